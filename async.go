@@ -0,0 +1,257 @@
+package httpteleport
+
+import (
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fastrpc"
+	"sync/atomic"
+	"time"
+)
+
+// DoAsync teleports the given request to the server set in Client.Addr
+// without blocking the caller.
+//
+// done is called with the result when the response is received or the
+// deadline is reached. The request is sent without waiting for the response,
+// while the response is passed to done by the goroutine reading responses
+// from the connection, so in-flight async requests don't occupy goroutines.
+// done must return quickly, since it delays reading other responses.
+// done may be called before DoAsync returns if the request cannot be sent.
+// req and resp mustn't be accessed until done is called.
+//
+// DoAsync never waits for a free slot, so ErrPendingRequestsOverflow
+// is passed to done if MaxPendingRequests limit is reached even if
+// WaitForPendingRequests is set. Middlewares aren't applied
+// to async requests.
+func (c *Client) DoAsync(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, done func(err error)) {
+	c.once.Do(c.init)
+	c.sendAsync([]*asyncCall{c.newAsyncCall(req, resp, done)}, deadline)
+}
+
+// DoBatch teleports the given requests to the server set in Client.Addr
+// without blocking the caller.
+//
+// All the requests are enqueued for sending at once, so they are sent
+// to the server in a single batch if they fit Client.MaxBatchDelay.
+// done is called once after all the responses are received or the deadline
+// is reached. errs[i] is the error for reqs[i], while resps[i] is
+// the response for reqs[i].
+//
+// See DoAsync for details.
+func (c *Client) DoBatch(reqs []*fasthttp.Request, resps []*fasthttp.Response, deadline time.Time, done func(errs []error)) {
+	if len(reqs) != len(resps) {
+		panic("BUG: reqs and resps must have the same length")
+	}
+	c.once.Do(c.init)
+	errs := make([]error, len(reqs))
+	if len(reqs) == 0 {
+		done(errs)
+		return
+	}
+	remaining := int32(len(reqs))
+	calls := make([]*asyncCall, len(reqs))
+	for i := range reqs {
+		errp := &errs[i]
+		calls[i] = c.newAsyncCall(reqs[i], resps[i], func(err error) {
+			*errp = err
+			if atomic.AddInt32(&remaining, -1) == 0 {
+				done(errs)
+			}
+		})
+	}
+	c.sendAsync(calls, deadline)
+}
+
+// asyncCall is the request sent via DoAsync or DoBatch.
+type asyncCall struct {
+	r         *responseReader
+	span      *traceSpan
+	startTime time.Time
+	done      func(err error)
+
+	// id is the id of the async request on the transport r.t.
+	id uint64
+
+	// timer fails the call with ErrTimeout on the deadline.
+	timer *time.Timer
+
+	// hasSlot is set if the call holds Client.pendingSem slot.
+	hasSlot bool
+
+	// sent is set after fastrpc sends the request.
+	sent bool
+
+	// refs is the number of references to the call. The waiter holds
+	// the reference until the result is known, while fastrpc holds
+	// the reference until the request is sent. done is called after
+	// both references are released, so req isn't accessed after that.
+	refs int32
+
+	err error
+}
+
+func (c *Client) newAsyncCall(req *fasthttp.Request, resp *fasthttp.Response, done func(err error)) *asyncCall {
+	a := &asyncCall{
+		r: &responseReader{
+			Response: resp,
+			c:        c,
+			req:      req,
+		},
+		startTime: time.Now(),
+		done:      done,
+		refs:      1,
+	}
+	if c.Tracer != nil {
+		a.span = newTraceSpan(c.Tracer.StartSpan("httpteleport.Client", traceContextFromRequest(req), req))
+	}
+	return a
+}
+
+// sendAsync enqueues the given calls for sending to the server
+// without waiting.
+func (c *Client) sendAsync(calls []*asyncCall, deadline time.Time) {
+	n := 0
+	for _, a := range calls {
+		if a.r.req.IsBodyStream() {
+			a.finish(errNoBodyStream)
+			continue
+		}
+		a.r.Reset()
+		calls[n] = a
+		n++
+	}
+	calls = calls[:n]
+	if len(calls) == 0 {
+		return
+	}
+
+	timeout := -time.Since(deadline)
+	if timeout <= 0 {
+		failAsyncCalls(calls, ErrTimeout)
+		return
+	}
+	if c.pendingSem != nil {
+		if !c.pendingSem.tryAcquire(len(calls)) {
+			failAsyncCalls(calls, ErrPendingRequestsOverflow)
+			return
+		}
+		for _, a := range calls {
+			a.hasSlot = true
+		}
+	}
+	t, err := c.acquireTransport(len(calls))
+	if err != nil {
+		failAsyncCalls(calls, err)
+		return
+	}
+	for _, a := range calls {
+		a.r.t = t
+	}
+
+	t.addAsyncWaiters(calls, timeout)
+	for _, a := range calls {
+		if c.OnRequestQueued != nil {
+			c.OnRequestQueued(a.r.req)
+		}
+		if !t.c.SendNowait(requestWriter{a.r.req, t, a.span, a}, releaseAsyncRequest) {
+			// fastrpc doesn't release the request it didn't accept.
+			if t.takeDeferredWaiter(a.key()) != nil {
+				a.finish(ErrPendingRequestsOverflow)
+			}
+			a.release()
+		}
+	}
+}
+
+func failAsyncCalls(calls []*asyncCall, err error) {
+	for _, a := range calls {
+		a.finish(err)
+	}
+}
+
+// addAsyncWaiters registers the given calls as waiting for responses.
+func (t *clientTransport) addAsyncWaiters(calls []*asyncCall, timeout time.Duration) {
+	startPoller := false
+	t.deferredMu.Lock()
+	for _, a := range calls {
+		t.lastAsyncID++
+		a.id = t.lastAsyncID
+		// The reference for fastrpc.
+		a.refs++
+		a.timer = time.AfterFunc(timeout, a.timeout)
+		w := &deferredWaiter{
+			key:   a.key(),
+			r:     a.r,
+			async: a,
+		}
+		if t.addWaiterLocked(w) {
+			startPoller = true
+		}
+	}
+	t.deferredMu.Unlock()
+
+	if startPoller {
+		go t.poller()
+	}
+}
+
+// key returns the key of the response in poll responses.
+func (a *asyncCall) key() uint64 {
+	return a.id<<1 | 1
+}
+
+func (a *asyncCall) timeout() {
+	if a.r.t.takeDeferredWaiter(a.key()) != nil {
+		a.finish(ErrTimeout)
+	}
+}
+
+// finish sets the result of the call and releases the waiter reference.
+//
+// It must be called once by the owner of the waiter.
+func (a *asyncCall) finish(err error) {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	a.err = err
+	a.release()
+}
+
+// releaseAsyncRequest is called by fastrpc after the request is sent.
+func releaseAsyncRequest(w fastrpc.RequestWriter) {
+	a := w.(requestWriter).async
+	a.sent = true
+	atomic.AddInt32(&a.r.t.asyncInFlight, 1)
+	a.release()
+}
+
+func (a *asyncCall) release() {
+	if atomic.AddInt32(&a.refs, -1) == 0 {
+		a.complete()
+	}
+}
+
+// complete releases resources occupied by the call and calls done.
+func (a *asyncCall) complete() {
+	c := a.r.c
+	if t := a.r.t; t != nil {
+		if a.sent {
+			atomic.AddInt32(&t.asyncInFlight, -1)
+		}
+		c.releaseTransport(t)
+	}
+	if a.hasSlot {
+		c.pendingSem.release()
+	}
+	err := a.err
+	if err == nil {
+		err = a.r.err
+	}
+	c.stats.addResult(err, time.Since(a.startTime))
+	if a.span != nil {
+		a.span.end(err)
+	}
+	if c.OnRequestDone != nil {
+		c.OnRequestDone(a.r.req, a.r.Response, err)
+	}
+	a.done(err)
+}
@@ -0,0 +1,65 @@
+package httpteleport
+
+import (
+	"sync"
+)
+
+// memoryBudget limits the number of bytes buffered by Server.
+type memoryBudget struct {
+	maxBytes int64
+
+	mu    sync.Mutex
+	cond  *sync.Cond
+	bytes int64
+}
+
+func newMemoryBudget(maxBytes int) *memoryBudget {
+	b := &memoryBudget{
+		maxBytes: int64(maxBytes),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire waits until n bytes fit the budget and then acquires them.
+//
+// n bytes are acquired immediately if the budget is empty, so requests
+// exceeding the budget are still processed one at a time.
+func (b *memoryBudget) acquire(n int64) {
+	b.mu.Lock()
+	for b.bytes > 0 && b.bytes+n > b.maxBytes {
+		b.cond.Wait()
+	}
+	b.bytes += n
+	b.mu.Unlock()
+}
+
+// forceAcquire acquires n bytes without waiting.
+//
+// It is used for accounting already allocated memory.
+func (b *memoryBudget) forceAcquire(n int64) {
+	b.mu.Lock()
+	b.bytes += n
+	b.mu.Unlock()
+}
+
+func (b *memoryBudget) release(n int64) {
+	if n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.bytes -= n
+	if b.bytes < 0 {
+		b.mu.Unlock()
+		panic("BUG: negative memory budget usage")
+	}
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *memoryBudget) usage() int64 {
+	b.mu.Lock()
+	n := b.bytes
+	b.mu.Unlock()
+	return n
+}
@@ -0,0 +1,178 @@
+package httpteleport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CertReloader loads TLS certificates from files and reloads them
+// without restart.
+//
+// Pass CertReloader.GetCertificate to tls.Config.GetCertificate
+// in Server.TLSConfig in order to serve the most recently loaded
+// certificates. Call CertReloader.Reload or CertReloader.Watch
+// for reloading certificates.
+type CertReloader struct {
+	certFiles []string
+	keyFiles  []string
+
+	// certs contains []tls.Certificate
+	certs atomic.Value
+
+	mu     sync.Mutex
+	states []fileState
+}
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewCertReloader loads certificates from the given cert and key files.
+//
+// certFiles[i] must correspond to keyFiles[i].
+func NewCertReloader(certFiles, keyFiles []string) (*CertReloader, error) {
+	if len(certFiles) == 0 {
+		return nil, fmt.Errorf("certFiles cannot be empty")
+	}
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("certFiles and keyFiles sizes mismatch: %d vs %d", len(certFiles), len(keyFiles))
+	}
+	cr := &CertReloader{
+		certFiles: append([]string{}, certFiles...),
+		keyFiles:  append([]string{}, keyFiles...),
+	}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// GetCertificate returns the certificate for the given client hello.
+//
+// The first certificate is returned if none of the certificates
+// is supported by the client.
+//
+// This function may be used as tls.Config.GetCertificate.
+func (cr *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := cr.certs.Load().([]tls.Certificate)
+	if len(certs) > 1 {
+		for i := range certs {
+			if hello.SupportsCertificate(&certs[i]) == nil {
+				return &certs[i], nil
+			}
+		}
+	}
+	return &certs[0], nil
+}
+
+// Reload re-reads certificates from files.
+//
+// Previously loaded certificates remain in use on error.
+func (cr *CertReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	states, err := cr.readStates()
+	if err != nil {
+		return err
+	}
+	return cr.reload(states)
+}
+
+func (cr *CertReloader) reload(states []fileState) error {
+	certs := make([]tls.Certificate, 0, len(cr.certFiles))
+	for i, certFile := range cr.certFiles {
+		keyFile := cr.keyFiles[i]
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("cannot load TLS certificate for cert=%q, key=%q: %s", certFile, keyFile, err)
+		}
+		if cert.Leaf == nil {
+			// Parse the leaf certificate once, so GetCertificate
+			// doesn't parse it on each call.
+			if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("cannot parse TLS certificate %q: %s", certFile, err)
+			}
+		}
+		certs = append(certs, cert)
+	}
+	cr.certs.Store(certs)
+	cr.states = states
+	return nil
+}
+
+// Watch checks cert and key files for changes every interval
+// and reloads certificates if the files are changed.
+//
+// Watch returns immediately. Files are checked until stopCh is closed.
+// Reload errors are logged to the given logger, previously loaded
+// certificates remain in use on errors. Errors aren't logged
+// if logger is nil.
+func (cr *CertReloader) Watch(interval time.Duration, stopCh <-chan struct{}, logger fasthttp.Logger) {
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := cr.reloadIfChanged(); err != nil {
+					logger.Printf("cannot reload TLS certificates: %s", err)
+				}
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, args ...interface{}) {}
+
+func (cr *CertReloader) reloadIfChanged() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	states, err := cr.readStates()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for i, st := range states {
+		if st != cr.states[i] {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return cr.reload(states)
+}
+
+func (cr *CertReloader) readStates() ([]fileState, error) {
+	var states []fileState
+	for i := range cr.certFiles {
+		for _, path := range []string{cr.certFiles[i], cr.keyFiles[i]} {
+			fi, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, fileState{
+				modTime: fi.ModTime(),
+				size:    fi.Size(),
+			})
+		}
+	}
+	return states, nil
+}
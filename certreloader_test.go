@@ -0,0 +1,190 @@
+package httpteleport
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertReloaderReload(t *testing.T) {
+	certFile, keyFile, cleanup := newTestCertFiles(t)
+	defer cleanup()
+
+	cr, err := NewCertReloader([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatalf("cannot create cert reloader: %s", err)
+	}
+	cert := testGetCertificate(t, cr)
+	if !bytes.Equal(cert.Certificate[0], testReadCert(t, "./ssl-cert-snakeoil.pem", "./ssl-cert-snakeoil.key")) {
+		t.Fatalf("unexpected initial certificate")
+	}
+
+	newCert := writeTestCert(t, certFile, keyFile)
+	if err := cr.Reload(); err != nil {
+		t.Fatalf("cannot reload certificates: %s", err)
+	}
+	cert = testGetCertificate(t, cr)
+	if !bytes.Equal(cert.Certificate[0], newCert) {
+		t.Fatalf("certificate hasn't been reloaded")
+	}
+
+	// Broken files mustn't break the previously loaded certificate.
+	if err := ioutil.WriteFile(keyFile, []byte("broken key"), 0600); err != nil {
+		t.Fatalf("cannot write key file: %s", err)
+	}
+	if err := cr.Reload(); err == nil {
+		t.Fatalf("expecting non-nil error when reloading broken key")
+	}
+	cert = testGetCertificate(t, cr)
+	if !bytes.Equal(cert.Certificate[0], newCert) {
+		t.Fatalf("unexpected certificate after reload error")
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	certFile, keyFile, cleanup := newTestCertFiles(t)
+	defer cleanup()
+
+	cr, err := NewCertReloader([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatalf("cannot create cert reloader: %s", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cr.Watch(10*time.Millisecond, stopCh, &nilLogger{})
+
+	newCert := writeTestCert(t, certFile, keyFile)
+	deadline := time.Now().Add(time.Second)
+	for {
+		cert := testGetCertificate(t, cr)
+		if bytes.Equal(cert.Certificate[0], newCert) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("certificate hasn't been reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestCertReloaderWatchNilLogger(t *testing.T) {
+	certFile, keyFile, cleanup := newTestCertFiles(t)
+	defer cleanup()
+
+	cr, err := NewCertReloader([]string{certFile}, []string{keyFile})
+	if err != nil {
+		t.Fatalf("cannot create cert reloader: %s", err)
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cr.Watch(10*time.Millisecond, stopCh, nil)
+
+	// Reload errors mustn't stop the watcher if logger is nil.
+	if err := ioutil.WriteFile(keyFile, []byte("broken key"), 0600); err != nil {
+		t.Fatalf("cannot write key file: %s", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	newCert := writeTestCert(t, certFile, keyFile)
+	err = testWaitFor(func() bool {
+		cert := testGetCertificate(t, cr)
+		return bytes.Equal(cert.Certificate[0], newCert)
+	})
+	if err != nil {
+		t.Fatalf("certificate hasn't been reloaded: %s", err)
+	}
+}
+
+func TestCertReloaderInvalidFiles(t *testing.T) {
+	if _, err := NewCertReloader(nil, nil); err == nil {
+		t.Fatalf("expecting non-nil error for empty files")
+	}
+	if _, err := NewCertReloader([]string{"./ssl-cert-snakeoil.pem"}, nil); err == nil {
+		t.Fatalf("expecting non-nil error for files mismatch")
+	}
+	if _, err := NewCertReloader([]string{"./missing.pem"}, []string{"./missing.key"}); err == nil {
+		t.Fatalf("expecting non-nil error for missing files")
+	}
+}
+
+func testGetCertificate(t *testing.T, cr *CertReloader) *tls.Certificate {
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("cannot obtain certificate: %s", err)
+	}
+	return cert
+}
+
+func testReadCert(t *testing.T, certFile, keyFile string) []byte {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("cannot load certificate: %s", err)
+	}
+	return cert.Certificate[0]
+}
+
+// newTestCertFiles copies the snakeoil certificate to a temporary
+// directory.
+func newTestCertFiles(t *testing.T) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "httpteleport-cert")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "cert.key")
+	for src, dst := range map[string]string{
+		"./ssl-cert-snakeoil.pem": certFile,
+		"./ssl-cert-snakeoil.key": keyFile,
+	} {
+		data, err := ioutil.ReadFile(src)
+		if err != nil {
+			t.Fatalf("cannot read %q: %s", src, err)
+		}
+		if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+			t.Fatalf("cannot write %q: %s", dst, err)
+		}
+	}
+	return certFile, keyFile, func() { os.RemoveAll(dir) }
+}
+
+// writeTestCert writes new self-signed certificate to the given files
+// and returns DER bytes for the certificate.
+func writeTestCert(t *testing.T, certFile, keyFile string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "httpteleport test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal key: %s", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", certFile, err)
+	}
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", keyFile, err)
+	}
+	return der
+}
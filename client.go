@@ -3,11 +3,14 @@ package httpteleport
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastrpc"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +34,43 @@ type Client struct {
 	// fasthttp.Dial is used by default.
 	Dial func(addr string) (net.Conn, error)
 
+	// Name is the client name sent to the server in the handshake.
+	//
+	// The server exposes the name to request handlers via GetConnInfo,
+	// so it may be used for per-client authorization and logging.
+	// Name is sent in plaintext before TLS is established, so it
+	// mustn't contain sensitive information. Name length cannot exceed
+	// 255 bytes.
+	//
+	// By default the name isn't sent.
+	Name string
+
+	// Version is the client version sent to the server in the handshake.
+	//
+	// The server exposes the version to request handlers via GetConnInfo.
+	// Version is sent in plaintext before TLS is established.
+	// Version length cannot exceed 255 bytes.
+	//
+	// By default the version isn't sent.
+	Version string
+
+	// AuthKey is the pre-shared key used for authenticating the client
+	// on the server.
+	//
+	// The key must be registered in Server.AuthKeys.
+	//
+	// By default the client doesn't authenticate on the server.
+	AuthKey *AuthKey
+
+	// ReverseHandler handles requests sent by the server over
+	// the connection established by the client.
+	//
+	// This allows the server to send requests to clients behind NAT.
+	// The server sends requests via ReverseClient.
+	//
+	// By default the client doesn't accept requests from the server.
+	ReverseHandler fasthttp.RequestHandler
+
 	// TLSConfig is TLS (aka SSL) config used for establishing encrypted
 	// connection to the server.
 	//
@@ -46,6 +86,23 @@ type Client struct {
 	// DefaultMaxPendingRequests is used by default.
 	MaxPendingRequests int
 
+	// WaitForPendingRequests makes DoDeadline wait until the number
+	// of pending requests drops below MaxPendingRequests instead
+	// of returning ErrPendingRequestsOverflow.
+	//
+	// Waiting requests are sent in FIFO order. ErrTimeout is returned
+	// if a free slot isn't obtained until the deadline.
+	//
+	// Wait statistics may be obtained via PendingRequestsWaits
+	// and PendingRequestsWaitDuration.
+	//
+	// Pings and polls for deferred responses don't count towards
+	// MaxPendingRequests in this case, so they never make requests
+	// fail with ErrPendingRequestsOverflow.
+	//
+	// By default ErrPendingRequestsOverflow is returned immediately.
+	WaitForPendingRequests bool
+
 	// MaxBatchDelay is the maximum duration before pending requests
 	// are sent to the server.
 	//
@@ -56,7 +113,8 @@ type Client struct {
 
 	// Maximum duration for full response reading (including body).
 	//
-	// This also limits idle connection lifetime duration.
+	// This also limits idle connection lifetime duration unless
+	// PingInterval is set to a smaller value.
 	//
 	// By default response read timeout is unlimited.
 	ReadTimeout time.Duration
@@ -66,6 +124,134 @@ type Client struct {
 	// By default request write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// PingInterval is the interval for sending pings to the server.
+	//
+	// Pings keep idle connections alive, detect dead servers without
+	// waiting for request timeouts and measure round-trip time
+	// exposed via RTT.
+	//
+	// By default pings aren't sent.
+	PingInterval time.Duration
+
+	// PingTimeout is the maximum duration for waiting for ping response.
+	//
+	// The connection is closed and then re-established if the server
+	// doesn't respond to ping during PingTimeout. Timed out pings don't
+	// close the connection if other data has been read from the server
+	// during PingTimeout, since the server may delay reading pings due
+	// to backpressure such as Server.MaxBufferedBytes.
+	//
+	// PingInterval is used by default.
+	PingTimeout time.Duration
+
+	// ReconnectDelay is the initial delay before reconnecting to the server
+	// after failed dial.
+	//
+	// The delay is doubled after each subsequent failed dial
+	// until it reaches MaxReconnectDelay. The delay is reset after
+	// the connection is established.
+	//
+	// By default the client reconnects without additional delays.
+	ReconnectDelay time.Duration
+
+	// MaxReconnectDelay is the maximum delay before reconnecting
+	// to the server.
+	//
+	// 30 seconds is used by default.
+	MaxReconnectDelay time.Duration
+
+	// ReconnectJitter randomizes reconnect delays by the given share
+	// in the range (0..1], so clients don't reconnect simultaneously
+	// after server restart. For instance, ReconnectJitter=0.2 randomizes
+	// 1s delay in the range [0.8s..1.2s).
+	//
+	// By default reconnect delays aren't randomized.
+	ReconnectJitter float64
+
+	// OnConnStateChange is called when the connection to the server
+	// changes its state.
+	//
+	// err contains the reason for ConnDisconnected state. It is nil
+	// for other states.
+	//
+	// The connection drained on server request is closed without
+	// ConnDisconnected state, since the client switches to the new
+	// connection. See Server.Drain for details.
+	//
+	// The callback may be used for alerting about broken connections
+	// and for routing requests around them. It must return quickly,
+	// since it blocks establishing and closing connections.
+	//
+	// By default connection state changes aren't reported.
+	OnConnStateChange func(state ConnState, err error)
+
+	// Tracer creates client spans for requests.
+	//
+	// The span parent is taken from the traceparent request header.
+	// The span context is sent to the server in the request frame
+	// regardless of request headers. See SpanEvent* constants
+	// for the recorded events.
+	//
+	// By default requests aren't traced.
+	Tracer Tracer
+
+	// Middlewares wrap requests sent via DoDeadline and DoTimeout.
+	//
+	// Middlewares[0] is called first. The last middleware calls
+	// the Client itself.
+	//
+	// Middlewares may be used for adding headers, measuring timings
+	// and logging failures for all the requests sent by the client.
+	Middlewares []Middleware
+
+	// OnRequestQueued is called when req is queued for sending
+	// to the server.
+	//
+	// The request may wait for the connection and for a free slot
+	// limited by MaxPendingRequests before queueing.
+	OnRequestQueued func(req *fasthttp.Request)
+
+	// OnRequestSent is called when req is added to the batch, which is
+	// sent to the server after MaxBatchDelay.
+	//
+	// It isn't called for requests timed out before sending.
+	OnRequestSent func(req *fasthttp.Request)
+
+	// OnResponseFirstByte is called when the client starts reading
+	// the response to req.
+	//
+	// It is called only once for deferred responses - when the response
+	// itself arrives, not when the server notifies the client
+	// the response is deferred.
+	//
+	// It isn't called for requests timed out before the response arrives.
+	OnResponseFirstByte func(req *fasthttp.Request)
+
+	// OnRequestDone is called when DoDeadline for req returns err.
+	//
+	// resp must not be retained after returning from the callback.
+	OnRequestDone func(req *fasthttp.Request, resp *fasthttp.Response, err error)
+
+	// MaxResponseBodySize is the maximum response body size the client reads.
+	//
+	// DoDeadline returns ErrResponseBodyTooLarge for responses with bigger
+	// bodies. The connection remains open, so other responses
+	// are read as usual.
+	//
+	// By default response body size is unlimited.
+	MaxResponseBodySize int
+
+	// MaxResponseHeaderSize is the maximum response header size.
+	//
+	// DoDeadline returns ErrResponseHeaderTooLarge for responses with bigger
+	// headers. The connection remains open, so other responses
+	// are read as usual.
+	//
+	// Response headers cannot exceed ReadBufferSize in any case.
+	//
+	// By default response header size is limited only by ReadBufferSize.
+	MaxResponseHeaderSize int
+
 	// ReadBufferSize is the size for read buffer.
 	//
 	// DefaultReadBufferSize is used by default.
@@ -77,7 +263,47 @@ type Client struct {
 	WriteBufferSize int
 
 	once sync.Once
-	c    fastrpc.Client
+
+	// doer calls Middlewares.
+	doer Doer
+
+	stats clientCounters
+
+	pendingSem *fifoSemaphore
+
+	reverseServer Server
+
+	pendingWaits     uint64
+	pendingWaitNanos uint64
+
+	rttNanos uint64
+
+	dialFailures uint32
+
+	loadRunning     uint32
+	loadQueued      uint32
+	loadConcurrency uint32
+
+	// drainMu protects the fields below, which are used for draining
+	// connections on server requests. See Server.Drain for details.
+	drainMu sync.Mutex
+
+	// t is the transport new requests are sent to.
+	t *clientTransport
+
+	// draining contains transports with draining connections.
+	draining []*clientTransport
+
+	// idleTransports contains drained transports, which may be reused.
+	idleTransports []*clientTransport
+
+	// addr is the server address. It differs from Addr only after
+	// the client is reused by ResolvingClient for another address.
+	addr string
+
+	redirectAddr string
+	drains       uint64
+	stopped      bool
 }
 
 var (
@@ -87,6 +313,14 @@ var (
 	// ErrPendingRequestsOverflow is returned when Client cannot send
 	// more requests to the server due to Client.MaxPendingRequests limit.
 	ErrPendingRequestsOverflow = fastrpc.ErrPendingRequestsOverflow
+
+	// ErrResponseBodyTooLarge is returned when response body exceeds
+	// Client.MaxResponseBodySize.
+	ErrResponseBodyTooLarge = errors.New("response body exceeds Client.MaxResponseBodySize")
+
+	// ErrResponseHeaderTooLarge is returned when response header exceeds
+	// Client.MaxResponseHeaderSize.
+	ErrResponseHeaderTooLarge = errors.New("response header exceeds Client.MaxResponseHeaderSize")
 )
 
 // DoTimeout teleports the given request to the server set in Client.Addr.
@@ -106,28 +340,156 @@ var errNoBodyStream = errors.New("requests with body streams aren't supported")
 // the given deadline.
 func (c *Client) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
 	c.once.Do(c.init)
+	return c.doer.DoDeadline(req, resp, deadline)
+}
+
+// do teleports the given request without Middlewares.
+func (c *Client) do(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	startTime := time.Now()
+	var span *traceSpan
+	if c.Tracer != nil {
+		span = newTraceSpan(c.Tracer.StartSpan("httpteleport.Client", traceContextFromRequest(req), req))
+	}
+	err := c.doDeadline(req, resp, deadline, span)
+	c.stats.addResult(err, time.Since(startTime))
+	if span != nil {
+		span.end(err)
+	}
+	if c.OnRequestDone != nil {
+		c.OnRequestDone(req, resp, err)
+	}
+	return err
+}
+
+func (c *Client) doDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time, span *traceSpan) error {
 	if req.IsBodyStream() {
 		return errNoBodyStream
 	}
 	resp.Reset()
-	return c.c.DoDeadline(requestWriter{req}, responseReader{resp}, deadline)
+	if c.pendingSem != nil {
+		d, ok := c.pendingSem.acquire(deadline)
+		if d > 0 {
+			atomic.AddUint64(&c.pendingWaits, 1)
+			atomic.AddUint64(&c.pendingWaitNanos, uint64(d))
+		}
+		if !ok {
+			return ErrTimeout
+		}
+		defer c.pendingSem.release()
+	}
+	t, err := c.acquireTransport(1)
+	if err != nil {
+		return err
+	}
+	defer c.releaseTransport(t)
+	if c.OnRequestQueued != nil {
+		c.OnRequestQueued(req)
+	}
+	r := &responseReader{
+		Response: resp,
+		c:        c,
+		t:        t,
+		req:      req,
+	}
+	if err := t.c.DoDeadline(requestWriter{req, t, span, nil}, r, deadline); err != nil {
+		return err
+	}
+	if r.deferred != nil {
+		if err := t.waitDeferred(r.deferred, deadline); err != nil {
+			return err
+		}
+	}
+	return r.err
 }
 
+// reservedPendingRequests is the number of pending requests reserved
+// for the ping and the poll if Client.WaitForPendingRequests is set.
+//
+// There is at most one ping per connection and at most one poll
+// per Client in flight.
+const reservedPendingRequests = 2
+
 func (c *Client) init() {
-	c.c.SniffHeader = sniffHeader
-	c.c.ProtocolVersion = protocolVersion
-	c.c.NewResponse = newResponse
-
-	c.c.Addr = c.Addr
-	c.c.CompressType = fastrpc.CompressType(c.CompressType)
-	c.c.Dial = c.Dial
-	c.c.TLSConfig = c.TLSConfig
-	c.c.MaxPendingRequests = c.MaxPendingRequests
-	c.c.MaxBatchDelay = c.MaxBatchDelay
-	c.c.ReadTimeout = c.ReadTimeout
-	c.c.WriteTimeout = c.WriteTimeout
-	c.c.ReadBufferSize = c.ReadBufferSize
-	c.c.WriteBufferSize = c.WriteBufferSize
+	c.doer = applyMiddlewares(DoerFunc(c.do), c.Middlewares)
+
+	if c.ReverseHandler != nil {
+		c.reverseServer.Handler = c.ReverseHandler
+		c.reverseServer.CompressType = c.CompressType
+		c.reverseServer.init()
+	}
+
+	if c.WaitForPendingRequests {
+		maxPendingRequests := c.MaxPendingRequests
+		if maxPendingRequests <= 0 {
+			maxPendingRequests = fastrpc.DefaultMaxPendingRequests
+		}
+		c.pendingSem = newFIFOSemaphore(maxPendingRequests)
+	}
+
+	c.drainMu.Lock()
+	c.addr = c.Addr
+	c.t = c.newTransport()
+	c.drainMu.Unlock()
+}
+
+// dial establishes the connection for the transport t.
+func (c *Client) dial(t *clientTransport) (net.Conn, error) {
+	c.waitReconnect()
+	c.setConnState(ConnDialing, nil)
+	conn, err := c.dialConn()
+	c.stats.addDial(err)
+	if err != nil {
+		atomic.AddUint32(&c.dialFailures, 1)
+		c.setConnState(ConnDisconnected, err)
+		return nil, err
+	}
+	atomic.StoreUint32(&c.dialFailures, 0)
+
+	cc := newClientConn(conn, t)
+	if !c.setConn(t, cc) {
+		// The transport has been drained or stopped while dialing.
+		cc.closeWithError(errConnDrained)
+		return nil, errConnDrained
+	}
+	if c.PingInterval > 0 {
+		go c.pinger(cc)
+	}
+	c.setConnState(ConnConnected, nil)
+	return cc, nil
+}
+
+func (c *Client) dialConn() (net.Conn, error) {
+	dial := c.Dial
+	if dial == nil {
+		dial = fasthttp.Dial
+	}
+	addr, redirected := c.dialAddr()
+	conn, err := dial(addr)
+	if err != nil && redirected {
+		// The server the client has been redirected to on drain
+		// is unavailable, so fall back to Client.Addr.
+		c.resetRedirect(addr)
+		addr, _ = c.dialAddr()
+		conn, err = dial(addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.needsHandshake() {
+		if err = handshakeClient(conn, c); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("handshake error with %q: %s", addr, err)
+		}
+	}
+	if c.ReverseHandler == nil {
+		return conn, nil
+	}
+	bc, err := c.newBidiConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot establish bidirectional connection with %q: %s", addr, err)
+	}
+	return bc, nil
 }
 
 // PendingRequests returns the number of pending requests at the moment.
@@ -135,25 +497,218 @@ func (c *Client) init() {
 // This function may be used either for informational purposes
 // or for load balancing purposes.
 func (c *Client) PendingRequests() int {
-	return c.c.PendingRequests()
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if c.t == nil {
+		return 0
+	}
+	n := c.t.pendingRequests()
+	for _, t := range c.draining {
+		n += t.pendingRequests()
+	}
+	return n
+}
+
+// PendingRequestsWaits returns the number of requests, which waited
+// for a free slot due to MaxPendingRequests limit.
+//
+// See WaitForPendingRequests for details.
+func (c *Client) PendingRequestsWaits() uint64 {
+	return atomic.LoadUint64(&c.pendingWaits)
+}
+
+// PendingRequestsWaitDuration returns the total duration requests spent
+// waiting for a free slot due to MaxPendingRequests limit.
+//
+// See WaitForPendingRequests for details.
+func (c *Client) PendingRequestsWaitDuration() time.Duration {
+	return time.Duration(atomic.LoadUint64(&c.pendingWaitNanos))
 }
 
 type requestWriter struct {
 	*fasthttp.Request
+	t *clientTransport
+
+	// span is set if the request is traced.
+	span *traceSpan
+
+	// async is set if the request is sent via DoAsync or DoBatch.
+	async *asyncCall
 }
 
 func (w requestWriter) WriteRequest(bw *bufio.Writer) error {
-	return w.Write(bw)
+	c := w.t.owner
+	var b [1 + traceContextSize + binary.MaxVarintLen64]byte
+	buf := append(b[:0], messageHTTP)
+	if w.span != nil {
+		buf[0] |= messageFlagTrace
+		buf = appendTraceContext(buf, w.span.s.Context())
+	}
+	if w.async != nil {
+		buf[0] |= messageFlagAsync
+		buf = appendUvarint(buf, w.async.id)
+	}
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	if err := w.Write(bw); err != nil {
+		return err
+	}
+	atomic.AddUint64(&c.stats.uncompressedBytesWritten, uint64(requestSize(w.Request)))
+	atomic.AddUint64(&c.stats.unflushed, 1)
+	if w.span != nil {
+		w.span.addEvent(SpanEventWritten, time.Now())
+		w.t.flushSpans.add(w.span)
+	}
+	if c.OnRequestSent != nil {
+		c.OnRequestSent(w.Request)
+	}
+	return nil
 }
 
+// responseReader reads responses with Client.MaxResponse* limits.
 type responseReader struct {
 	*fasthttp.Response
+	c   *Client
+	t   *clientTransport
+	req *fasthttp.Request
+
+	// deferred is set if the server deferred the response.
+	deferred *deferredWaiter
+
+	err error
 }
 
-func (r responseReader) ReadResponse(br *bufio.Reader) error {
-	return r.Read(br)
+func (r *responseReader) ReadResponse(br *bufio.Reader) error {
+	typ, err := r.t.readMessageType(br)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case messageHTTP:
+		return r.readHTTP(br)
+	case messageDeferred:
+		id, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("cannot read deferred response id: %s", err)
+		}
+		r.deferred = r.t.addDeferredWaiter(id, r)
+		return nil
+	default:
+		return fmt.Errorf("unexpected message type: %d. Expecting %d", typ, messageHTTP)
+	}
 }
 
-func newResponse() fastrpc.ResponseReader {
-	return responseReader{&fasthttp.Response{}}
+// readHTTP reads http response without the message type from br.
+//
+// It is called for both immediate and deferred responses.
+func (r *responseReader) readHTTP(br *bufio.Reader) error {
+	if r.c.OnResponseFirstByte != nil {
+		r.c.OnResponseFirstByte(r.req)
+	}
+	if r.c.MaxResponseBodySize <= 0 && r.c.MaxResponseHeaderSize <= 0 {
+		if err := r.Read(br); err != nil {
+			return err
+		}
+		atomic.AddUint64(&r.c.stats.uncompressedBytesRead, uint64(responseSize(r.Response)))
+		return nil
+	}
+	err := r.ReadLimitBody(br, r.c.MaxResponseBodySize)
+	if err == fasthttp.ErrBodyTooLarge {
+		// Skip the body, so the following responses may be read from br.
+		n := r.Header.ContentLength()
+		if err = skipBody(br, n); err != nil {
+			return err
+		}
+		atomic.AddUint64(&r.c.stats.uncompressedBytesRead, uint64(responseSize(r.Response)+n))
+		r.Reset()
+		r.err = ErrResponseBodyTooLarge
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&r.c.stats.uncompressedBytesRead, uint64(responseSize(r.Response)))
+	if r.c.MaxResponseHeaderSize > 0 && len(r.Header.Header()) > r.c.MaxResponseHeaderSize {
+		r.Reset()
+		r.err = ErrResponseHeaderTooLarge
+	}
+	return nil
+}
+
+func (t *clientTransport) newResponse() fastrpc.ResponseReader {
+	return discardResponseReader{t}
+}
+
+// discardResponseReader reads responses for timed out requests,
+// pings and polls.
+type discardResponseReader struct {
+	t *clientTransport
+}
+
+func (r discardResponseReader) ReadResponse(br *bufio.Reader) error {
+	typ, err := r.t.readMessageType(br)
+	if err != nil {
+		return err
+	}
+	switch typ {
+	case messageHTTP:
+		resp := fasthttp.AcquireResponse()
+		err = resp.Read(br)
+		fasthttp.ReleaseResponse(resp)
+		return err
+	case messagePing:
+		return nil
+	case messageDeferred:
+		// The deferred response is discarded when it is received,
+		// since there is no waiter for it.
+		_, err = binary.ReadUvarint(br)
+		return err
+	case messagePoll:
+		// Deferred responses must be passed to waiters even if the poll
+		// has been timed out.
+		_, err = r.t.readDeferred(br)
+		return err
+	default:
+		return fmt.Errorf("unexpected message type: %d", typ)
+	}
+}
+
+// readMessageType reads the type of the message sent by the server.
+//
+// The client starts draining the connection if the server is draining.
+func (t *clientTransport) readMessageType(br *bufio.Reader) (byte, error) {
+	c := t.owner
+	typ, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if typ&messageFlagDrain != 0 {
+		addr, err := readHandshakeString(br)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read drain address: %s", err)
+		}
+		c.drain(t, addr)
+		typ &^= messageFlagDrain
+	}
+	if typ&messageFlagLoad != 0 {
+		if err := c.readServerLoad(br); err != nil {
+			return 0, fmt.Errorf("cannot read server load: %s", err)
+		}
+		typ &^= messageFlagLoad
+	}
+	return typ, nil
+}
+
+// expectMessageType reads the type of the message sent by the server
+// and verifies it matches the expected type.
+func (t *clientTransport) expectMessageType(br *bufio.Reader, expected byte) error {
+	typ, err := t.readMessageType(br)
+	if err != nil {
+		return err
+	}
+	if typ != expected {
+		return fmt.Errorf("unexpected message type: %d. Expecting %d", typ, expected)
+	}
+	return nil
 }
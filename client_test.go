@@ -6,6 +6,8 @@ import (
 	"github.com/valyala/fasthttp"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -106,3 +108,595 @@ func TestClientTimeout(t *testing.T) {
 
 	close(dialCh)
 }
+
+func TestClientMaxResponseSize(t *testing.T) {
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		switch string(ctx.Path()) {
+		case "/big-body":
+			ctx.SetBody(bytes.Repeat([]byte("x"), 101))
+		case "/big-header":
+			ctx.Response.Header.Set("X-Foo", strings.Repeat("x", 200))
+		default:
+			ctx.WriteString("ok")
+		}
+	})
+	c.MaxResponseBodySize = 100
+	c.MaxResponseHeaderSize = 200
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	for i := 0; i < 10; i++ {
+		req.SetRequestURI("http://foobar.com/big-body")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != ErrResponseBodyTooLarge {
+			t.Fatalf("unexpected error on iteration %d: %v. Expecting %s", i, err, ErrResponseBodyTooLarge)
+		}
+
+		req.SetRequestURI("http://foobar.com/big-header")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != ErrResponseHeaderTooLarge {
+			t.Fatalf("unexpected error on iteration %d: %v. Expecting %s", i, err, ErrResponseHeaderTooLarge)
+		}
+
+		// The connection must remain usable after rejected responses.
+		req.SetRequestURI("http://foobar.com/ok")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		if string(resp.Body()) != "ok" {
+			t.Fatalf("unexpected body on iteration %d: %q. Expecting %q", i, resp.Body(), "ok")
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientWaitForPendingRequests(t *testing.T) {
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(&Server{})
+	c := newTestClient(ln)
+	c.MaxPendingRequests = 2
+	c.WaitForPendingRequests = true
+
+	resultCh := testQuotaRequests(c, 2)
+	testQuotaHandlers(t, handlerCh, 2)
+
+	// The request must wait for a free slot until the deadline.
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/fast")
+	if err := c.DoTimeout(&req, &resp, 50*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v. Expecting %s", err, ErrTimeout)
+	}
+	if n := c.PendingRequestsWaits(); n != 1 {
+		t.Fatalf("unexpected number of waits: %d. Expecting 1", n)
+	}
+	// The deadline is set before the wait starts, so the wait may be
+	// slightly shorter than the request timeout.
+	if d := c.PendingRequestsWaitDuration(); d < 45*time.Millisecond {
+		t.Fatalf("unexpected wait duration: %s. Expecting at least 45ms", d)
+	}
+
+	// Waiting requests must be sent when slots are freed.
+	fastCh := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() {
+			fastCh <- testDone(c)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(doneCh)
+	testQuotaResults(t, resultCh, 2)
+	testQuotaResults(t, fastCh, 5)
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientWaitForPendingRequestsPings(t *testing.T) {
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		time.Sleep(time.Millisecond)
+		ctx.Success("text/plain", []byte("done"))
+	})
+	c := newTestClient(ln)
+	c.MaxPendingRequests = 2
+	c.WaitForPendingRequests = true
+	c.PingInterval = time.Millisecond
+	c.PingTimeout = time.Second
+
+	// Pings mustn't occupy slots obtained by waiting requests.
+	const workers = 10
+	resultCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for j := 0; j < 50; j++ {
+				if err := testDone(c); err != nil {
+					resultCh <- err
+					return
+				}
+			}
+			resultCh <- nil
+		}()
+	}
+	testQuotaResults(t, resultCh, workers)
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientDoAsync(t *testing.T) {
+	serverStop, c := newTestServerClient(testPostHandler)
+
+	const requests = 100
+	resultCh := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		req := &fasthttp.Request{}
+		resp := &fasthttp.Response{}
+		body := fmt.Sprintf("request %d", i)
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("http://foobar.com/aaa")
+		req.SetBodyString(body)
+		c.DoAsync(req, resp, time.Now().Add(time.Second), func(err error) {
+			if err == nil && string(resp.Body()) != body {
+				err = fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), body)
+			}
+			resultCh <- err
+		})
+	}
+	for i := 0; i < requests; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientDoBatch(t *testing.T) {
+	serverStop, c := newTestServerClient(testPostHandler)
+
+	const requests = 100
+	reqs := make([]*fasthttp.Request, requests)
+	resps := make([]*fasthttp.Response, requests)
+	for i := range reqs {
+		reqs[i] = &fasthttp.Request{}
+		reqs[i].Header.SetMethod("POST")
+		reqs[i].SetRequestURI("http://foobar.com/aaa")
+		reqs[i].SetBodyString(fmt.Sprintf("request %d", i))
+		resps[i] = &fasthttp.Response{}
+	}
+	for n := 0; n < 3; n++ {
+		errsCh := make(chan []error, 1)
+		c.DoBatch(reqs, resps, time.Now().Add(time.Second), func(errs []error) {
+			errsCh <- errs
+		})
+		var errs []error
+		select {
+		case errs = <-errsCh:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", n)
+		}
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("unexpected error for request %d: %s", i, err)
+			}
+			body := fmt.Sprintf("request %d", i)
+			if string(resps[i].Body()) != body {
+				t.Fatalf("unexpected body for request %d: %q. Expecting %q", i, resps[i].Body(), body)
+			}
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientDoBatchNoWait(t *testing.T) {
+	releaseCh := make(chan struct{})
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		<-releaseCh
+		ctx.SetBody(ctx.Request.Body())
+	})
+
+	const requests = 10
+	reqs := make([]*fasthttp.Request, requests)
+	resps := make([]*fasthttp.Response, requests)
+	for i := range reqs {
+		reqs[i] = &fasthttp.Request{}
+		reqs[i].Header.SetMethod("POST")
+		reqs[i].SetRequestURI("http://foobar.com/aaa")
+		reqs[i].SetBodyString(fmt.Sprintf("request %d", i))
+		resps[i] = &fasthttp.Response{}
+	}
+	errsCh := make(chan []error, 1)
+	returnedCh := make(chan struct{})
+	go func() {
+		c.DoBatch(reqs, resps, time.Now().Add(3*time.Second), func(errs []error) {
+			errsCh <- errs
+		})
+		close(returnedCh)
+	}()
+	select {
+	case <-returnedCh:
+	case <-time.After(time.Second):
+		t.Fatalf("DoBatch mustn't wait for responses")
+	}
+	select {
+	case <-errsCh:
+		t.Fatalf("done mustn't be called before responses are received")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(releaseCh)
+
+	select {
+	case errs := <-errsCh:
+		for i, err := range errs {
+			if err != nil {
+				t.Fatalf("unexpected error for request %d: %s", i, err)
+			}
+			body := fmt.Sprintf("request %d", i)
+			if string(resps[i].Body()) != body {
+				t.Fatalf("unexpected body for request %d: %q. Expecting %q", i, resps[i].Body(), body)
+			}
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientDoAsyncTimeout(t *testing.T) {
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/slow" {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ctx.Success("text/plain", ctx.Path())
+	})
+
+	doAsync := func(uri string, timeout time.Duration) (*fasthttp.Response, error) {
+		req := &fasthttp.Request{}
+		resp := &fasthttp.Response{}
+		req.SetRequestURI(uri)
+		errCh := make(chan error, 1)
+		c.DoAsync(req, resp, time.Now().Add(timeout), func(err error) {
+			errCh <- err
+		})
+		select {
+		case err := <-errCh:
+			return resp, err
+		case <-time.After(3 * time.Second):
+			return nil, fmt.Errorf("timeout")
+		}
+	}
+
+	if _, err := doAsync("http://foobar.com/slow", 20*time.Millisecond); err != ErrTimeout {
+		t.Fatalf("unexpected error: %v. Expecting %s", err, ErrTimeout)
+	}
+
+	// Wait until the response for the timed out request is received
+	// and discarded.
+	time.Sleep(150 * time.Millisecond)
+	resp, err := doAsync("http://foobar.com/fast", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "/fast" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "/fast")
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	var handlerCalls uint64
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		atomic.AddUint64(&handlerCalls, 1)
+		ctx.Success("text/plain", []byte("done"))
+	})
+	c := newTestClient(ln)
+	c.PingInterval = 10 * time.Millisecond
+
+	if c.RTT() != 0 {
+		t.Fatalf("unexpected RTT before pings: %s", c.RTT())
+	}
+	if err := testDone(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := testWaitFor(func() bool { return c.RTT() != 0 }); err != nil {
+		t.Fatalf("RTT isn't measured: %s", err)
+	}
+
+	// Wait for a few more pings. Each ping response is at least a byte.
+	bytesRead := c.Stats().BytesRead
+	if err := testWaitFor(func() bool { return c.Stats().BytesRead >= bytesRead+3 }); err != nil {
+		t.Fatalf("pings aren't sent: %s", err)
+	}
+
+	// Pings mustn't reach the handler.
+	if n := atomic.LoadUint64(&handlerCalls); n != 1 {
+		t.Fatalf("unexpected number of handler calls: %d. Expecting 1", n)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientPingTimeout(t *testing.T) {
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+	var dials uint32
+	blackholeCh := make(chan struct{})
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			conn, err := ln.Dial()
+			if err != nil {
+				return nil, err
+			}
+			if atomic.AddUint32(&dials, 1) > 1 {
+				return conn, nil
+			}
+			// The first connection stops delivering data to the server.
+			return &blackholeConn{
+				Conn:        conn,
+				blackholeCh: blackholeCh,
+			}, nil
+		},
+		PingInterval: 10 * time.Millisecond,
+		PingTimeout:  50 * time.Millisecond,
+	}
+
+	if err := testDone(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	close(blackholeCh)
+
+	// Pending requests mustn't prevent closing the dead connection.
+	pendingDoneCh := make(chan struct{})
+	go func() {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/pending")
+		c.DoTimeout(&req, &resp, 10*time.Second)
+		close(pendingDoneCh)
+	}()
+
+	// The dead connection must be closed after the ping timeout,
+	// so the request is sent over new connection.
+	if err := testWaitFor(func() bool { return atomic.LoadUint32(&dials) >= 2 }); err != nil {
+		t.Fatalf("the dead connection isn't closed after ping timeout: %s", err)
+	}
+	select {
+	case <-pendingDoneCh:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("the pending request isn't finished after the connection is closed")
+	}
+	if err := testDone(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientPingBackpressure(t *testing.T) {
+	const requests = 10
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			// Slow handlers hold the budget, so the server stops
+			// reading requests and pings from the connection,
+			// while responses are still sent.
+			time.Sleep(30 * time.Millisecond)
+			ctx.SetBody(ctx.Request.Body())
+		},
+		MaxBufferedBytes: 250,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.PingInterval = 10 * time.Millisecond
+	c.PingTimeout = 100 * time.Millisecond
+	var disconnects uint32
+	c.OnConnStateChange = func(state ConnState, err error) {
+		if state == ConnDisconnected {
+			atomic.AddUint32(&disconnects, 1)
+		}
+	}
+
+	body := bytes.Repeat([]byte("x"), 100)
+	resultCh := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			req.Header.SetMethod("POST")
+			req.SetRequestURI("http://foobar.com/baz")
+			req.SetBody(body)
+			if err := c.DoTimeout(&req, &resp, 3*time.Second); err != nil {
+				resultCh <- err
+				return
+			}
+			if !bytes.Equal(resp.Body(), body) {
+				resultCh <- fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), body)
+				return
+			}
+			resultCh <- nil
+		}()
+	}
+
+	// The connection mustn't be closed due to ping timeouts
+	// while the server is under backpressure.
+	for i := 0; i < requests; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+	if n := atomic.LoadUint32(&disconnects); n != 0 {
+		t.Fatalf("unexpected number of disconnects: %d. Expecting 0", n)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+// blackholeConn discards written data after blackholeCh is closed.
+type blackholeConn struct {
+	net.Conn
+	blackholeCh chan struct{}
+}
+
+func (c *blackholeConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.blackholeCh:
+		return len(p), nil
+	default:
+		return c.Conn.Write(p)
+	}
+}
+
+func TestClientReconnectDelay(t *testing.T) {
+	var mu sync.Mutex
+	var dialTimes []time.Time
+	errDial := fmt.Errorf("dial error")
+	stateCh := make(chan ConnState, 100)
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			mu.Lock()
+			dialTimes = append(dialTimes, time.Now())
+			mu.Unlock()
+			return nil, errDial
+		},
+		ReconnectDelay:    50 * time.Millisecond,
+		MaxReconnectDelay: 100 * time.Millisecond,
+		OnConnStateChange: func(state ConnState, err error) {
+			if state == ConnDisconnected && err != errDial {
+				t.Errorf("unexpected error: %v. Expecting %s", err, errDial)
+			}
+			stateCh <- state
+		},
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	var times []time.Time
+	err := testWaitFor(func() bool {
+		if err := c.DoTimeout(&req, &resp, 50*time.Millisecond); err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+		mu.Lock()
+		times = append(times[:0], dialTimes...)
+		mu.Unlock()
+		return len(times) >= 3
+	})
+	if err != nil {
+		t.Fatalf("too small number of dials: %d. Expecting at least 3", len(times))
+	}
+	expectedDelays := []time.Duration{50 * time.Millisecond, 100 * time.Millisecond}
+	for i, d := range expectedDelays {
+		if delay := times[i+1].Sub(times[i]); delay < d {
+			t.Fatalf("unexpected delay before dial #%d: %s. Expecting at least %s", i+2, delay, d)
+		}
+	}
+
+	for i := 0; i < 2*len(times); i++ {
+		state := <-stateCh
+		expectedState := ConnDialing
+		if i%2 == 1 {
+			expectedState = ConnDisconnected
+		}
+		if state != expectedState {
+			t.Fatalf("unexpected state #%d: %s. Expecting %s", i, state, expectedState)
+		}
+	}
+}
+
+func TestClientReconnectJitter(t *testing.T) {
+	c := &Client{
+		ReconnectDelay:    100 * time.Millisecond,
+		MaxReconnectDelay: time.Second,
+		ReconnectJitter:   0.5,
+	}
+	for failures := uint32(1); failures < 10; failures++ {
+		d := 100 * time.Millisecond << (failures - 1)
+		if d > time.Second {
+			d = time.Second
+		}
+		for i := 0; i < 100; i++ {
+			delay := c.reconnectDelay(failures)
+			if delay < d/2 || delay >= d*3/2 {
+				t.Fatalf("unexpected delay after %d failures: %s. Expecting [%s..%s)", failures, delay, d/2, d*3/2)
+			}
+		}
+	}
+}
+
+func TestClientOnConnStateChange(t *testing.T) {
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+	type stateChange struct {
+		state ConnState
+		err   error
+	}
+	stateCh := make(chan stateChange, 10)
+	connCh := make(chan net.Conn, 1)
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			conn, err := ln.Dial()
+			if err == nil {
+				connCh <- conn
+			}
+			return conn, err
+		},
+	}
+	c.OnConnStateChange = func(state ConnState, err error) {
+		stateCh <- stateChange{state, err}
+	}
+
+	if err := testDone(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, expectedState := range []ConnState{ConnDialing, ConnConnected} {
+		sc := <-stateCh
+		if sc.state != expectedState || sc.err != nil {
+			t.Fatalf("unexpected state change: %s, %v. Expecting %s, <nil>", sc.state, sc.err, expectedState)
+		}
+	}
+
+	// Break the connection.
+	conn := <-connCh
+	conn.Close()
+	select {
+	case sc := <-stateCh:
+		if sc.state != ConnDisconnected || sc.err == nil {
+			t.Fatalf("unexpected state change: %s, %v. Expecting %s with error", sc.state, sc.err, ConnDisconnected)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout when waiting for %s state", ConnDisconnected)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fasthttp/expvarhandler"
+	"github.com/valyala/httpteleport/metrics"
 	"io"
 	"log"
 	"net"
@@ -48,11 +49,70 @@ func expvarHandler(ctx *fasthttp.RequestCtx) {
 func prometheusHandler(ctx *fasthttp.RequestCtx) {
 	prometheusHandlerCalls.Add(1)
 	expvar.Do(func(kv expvar.KeyValue) {
-		if x, ok := kv.Value.(*expvar.Int); ok {
-			fmt.Fprintf(ctx, "# TYPE %s counter\n", kv.Key)
+		switch x := kv.Value.(type) {
+		case *expvar.Int:
+			metricType := "counter"
+			if gaugeVars[kv.Key] {
+				metricType = "gauge"
+			}
+			fmt.Fprintf(ctx, "# TYPE %s %s\n", kv.Key, metricType)
 			fmt.Fprintf(ctx, "%s %s\n", kv.Key, x)
+		case expvar.Func:
+			if n, ok := x.Value().(int64); ok {
+				fmt.Fprintf(ctx, "# TYPE %s gauge\n", kv.Key)
+				fmt.Fprintf(ctx, "%s %d\n", kv.Key, n)
+			}
+		case *latencyVar:
+			fmt.Fprintf(ctx, "# TYPE %s histogram\n", kv.Key)
+			x.writePrometheus(ctx, kv.Key, "")
+		case *latencyVec:
+			fmt.Fprintf(ctx, "# TYPE %s histogram\n", kv.Key)
+			x.writePrometheus(ctx, kv.Key)
+		case *sizeHistogram:
+			fmt.Fprintf(ctx, "# TYPE %s histogram\n", kv.Key)
+			x.writePrometheus(ctx, kv.Key)
+		case *expvar.Map:
+			// Map keys are exported as label values, e.g. tunnel names.
+			metricType := "counter"
+			if gaugeMaps[kv.Key] {
+				metricType = "gauge"
+			}
+			fmt.Fprintf(ctx, "# TYPE %s %s\n", kv.Key, metricType)
+			label := mapLabels[kv.Key]
+			if len(label) == 0 {
+				label = "key"
+			}
+			x.Do(func(item expvar.KeyValue) {
+				fmt.Fprintf(ctx, "%s{%s=%q} %s\n", kv.Key, label, item.Key, item.Value)
+			})
 		}
 	})
+	metricsExporter.WritePrometheus(ctx)
+}
+
+// metricsExporter exports httpteleport clients and servers statistics
+// to prometheus.
+var metricsExporter metrics.Exporter
+
+// gaugeVars contains names of *expvar.Int metrics, which must be exported
+// as gauges to prometheus. Other ints are exported as counters.
+var gaugeVars = map[string]bool{
+	"inConns":  true,
+	"outConns": true,
+}
+
+// gaugeMaps contains names of *expvar.Map metrics, which must be exported
+// as gauges to prometheus. Other maps are exported as counters.
+var gaugeMaps = map[string]bool{
+	"tunnelAgents": true,
+}
+
+// mapLabels contains label names for *expvar.Map keys exported to prometheus.
+var mapLabels = map[string]string{
+	"tunnelAgents":              "tunnel",
+	"tunnelRequestSuccess":      "tunnel",
+	"tunnelRequestTimeoutError": "tunnel",
+	"tunnelRequestOtherError":   "tunnel",
 }
 
 func newExpvarDial(dial fasthttp.DialFunc) fasthttp.DialFunc {
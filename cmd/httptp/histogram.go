@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/httpteleport"
+	"github.com/valyala/httpteleport/metrics"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	inRequestDuration  = &latencyVar{}
+	outRequestDuration = &latencyVec{
+		label: "addr",
+	}
+	tunnelRequestDuration = &latencyVec{
+		label: "tunnel",
+	}
+	inRequestSize  = &sizeHistogram{}
+	inResponseSize = &sizeHistogram{}
+)
+
+func init() {
+	expvar.Publish("inRequestDurationSeconds", inRequestDuration)
+	expvar.Publish("outRequestDurationSeconds", outRequestDuration)
+	expvar.Publish("tunnelRequestDurationSeconds", tunnelRequestDuration)
+	expvar.Publish("inRequestSizeBytes", inRequestSize)
+	expvar.Publish("inResponseSizeBytes", inResponseSize)
+}
+
+// latencyVar exports httpteleport.LatencyHistogram to expvar and prometheus.
+type latencyVar struct {
+	httpteleport.LatencyHistogram
+}
+
+// UpdateDuration adds the duration since startTime to the histogram.
+func (lv *latencyVar) UpdateDuration(startTime time.Time) {
+	lv.Add(time.Since(startTime))
+}
+
+// String returns the histogram in JSON format.
+//
+// It implements expvar.Var.
+func (lv *latencyVar) String() string {
+	h := lv.Histogram()
+	var bb bytes.Buffer
+	bb.WriteString(`{"buckets": {`)
+	for i, b := range httpteleport.LatencyBuckets {
+		if i > 0 {
+			bb.WriteString(", ")
+		}
+		fmt.Fprintf(&bb, `"%g": %d`, b.Seconds(), h.Counts[i])
+	}
+	fmt.Fprintf(&bb, `}, "count": %d, "sum": %g}`, h.Count, h.Sum.Seconds())
+	return bb.String()
+}
+
+func (lv *latencyVar) writePrometheus(w io.Writer, name, labels string) {
+	h := lv.Histogram()
+	metrics.WriteHistogram(w, name, labels, &h)
+}
+
+// latencyVec contains latency histograms labeled by keys,
+// e.g. -out addresses.
+type latencyVec struct {
+	label string
+
+	mu sync.Mutex
+	m  map[string]*latencyVar
+}
+
+// Get returns the histogram for the given key.
+func (lv *latencyVec) Get(key string) *latencyVar {
+	lv.mu.Lock()
+	h := lv.m[key]
+	if h == nil {
+		if lv.m == nil {
+			lv.m = make(map[string]*latencyVar)
+		}
+		h = &latencyVar{}
+		lv.m[key] = h
+	}
+	lv.mu.Unlock()
+	return h
+}
+
+func (lv *latencyVec) sortedKeys() []string {
+	lv.mu.Lock()
+	keys := make([]string, 0, len(lv.m))
+	for k := range lv.m {
+		keys = append(keys, k)
+	}
+	lv.mu.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+// String returns histograms in JSON format.
+//
+// It implements expvar.Var.
+func (lv *latencyVec) String() string {
+	var bb bytes.Buffer
+	bb.WriteString("{")
+	for i, k := range lv.sortedKeys() {
+		if i > 0 {
+			bb.WriteString(", ")
+		}
+		fmt.Fprintf(&bb, "%q: %s", k, lv.Get(k))
+	}
+	bb.WriteString("}")
+	return bb.String()
+}
+
+func (lv *latencyVec) writePrometheus(w io.Writer, name string) {
+	for _, k := range lv.sortedKeys() {
+		lv.Get(k).writePrometheus(w, name, fmt.Sprintf("%s=%q", lv.label, k))
+	}
+}
+
+// sizeBounds contains histogram bucket bounds for request
+// and response sizes.
+var sizeBounds = [...]int64{64, 256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20}
+
+// sizeHistogram is a cumulative histogram of sizes in bytes.
+//
+// Durations must be collected into latencyVar instead.
+type sizeHistogram struct {
+	// The last item counts sizes exceeding all the sizeBounds.
+	counts [len(sizeBounds) + 1]uint64
+	sum    int64
+}
+
+// Update adds n to the histogram.
+func (h *sizeHistogram) Update(n int) {
+	v := int64(n)
+	i := sort.Search(len(sizeBounds), func(i int) bool { return v <= sizeBounds[i] })
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddInt64(&h.sum, v)
+}
+
+// snapshot returns cumulative counts, the total count and the sum.
+func (h *sizeHistogram) snapshot() ([]uint64, uint64, int64) {
+	counts := make([]uint64, len(sizeBounds))
+	var count uint64
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		if i < len(counts) {
+			counts[i] = count
+		}
+	}
+	return counts, count, atomic.LoadInt64(&h.sum)
+}
+
+// String returns the histogram in JSON format.
+//
+// It implements expvar.Var.
+func (h *sizeHistogram) String() string {
+	counts, count, sum := h.snapshot()
+	var bb bytes.Buffer
+	bb.WriteString(`{"buckets": {`)
+	for i, n := range counts {
+		if i > 0 {
+			bb.WriteString(", ")
+		}
+		fmt.Fprintf(&bb, `"%d": %d`, sizeBounds[i], n)
+	}
+	fmt.Fprintf(&bb, `}, "count": %d, "sum": %d}`, count, sum)
+	return bb.String()
+}
+
+func (h *sizeHistogram) writePrometheus(w io.Writer, name string) {
+	counts, count, sum := h.snapshot()
+	for i, n := range counts {
+		fmt.Fprintf(w, "%s_bucket{le=%q} %d\n", name, strconv.FormatInt(sizeBounds[i], 10), n)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, count)
+	fmt.Fprintf(w, "%s_sum %d\n", name, sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, count)
+}
+
+// histogramClient measures request durations to the upstream client.
+type histogramClient struct {
+	fasthttp.BalancingClient
+	h *latencyVar
+}
+
+func newHistogramClient(c fasthttp.BalancingClient, addr string) fasthttp.BalancingClient {
+	return &histogramClient{
+		BalancingClient: c,
+		h:               outRequestDuration.Get(addr),
+	}
+}
+
+func (c *histogramClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	startTime := time.Now()
+	err := c.BalancingClient.DoDeadline(req, resp, deadline)
+	c.h.UpdateDuration(startTime)
+	return err
+}
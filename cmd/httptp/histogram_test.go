@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSizeHistogram(t *testing.T) {
+	var h sizeHistogram
+	h.Update(10)
+	h.Update(64)
+	h.Update(100)
+	h.Update(100 << 20)
+
+	expectedJSON := `{"buckets": {"64": 2, "256": 3, "1024": 3, "4096": 3, "16384": 3, "65536": 3, "262144": 3, "1048576": 3, "4194304": 3, "16777216": 3}, "count": 4, "sum": 104857774}`
+	if s := h.String(); s != expectedJSON {
+		t.Fatalf("unexpected JSON: %s. Expecting %s", s, expectedJSON)
+	}
+
+	var bb bytes.Buffer
+	h.writePrometheus(&bb, "foo")
+	testPrometheusLines(t, bb.String(), []string{
+		`foo_bucket{le="64"} 2`,
+		`foo_bucket{le="256"} 3`,
+		`foo_bucket{le="16777216"} 3`,
+		`foo_bucket{le="+Inf"} 4`,
+		`foo_sum 104857774`,
+		`foo_count 4`,
+	})
+}
+
+func TestLatencyVec(t *testing.T) {
+	lv := &latencyVec{
+		label: "addr",
+	}
+	if lv.Get("foo") != lv.Get("foo") {
+		t.Fatalf("expecting the same histogram for the same key")
+	}
+	lv.Get("foo").Add(time.Millisecond)
+	lv.Get("bar").Add(20 * time.Second)
+
+	s := lv.String()
+	if !strings.HasPrefix(s, `{"bar": {"buckets": {"0.001": 0,`) {
+		t.Fatalf("unexpected JSON prefix: %s", s)
+	}
+	if !strings.Contains(s, `"foo": {"buckets": {"0.001": 1,`) || !strings.Contains(s, `"count": 1, "sum": 20}`) {
+		t.Fatalf("unexpected JSON: %s", s)
+	}
+
+	var bb bytes.Buffer
+	lv.writePrometheus(&bb, "foo_seconds")
+	testPrometheusLines(t, bb.String(), []string{
+		`foo_seconds_bucket{addr="bar",le="10"} 0`,
+		`foo_seconds_bucket{addr="bar",le="+Inf"} 1`,
+		`foo_seconds_sum{addr="bar"} 20`,
+		`foo_seconds_bucket{addr="foo",le="0.001"} 1`,
+		`foo_seconds_count{addr="foo"} 1`,
+	})
+}
+
+func testPrometheusLines(t *testing.T, s string, expectedLines []string) {
+	t.Helper()
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(s, "\n") {
+		lines[line] = true
+	}
+	for _, line := range expectedLines {
+		if !lines[line] {
+			t.Fatalf("missing line %q in\n%s", line, s)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"crypto/tls"
 	"expvar"
 	"flag"
@@ -16,6 +15,7 @@ import (
 	"os"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -41,10 +41,21 @@ var (
 		"\tflate - responses are compressed using flate algorithm. Low network bandwidth at the cost of high CPU usage\n"+
 		"\tsnappy - responses are compressed using snappy algorithm. Balance between network bandwidth and CPU usage")
 
-	inGetOnly       = flag.Bool("inGetOnly", false, "Accept only GET -in requests if set to true")
-	inMaxHeaderSize = flag.Int("inMaxHeaderSize", 4*1024, "Maximum header size for -in requests")
-	inMaxBodySize   = flag.Int("inMaxBodySize", fasthttp.DefaultMaxRequestBodySize, "Maximum body size for -in requests")
-	inAllowIP       = flag.String("inAllowIP", "", "Comma-separated list of IP addresses allowed for establishing connections to -in.\n"+
+	inGetOnly          = flag.Bool("inGetOnly", false, "Accept only GET -in requests if set to true")
+	inMaxHeaderSize    = flag.Int("inMaxHeaderSize", 4*1024, "Maximum header size for -in requests")
+	inMaxBodySize      = flag.Int("inMaxBodySize", fasthttp.DefaultMaxRequestBodySize, "Maximum body size for -in requests")
+	inMaxBufferedBytes = flag.Int("inMaxBufferedBytes", 0, "Maximum number of bytes for buffered request and response bodies if -inType=teleport or teleports.\n"+
+		"\tNew requests aren't read from clients until buffered bodies are sent. Zero means unlimited")
+	inMaxConcurrencyPerConn = flag.Int("inMaxConcurrencyPerConn", 0, "The maximum number of concurrent requests httptp may process per connection if -inType=teleport or teleports.\n"+
+		"\tZero means the number is limited only by -concurrency")
+	inMaxConcurrencyPerClient = flag.Int("inMaxConcurrencyPerClient", 0, "The maximum number of concurrent requests httptp may process per client if -inType=teleport or teleports.\n"+
+		"\tClients are identified by IP address. Zero means the number is limited only by -concurrency")
+	inFairConcurrency = flag.Bool("inFairConcurrency", false, "Whether to fairly share -concurrency among connections if -inType=teleport or teleports.\n"+
+		"\tOtherwise a single client may occupy all the request slots")
+	inMaxQueueSize = flag.Int("inMaxQueueSize", 0, "The maximum number of requests waiting for processing when -concurrency is exceeded if -inType=teleport or teleports.\n"+
+		"\tRequests are rejected immediately when -concurrency is exceeded if zero")
+	inQueueTimeout = flag.Duration("inQueueTimeout", 5*time.Second, "The maximum duration a request may wait in the queue if -inMaxQueueSize is set")
+	inAllowIP      = flag.String("inAllowIP", "", "Comma-separated list of IP addresses allowed for establishing connections to -in.\n"+
 		"\tAll IP addresses are allowed if empty")
 	inTLSCert = flag.String("inTLSCert", "", "Comma-separated list of paths to TLS certificate files if -inType=https or teleports.\n"+
 		"\tCertificates for -inType=https are automatically generated using https://letsencrypt.org/ "+
@@ -52,9 +63,14 @@ var (
 	inTLSKey = flag.String("inTLSKey", "", "Comma-separated list of paths to TLS key files if -inType=https or teleports.\n"+
 		"\tKeys for -inType=https are automatically generated using https://letsencrypt.org/ "+
 		"and cached at -autocertCacheDir if empty")
+	inTLSCertCheckInterval = flag.Duration("inTLSCertCheckInterval", 10*time.Second, "How often to check -inTLSCert, -inTLSKey and -inTLSSessionTicketKeyFile files for changes.\n"+
+		"\tCertificates and keys are reloaded without restart if the files are changed. "+
+		"They are also reloaded on SIGHUP. Zero disables the check")
 	inTLSSessionTicketKey = flag.String("inTLSSessionTicketKey", "", "TLS sesssion ticket key if -inType=https or teleports. "+
 		"Automatically generated if empty.\n"+
 		"\tSee https://blog.cloudflare.com/tls-session-resumption-full-speed-and-secure/ for details")
+	inTLSClientCA = flag.String("inTLSClientCA", "", "Path to CA bundle file for verifying client certificates if -inType=https or teleports.\n"+
+		"\tClients must present certificates signed by the given CA if set. Client certificates aren't requested if empty")
 
 	out = flag.String("out", "127.0.0.1:8043", "Comma-separated list of -outType addresses to forward requests to.\n"+
 		"\tEach request is forwarded to the least loaded address")
@@ -63,6 +79,7 @@ var (
 		"\thttps - forward requests to https servers on TCP, e.g -out=127.0.0.1:443\n"+
 		"\tunix - forward requests to http servers on unix socket, e.g. -out=/var/nginx/sock.unix\n"+
 		"\tteleport - forward requests to httpteleport servers over TCP, e.g. -out=127.0.0.1:8043\n"+
+		"\ttunnel - forward requests to tunnel agents connected to -tunnelIn. -out is ignored. See -tunnelName for details\n"+
 		"\ttepelorts - forward requests to httpteleport servers over encrypted TCP, e.g. -out=127.0.0.1:8043. "+
 		"The server must properly set -inTLS* flags in order to accept encrypted TCP connections")
 	outDelay    = flag.Duration("outDelay", 0, "How long to wait before forwarding incoming requests to -out if -outType=teleport")
@@ -72,6 +89,12 @@ var (
 		"\tflate - requests are compressed using flate algorithm. Low network bandwidth at the cost of high CPU usage\n"+
 		"\tsnappy - requests are compressed using snappy algorithm. Balance between network bandwidth and CPU usage")
 
+	outTLSCert = flag.String("outTLSCert", "", "Path to TLS certificate file presented to -out servers if -outType=https or teleports.\n"+
+		"\tClient certificate isn't presented if empty")
+	outTLSKey = flag.String("outTLSKey", "", "Path to TLS key file for -outTLSCert")
+	outTLSCA  = flag.String("outTLSCA", "", "Path to CA bundle file for verifying -out server certificates if -outType=https or teleports.\n"+
+		"\tSystem CA bundle is used if empty")
+
 	outMaxHeaderSize = flag.Int("outMaxHeaderSize", 4*1024, "Maximum header size for -out responses")
 	outTimeout       = flag.Duration("outTimeout", 3*time.Second, "The maximum duration for waiting responses from -out server")
 	outConnsPerAddr  = flag.Int("outConnsPerAddr", 1, "How many connections must be established per each -out server if -outType=teleport.\n"+
@@ -112,8 +135,15 @@ func main() {
 		initTeleportClients(outs)
 	case "teleports":
 		initTeleportsClients(outs)
+	case "tunnel":
+		serveTunnelAgents()
 	default:
-		log.Fatalf("unknown -outType=%q. Supported values are: http, https, unix, teleport, teleports", *outType)
+		log.Fatalf("unknown -outType=%q. Supported values are: http, https, unix, teleport, teleports, tunnel", *outType)
+	}
+
+	if len(*tunnelName) > 0 && len(*in) == 0 {
+		// Tunnel agent doesn't need to accept requests at -in.
+		select {}
 	}
 
 	switch *inType {
@@ -145,7 +175,7 @@ func initHTTPClientsExt(outs []string, isTLS bool) {
 	var cc []fasthttp.BalancingClient
 	for _, addr := range outs {
 		c := newHTTPClient(fasthttp.Dial, addr, connsPerAddr, isTLS)
-		cc = append(cc, c)
+		cc = append(cc, newHistogramClient(c, addr))
 	}
 	upstreamClients.Clients = cc
 	tlsSuffix := ""
@@ -161,7 +191,7 @@ func initUnixClients(outs []string) {
 	for _, addr := range outs {
 		verifyUnixAddr(addr)
 		c := newHTTPClient(dialUnix, addr, connsPerAddr, false)
-		cc = append(cc, c)
+		cc = append(cc, newHistogramClient(c, addr))
 	}
 	upstreamClients.Clients = cc
 	log.Printf("forwarding requests to http servers at unix:%q", outs)
@@ -191,6 +221,7 @@ func initTeleportClientsExt(outs []string, isTLS bool) {
 	concurrencyPerAddr = (concurrencyPerAddr + *outConnsPerAddr - 1) / *outConnsPerAddr
 	outCompressType := compressType(*outCompress, "outCompress")
 	var cc []fasthttp.BalancingClient
+	var clients []*httpteleport.Client
 	for _, addr := range outs {
 		c := &httpteleport.Client{
 			Addr:               addr,
@@ -203,16 +234,20 @@ func initTeleportClientsExt(outs []string, isTLS bool) {
 			ReadBufferSize:     *outMaxHeaderSize,
 		}
 		if isTLS {
-			serverName, _, err := net.SplitHostPort(addr)
-			if err != nil {
-				log.Fatalf("cannot extract teleport server name from %q: %s", addr, err)
-			}
-			c.TLSConfig = &tls.Config{
-				ServerName: serverName,
-			}
+			c.TLSConfig = newOutTLSConfig(addr, "teleport")
 		}
-		cc = append(cc, c)
-	}
+		initTunnelAgent(c)
+		metricsExporter.AddClient(c)
+		clients = append(clients, c)
+		cc = append(cc, newHistogramClient(c, addr))
+	}
+	expvar.Publish("outStats", expvar.Func(func() interface{} {
+		m := make(map[string]httpteleport.ClientStats, len(clients))
+		for _, c := range clients {
+			m[c.Addr] = c.Stats()
+		}
+		return m
+	}))
 
 	var cs []fasthttp.BalancingClient
 	for i := 0; i < *outConnsPerAddr; i++ {
@@ -250,14 +285,8 @@ func newHTTPClient(dial fasthttp.DialFunc, addr string, connsPerAddr int, isTLS
 		ReadBufferSize: *outMaxHeaderSize,
 	}
 	if isTLS {
-		serverName, _, err := net.SplitHostPort(addr)
-		if err != nil {
-			log.Fatalf("cannot extract http server name from %q: %s", addr, err)
-		}
 		c.IsTLS = true
-		c.TLSConfig = &tls.Config{
-			ServerName: serverName,
-		}
+		c.TLSConfig = newOutTLSConfig(addr, "http")
 	}
 	return c
 }
@@ -278,7 +307,7 @@ func serveHTTP() {
 
 func serveHTTPS() {
 	ln := newTCPListener()
-	tlsConfig := newInTLSConfig(true)
+	tlsConfig := getInTLSConfig(true)
 	lnTLS := tls.NewListener(ln, tlsConfig)
 	s := newHTTPServer()
 
@@ -321,20 +350,37 @@ func serveTeleportExt(isTLS bool) {
 	ln := newTCPListener()
 	var tlsConfig *tls.Config
 	if isTLS {
-		tlsConfig = newInTLSConfig(false)
+		tlsConfig = getInTLSConfig(false)
 	}
 	inCompressType := compressType(*inCompress, "inCompress")
 	s := httpteleport.Server{
-		Handler:           httpteleportRequestHandler,
-		Concurrency:       *concurrency,
-		MaxBatchDelay:     *inDelay,
-		TLSConfig:         tlsConfig,
-		ReduceMemoryUsage: true,
-		ReadTimeout:       120 * time.Second,
-		WriteTimeout:      5 * time.Second,
-		CompressType:      inCompressType,
-		ReadBufferSize:    *inMaxHeaderSize,
-	}
+		Handler:              httpteleportRequestHandler,
+		Concurrency:          *concurrency,
+		MaxBatchDelay:        *inDelay,
+		TLSConfig:            tlsConfig,
+		ReduceMemoryUsage:    true,
+		ReadTimeout:          120 * time.Second,
+		WriteTimeout:         5 * time.Second,
+		CompressType:         inCompressType,
+		ReadBufferSize:       *inMaxHeaderSize,
+		MaxRequestBodySize:   *inMaxBodySize,
+		MaxRequestHeaderSize: *inMaxHeaderSize,
+		MaxBufferedBytes:     *inMaxBufferedBytes,
+
+		MaxConcurrencyPerConn:   *inMaxConcurrencyPerConn,
+		MaxConcurrencyPerClient: *inMaxConcurrencyPerClient,
+		FairConcurrency:         *inFairConcurrency,
+
+		MaxQueueSize: *inMaxQueueSize,
+		QueueTimeout: *inQueueTimeout,
+	}
+	expvar.Publish("inBufferedBytes", expvar.Func(func() interface{} {
+		return s.BufferedBytes()
+	}))
+	expvar.Publish("inStats", expvar.Func(func() interface{} {
+		return s.Stats()
+	}))
+	metricsExporter.AddServer("in", &s)
 
 	secureStr := ""
 	if isTLS {
@@ -405,12 +451,18 @@ func httpteleportRequestHandler(ctx *fasthttp.RequestCtx) {
 
 func commonRequestHandler(proxyType string, ctx *fasthttp.RequestCtx) {
 	inRequestStart.Add(1)
+	startTime := time.Now()
+	inRequestSize.Update(len(ctx.Request.Header.Header()) + len(ctx.Request.Body()))
+	defer func() {
+		inResponseSize.Update(len(ctx.Response.Header.Header()) + len(ctx.Response.Body()))
+		inRequestDuration.UpdateDuration(startTime)
+	}()
 
 	// Reset 'Connection: close' request header in order to prevent
 	// from closing keep-alive connections to -out servers.
 	ctx.Request.Header.ResetConnectionClose()
 
-	err := upstreamClients.DoTimeout(&ctx.Request, &ctx.Response, *outTimeout)
+	err := doUpstream(&ctx.Request, &ctx.Response, *outTimeout)
 	if err == nil {
 		inRequestSuccess.Add(1)
 		if ctx.Response.StatusCode() != fasthttp.StatusOK {
@@ -432,6 +484,28 @@ func commonRequestHandler(proxyType string, ctx *fasthttp.RequestCtx) {
 
 var upstreamClients fasthttp.LBClient
 
+// doUpstream forwards requests to -out.
+var doUpstream = upstreamClients.DoTimeout
+
+var (
+	inTLSConfigOnce sync.Once
+	inTLSConfig     *tls.Config
+)
+
+// getInTLSConfig returns TLS config for -in and -tunnelIn.
+//
+// The config is shared, so certificates are watched and reloaded only once.
+// The config may use autocert only if allowAutocert is set.
+func getInTLSConfig(allowAutocert bool) *tls.Config {
+	if !allowAutocert && len(*inTLSCert) == 0 {
+		log.Fatalf("missing -inTLSCert")
+	}
+	inTLSConfigOnce.Do(func() {
+		inTLSConfig = newInTLSConfig(allowAutocert)
+	})
+	return inTLSConfig
+}
+
 func newInTLSConfig(allowAutocert bool) *tls.Config {
 	// See https://blog.gopheracademy.com/advent-2016/exposing-go-on-the-internet/
 	tlsConfig := &tls.Config{
@@ -441,11 +515,8 @@ func newInTLSConfig(allowAutocert bool) *tls.Config {
 			tls.X25519, // Go 1.8 only
 		},
 	}
-	if len(*inTLSSessionTicketKey) > 0 {
-		tlsConfig.SessionTicketKey = sha256.Sum256([]byte(*inTLSSessionTicketKey))
-	}
+	initSessionTicketKeys(tlsConfig)
 
-	var certs []tls.Certificate
 	if len(*inTLSCert) > 0 {
 		certFiles := strings.Split(*inTLSCert, ",")
 		keyFiles := strings.Split(*inTLSKey, ",")
@@ -453,21 +524,24 @@ func newInTLSConfig(allowAutocert bool) *tls.Config {
 			log.Fatalf("-inTLSCert and -inTLSKey sizes mismatch: %d vs %d. -inTLSCert=%q, -inTLSKey=%q",
 				len(certFiles), len(keyFiles), *inTLSCert, *inTLSKey)
 		}
-		for i := range certFiles {
-			certFile := certFiles[i]
-			keyFile := keyFiles[i]
-			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-			if err != nil {
-				log.Fatalf("cannot load TLS certificate for cert=%q, key=%q, -inTLSCert=%q and -inTLSKey=%q",
-					certFile, keyFile, *inTLSCert, *inTLSKey, err)
-			}
-			certs = append(certs, cert)
+		cr, err := httpteleport.NewCertReloader(certFiles, keyFiles)
+		if err != nil {
+			log.Fatalf("cannot load TLS certificates for -inTLSCert=%q and -inTLSKey=%q: %s", *inTLSCert, *inTLSKey, err)
 		}
-		tlsConfig.Certificates = certs
-		tlsConfig.BuildNameToCertificate()
+		tlsConfig.GetCertificate = cr.GetCertificate
+		if *inTLSCertCheckInterval > 0 {
+			cr.Watch(*inTLSCertCheckInterval, nil, log.New(os.Stderr, "", log.LstdFlags))
+		}
+		reloadOnSIGHUP("TLS certificates", cr.Reload)
+	}
+
+	if len(*inTLSClientCA) > 0 {
+		tlsConfig.ClientCAs = loadCertPool(*inTLSClientCA, "inTLSClientCA")
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		log.Printf("requiring client certificates signed by -inTLSClientCA=%q", *inTLSClientCA)
 	}
 
-	if len(certs) > 0 {
+	if tlsConfig.GetCertificate != nil {
 		return tlsConfig
 	}
 
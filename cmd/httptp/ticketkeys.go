@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	inTLSSessionTicketKeyFile = flag.String("inTLSSessionTicketKeyFile", "", "Path to file with TLS session ticket keys if -inType=https or teleports.\n"+
+		"\tThe file must contain a key per line. The first key is used for encrypting new session tickets,\n"+
+		"\twhile the remaining keys are used only for decrypting tickets encrypted with previous keys.\n"+
+		"\tThe file is re-read when it changes (see -inTLSCertCheckInterval) and on SIGHUP, so keys may be rotated without restart.\n"+
+		"\tThis flag cannot be used together with -inTLSSessionTicketKey")
+	inTLSSessionTicketKeyRotateInterval = flag.Duration("inTLSSessionTicketKeyRotateInterval", 0, "How often to generate new random TLS session ticket key "+
+		"if -inType=https or teleports.\n"+
+		"\tThe previous two keys remain valid for decrypting session tickets. Zero disables the rotation.\n"+
+		"\tThis flag cannot be used together with -inTLSSessionTicketKey and -inTLSSessionTicketKeyFile")
+)
+
+const previousSessionTicketKeys = 2
+
+func initSessionTicketKeys(tlsConfig *tls.Config) {
+	switch {
+	case len(*inTLSSessionTicketKeyFile) > 0:
+		if len(*inTLSSessionTicketKey) > 0 {
+			log.Fatalf("-inTLSSessionTicketKey and -inTLSSessionTicketKeyFile cannot be set simultaneously")
+		}
+		kf := &ticketKeyFile{
+			path:    *inTLSSessionTicketKeyFile,
+			setKeys: tlsConfig.SetSessionTicketKeys,
+		}
+		if err := kf.load(); err != nil {
+			log.Fatalf("cannot load -inTLSSessionTicketKeyFile=%q: %s", kf.path, err)
+		}
+		if *inTLSCertCheckInterval > 0 {
+			go kf.watch(*inTLSCertCheckInterval)
+		}
+		reloadOnSIGHUP("TLS session ticket keys", kf.load)
+	case len(*inTLSSessionTicketKey) > 0:
+		tlsConfig.SessionTicketKey = sha256.Sum256([]byte(*inTLSSessionTicketKey))
+	}
+
+	if *inTLSSessionTicketKeyRotateInterval > 0 {
+		if len(*inTLSSessionTicketKey) > 0 || len(*inTLSSessionTicketKeyFile) > 0 {
+			log.Fatalf("-inTLSSessionTicketKeyRotateInterval cannot be used together with " +
+				"-inTLSSessionTicketKey and -inTLSSessionTicketKeyFile")
+		}
+		go rotateSessionTicketKeys(tlsConfig.SetSessionTicketKeys, *inTLSSessionTicketKeyRotateInterval)
+	}
+}
+
+func rotateSessionTicketKeys(setKeys func(keys [][32]byte), interval time.Duration) {
+	var keys [][32]byte
+	for {
+		var err error
+		if keys, err = nextSessionTicketKeys(keys); err != nil {
+			log.Fatalf("cannot generate TLS session ticket key: %s", err)
+		}
+		setKeys(keys)
+		time.Sleep(interval)
+	}
+}
+
+// nextSessionTicketKeys returns keys with new random key at the front.
+//
+// Only previousSessionTicketKeys keys are preserved after the new key.
+func nextSessionTicketKeys(keys [][32]byte) ([][32]byte, error) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	keys = append([][32]byte{key}, keys...)
+	if len(keys) > previousSessionTicketKeys+1 {
+		keys = keys[:previousSessionTicketKeys+1]
+	}
+	return keys, nil
+}
+
+type ticketKeyFile struct {
+	path string
+
+	// setKeys is called with the keys loaded from path,
+	// e.g. tls.Config.SetSessionTicketKeys.
+	setKeys func(keys [][32]byte)
+
+	// mu serializes loads from the watch goroutine and SIGHUP handler.
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+func (kf *ticketKeyFile) load() error {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	fi, err := os.Stat(kf.path)
+	if err != nil {
+		return err
+	}
+	return kf.loadLocked(fi)
+}
+
+// reloadIfChanged re-reads the keys if the file has been changed since
+// the last load.
+//
+// true is returned if the keys have been reloaded.
+func (kf *ticketKeyFile) reloadIfChanged() (bool, error) {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+
+	fi, err := os.Stat(kf.path)
+	if err != nil {
+		return false, err
+	}
+	if fi.ModTime().Equal(kf.modTime) && fi.Size() == kf.size {
+		return false, nil
+	}
+	if err := kf.loadLocked(fi); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (kf *ticketKeyFile) loadLocked(fi os.FileInfo) error {
+	data, err := ioutil.ReadFile(kf.path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseSessionTicketKeys(string(data))
+	if err != nil {
+		return err
+	}
+	kf.setKeys(keys)
+	kf.modTime = fi.ModTime()
+	kf.size = fi.Size()
+	return nil
+}
+
+func (kf *ticketKeyFile) watch(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		reloaded, err := kf.reloadIfChanged()
+		if err != nil {
+			log.Printf("cannot reload -inTLSSessionTicketKeyFile=%q: %s", kf.path, err)
+			continue
+		}
+		if !reloaded {
+			continue
+		}
+		log.Printf("reloaded TLS session ticket keys from -inTLSSessionTicketKeyFile=%q", kf.path)
+	}
+}
+
+// parseSessionTicketKeys parses session ticket keys from data.
+//
+// Each non-empty line is converted to a key in the same way
+// as -inTLSSessionTicketKey. Lines starting with # are ignored.
+func parseSessionTicketKeys(data string) ([][32]byte, error) {
+	var keys [][32]byte
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, sha256.Sum256([]byte(line)))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("missing session ticket keys")
+	}
+	return keys, nil
+}
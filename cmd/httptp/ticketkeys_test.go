@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestParseSessionTicketKeys(t *testing.T) {
+	keys, err := parseSessionTicketKeys("# comment\nfoo\n\n  bar  \n")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectedKeys := [][32]byte{
+		sha256.Sum256([]byte("foo")),
+		sha256.Sum256([]byte("bar")),
+	}
+	testSessionTicketKeys(t, keys, expectedKeys)
+
+	for _, data := range []string{"", "\n\n", "# only comment\n"} {
+		if _, err := parseSessionTicketKeys(data); err == nil {
+			t.Fatalf("expecting non-nil error for %q", data)
+		}
+	}
+}
+
+func TestTicketKeyFileLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httptp-ticketkeys")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+
+	var keys [][32]byte
+	kf := &ticketKeyFile{
+		path: path,
+		setKeys: func(k [][32]byte) {
+			keys = k
+		},
+	}
+	if err := kf.load(); err == nil {
+		t.Fatalf("expecting non-nil error for missing file")
+	}
+
+	if err := ioutil.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+	if err := kf.load(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testSessionTicketKeys(t, keys, [][32]byte{sha256.Sum256([]byte("old"))})
+
+	// The new key must encrypt tickets, while the old key must remain
+	// available for decrypting.
+	if err := ioutil.WriteFile(path, []byte("new\nold\n"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+	if err := kf.load(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectedKeys := [][32]byte{
+		sha256.Sum256([]byte("new")),
+		sha256.Sum256([]byte("old")),
+	}
+	testSessionTicketKeys(t, keys, expectedKeys)
+
+	// Previously loaded keys must remain in use on invalid file.
+	if err := ioutil.WriteFile(path, []byte("# no keys\n"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+	if err := kf.load(); err == nil {
+		t.Fatalf("expecting non-nil error for file without keys")
+	}
+	testSessionTicketKeys(t, keys, expectedKeys)
+}
+
+func TestTicketKeyFileConcurrentReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httptp-ticketkeys")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keys")
+	if err := ioutil.WriteFile(path, []byte("foo\n"), 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+
+	kf := &ticketKeyFile{
+		path:    path,
+		setKeys: func(k [][32]byte) {},
+	}
+
+	// The file is reloaded both from the watch goroutine and on SIGHUP.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if err := kf.load(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if _, err := kf.reloadIfChanged(); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	reloaded, err := kf.reloadIfChanged()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if reloaded {
+		t.Fatalf("unchanged file mustn't be reloaded")
+	}
+}
+
+func TestNextSessionTicketKeys(t *testing.T) {
+	var keys [][32]byte
+	var prevKeys [][32]byte
+	for i := 0; i < previousSessionTicketKeys+3; i++ {
+		var err error
+		if keys, err = nextSessionTicketKeys(keys); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		expectedLen := i + 1
+		if expectedLen > previousSessionTicketKeys+1 {
+			expectedLen = previousSessionTicketKeys + 1
+		}
+		if len(keys) != expectedLen {
+			t.Fatalf("unexpected number of keys on iteration %d: %d. Expecting %d", i, len(keys), expectedLen)
+		}
+		for _, k := range prevKeys {
+			if k == keys[0] {
+				t.Fatalf("the new key on iteration %d matches the previous key", i)
+			}
+		}
+		// Previous keys must be shifted after the new key.
+		n := len(keys) - 1
+		testSessionTicketKeys(t, keys[1:], prevKeys[:n])
+		prevKeys = append([][32]byte{}, keys...)
+	}
+}
+
+func testSessionTicketKeys(t *testing.T, keys, expectedKeys [][32]byte) {
+	t.Helper()
+	if len(keys) != len(expectedKeys) {
+		t.Fatalf("unexpected number of keys: %d. Expecting %d", len(keys), len(expectedKeys))
+	}
+	for i := range keys {
+		if keys[i] != expectedKeys[i] {
+			t.Fatalf("unexpected key #%d: %x. Expecting %x", i, keys[i], expectedKeys[i])
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func newOutTLSConfig(addr, serverType string) *tls.Config {
+	serverName, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatalf("cannot extract %s server name from %q: %s", serverType, addr, err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName: serverName,
+	}
+	if len(*outTLSCA) > 0 {
+		tlsConfig.RootCAs = loadCertPool(*outTLSCA, "outTLSCA")
+	}
+	if len(*outTLSCert) > 0 || len(*outTLSKey) > 0 {
+		cert, err := tls.LoadX509KeyPair(*outTLSCert, *outTLSKey)
+		if err != nil {
+			log.Fatalf("cannot load TLS certificate for -outTLSCert=%q and -outTLSKey=%q: %s", *outTLSCert, *outTLSKey, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig
+}
+
+func loadCertPool(path, flagName string) *x509.CertPool {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("cannot read -%s=%q: %s", flagName, path, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		log.Fatalf("cannot find PEM-encoded certificates in -%s=%q", flagName, path)
+	}
+	return pool
+}
+
+// reloadOnSIGHUP calls reload each time the process receives SIGHUP.
+func reloadOnSIGHUP(name string, reload func() error) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	go func() {
+		for range ch {
+			if err := reload(); err != nil {
+				log.Printf("cannot reload %s on SIGHUP: %s", name, err)
+				continue
+			}
+			log.Printf("reloaded %s on SIGHUP", name)
+		}
+	}()
+}
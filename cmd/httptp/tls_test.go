@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "httptp-tls")
+	if err != nil {
+		t.Fatalf("cannot create temporary dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	serverCert, serverKey := ca.issue(t, dir, "server", x509.ExtKeyUsageServerAuth)
+	clientCert, clientKey := ca.issue(t, dir, "client", x509.ExtKeyUsageClientAuth)
+
+	defer testSetFlags(map[*string]string{
+		inTLSCert:     serverCert,
+		inTLSKey:      serverKey,
+		inTLSClientCA: ca.certFile,
+		outTLSCA:      ca.certFile,
+		outTLSCert:    clientCert,
+		outTLSKey:     clientKey,
+	})()
+	checkInterval := *inTLSCertCheckInterval
+	*inTLSCertCheckInterval = 0
+	defer func() {
+		*inTLSCertCheckInterval = checkInterval
+	}()
+
+	serverConfig := newInTLSConfig(false)
+	if serverConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("unexpected ClientAuth: %s. Expecting %s", serverConfig.ClientAuth, tls.RequireAndVerifyClientCert)
+	}
+	clientConfig := newOutTLSConfig("localhost:8043", "teleports")
+	if err := testTLSHandshake(serverConfig, clientConfig); err != nil {
+		t.Fatalf("unexpected handshake error: %s", err)
+	}
+
+	// The server must reject clients without certificates.
+	clientConfig.Certificates = nil
+	if err := testTLSHandshake(serverConfig, clientConfig); err == nil {
+		t.Fatalf("expecting non-nil error for client without certificate")
+	}
+
+	// The client must reject servers signed by unknown CA.
+	clientConfig = newOutTLSConfig("localhost:8043", "teleports")
+	clientConfig.RootCAs = x509.NewCertPool()
+	if err := testTLSHandshake(serverConfig, clientConfig); err == nil {
+		t.Fatalf("expecting non-nil error for unknown server CA")
+	}
+}
+
+// testTLSHandshake performs TLS handshake between server and client
+// with the given configs.
+//
+// The server handshake error is returned if the client handshake succeeds.
+func testTLSHandshake(serverConfig, clientConfig *tls.Config) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+
+	serverCh := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverCh <- err
+			return
+		}
+		defer conn.Close()
+		tc := tls.Server(conn, serverConfig)
+		if err := tc.Handshake(); err != nil {
+			serverCh <- err
+			return
+		}
+		if len(tc.ConnectionState().PeerCertificates) == 0 {
+			serverCh <- errors.New("missing client certificate")
+			return
+		}
+		serverCh <- nil
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Second)); err != nil {
+		return err
+	}
+	if err := tls.Client(conn, clientConfig).Handshake(); err != nil {
+		return err
+	}
+	// TLS 1.3 client finishes the handshake before the server verifies
+	// the client certificate, so wait for the server result.
+	return <-serverCh
+}
+
+// testSetFlags sets flag values and returns a function for restoring
+// the previous values.
+func testSetFlags(values map[*string]string) func() {
+	prevValues := make(map[*string]string, len(values))
+	for p, v := range values {
+		prevValues[p] = *p
+		*p = v
+	}
+	return func() {
+		for p, v := range prevValues {
+			*p = v
+		}
+	}
+}
+
+type testCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key := testGenerateKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httptp test " + name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("cannot create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("cannot parse CA certificate: %s", err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	testWritePEM(t, certFile, "CERTIFICATE", der)
+	return &testCA{
+		cert:     cert,
+		key:      key,
+		certFile: certFile,
+	}
+}
+
+// issue writes certificate and key signed by ca to dir and returns paths
+// to these files.
+func (ca *testCA) issue(t *testing.T, dir, name string, usage x509.ExtKeyUsage) (string, string) {
+	key := testGenerateKey(t)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "httptp test " + name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("cannot create %s certificate: %s", name, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("cannot marshal %s key: %s", name, err)
+	}
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	testWritePEM(t, certFile, "CERTIFICATE", der)
+	testWritePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func testGenerateKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("cannot generate key: %s", err)
+	}
+	return key
+}
+
+func testWritePEM(t *testing.T, path, typ string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("cannot write %q: %s", path, err)
+	}
+}
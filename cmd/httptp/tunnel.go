@@ -0,0 +1,294 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"expvar"
+	"flag"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/httpteleport"
+	"github.com/valyala/tcplisten"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	tunnelIn = flag.String("tunnelIn", ":8044", "TCP address to listen to for connections from tunnel agents if -outType=tunnel.\n"+
+		"\tSee -tunnelName for details")
+	tunnelInTLS = flag.Bool("tunnelInTLS", false, "Whether to accept only encrypted connections from tunnel agents at -tunnelIn.\n"+
+		"\tTLS certificates are set via -inTLSCert and -inTLSKey")
+	tunnelAuthKeysFile = flag.String("tunnelAuthKeysFile", "", "Path to file with auth keys for tunnel agents if -outType=tunnel.\n"+
+		"\tThe file must contain 'tunnelName secret' per line. Agents must set -tunnelAuthKeyFile with the secret\n"+
+		"\tfor registering the tunnel. httptp refuses to start without the file unless -tunnelAllowUnauthenticated is set")
+	tunnelAllowUnauthenticated = flag.Bool("tunnelAllowUnauthenticated", false, "Whether to allow tunnel agents to register arbitrary tunnels\n"+
+		"\twithout authentication if -tunnelAuthKeysFile isn't set. Any agent may take over any Host then")
+
+	tunnelName = flag.String("tunnelName", "", "Tunnel name to register at -out if -outType=teleport or teleports.\n"+
+		"\tThis turns httptp into tunnel agent: it forwards requests received from -out via the tunnel to -tunnelTarget.\n"+
+		"\tThe -out httptp must run with -outType=tunnel. It routes requests with Host header matching\n"+
+		"\tthe tunnel name to the agent. -in may be empty in tunnel agent mode")
+	tunnelTarget = flag.String("tunnelTarget", "127.0.0.1:8080", "TCP address of http server to forward requests from the tunnel to.\n"+
+		"\tSee -tunnelName for details")
+	tunnelAuthKeyFile = flag.String("tunnelAuthKeyFile", "", "Path to file with the secret for registering -tunnelName.\n"+
+		"\tSee -tunnelAuthKeysFile for details")
+)
+
+// tunnelPingPath is requested by tunnel agents in order to keep
+// connections to -out established.
+const tunnelPingPath = "/httptp/tunnel/ping"
+
+const tunnelPingInterval = time.Second
+
+func serveTunnelAgents() {
+	cfg := tcplisten.Config{
+		ReusePort: *reusePort,
+	}
+	ln, err := cfg.NewListener("tcp4", *tunnelIn)
+	if err != nil {
+		log.Fatalf("cannot listen to -tunnelIn=%q: %s", *tunnelIn, err)
+	}
+	ln = &expvarListener{
+		Listener: ln,
+	}
+	var tlsConfig *tls.Config
+	if *tunnelInTLS {
+		tlsConfig = getInTLSConfig(false)
+	}
+	s := &httpteleport.Server{
+		Handler:       tunnelServerHandler,
+		OnReverseConn: registerTunnelAgent,
+		TLSConfig:     tlsConfig,
+		ReadTimeout:   120 * time.Second,
+		WriteTimeout:  5 * time.Second,
+	}
+	metricsExporter.AddServer("tunnel", s)
+	if len(*tunnelAuthKeysFile) > 0 {
+		keys, err := readTunnelAuthKeys(*tunnelAuthKeysFile)
+		if err != nil {
+			log.Fatalf("cannot read -tunnelAuthKeysFile=%q: %s", *tunnelAuthKeysFile, err)
+		}
+		s.AuthKeys = keys
+	} else if *tunnelAllowUnauthenticated {
+		log.Printf("tunnel agents may register arbitrary tunnels, since -tunnelAuthKeysFile isn't set")
+	} else {
+		log.Fatalf("-tunnelAuthKeysFile must be set if -outType=tunnel. Set -tunnelAllowUnauthenticated " +
+			"for allowing tunnel agents to register arbitrary tunnels without authentication")
+	}
+
+	secureStr := ""
+	if *tunnelInTLS {
+		secureStr = "encrypted "
+	}
+	log.Printf("listening for %sconnections from tunnel agents on %q", secureStr, *tunnelIn)
+	go func() {
+		if err := s.Serve(ln); err != nil {
+			log.Fatalf("error in tunnel server: %s", err)
+		}
+	}()
+	doUpstream = doTunnel
+}
+
+func tunnelServerHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Path()) != tunnelPingPath {
+		ctx.Error("tunnel agents may send only pings", fasthttp.StatusBadRequest)
+		return
+	}
+	ctx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
+// readTunnelAuthKeys reads 'tunnelName secret' lines from the given file.
+func readTunnelAuthKeys(path string) ([]httpteleport.AuthKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []httpteleport.AuthKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("unexpected number of fields on line %d: %d. Expecting 2 fields: 'tunnelName secret'", i+1, len(fields))
+		}
+		keys = append(keys, httpteleport.AuthKey{
+			ID:     fields[0],
+			Secret: []byte(fields[1]),
+		})
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("missing auth keys")
+	}
+	return keys, nil
+}
+
+type tunnel struct {
+	mu     sync.Mutex
+	agents []*httpteleport.ReverseClient
+	n      uint32
+}
+
+var (
+	tunnelsLock sync.Mutex
+	tunnels     = make(map[string]*tunnel)
+)
+
+var (
+	tunnelAgents          = expvar.NewMap("tunnelAgents")
+	tunnelRequestSuccess  = expvar.NewMap("tunnelRequestSuccess")
+	tunnelRequestTimeout  = expvar.NewMap("tunnelRequestTimeoutError")
+	tunnelRequestError    = expvar.NewMap("tunnelRequestOtherError")
+	tunnelRequestNotFound = expvar.NewInt("tunnelRequestNotFound")
+)
+
+func registerTunnelAgent(rc *httpteleport.ReverseClient) {
+	info := rc.ConnInfo()
+	name := info.ClientName
+	if len(name) == 0 {
+		log.Printf("rejecting tunnel agent at %s: missing tunnel name", rc.RemoteAddr())
+		rc.Close()
+		return
+	}
+	if len(*tunnelAuthKeysFile) > 0 && info.AuthKeyID != name {
+		log.Printf("rejecting tunnel agent for %q at %s: the agent is authenticated with the key for %q",
+			name, rc.RemoteAddr(), info.AuthKeyID)
+		rc.Close()
+		return
+	}
+
+	tunnelsLock.Lock()
+	t := tunnels[name]
+	if t == nil {
+		t = &tunnel{}
+		tunnels[name] = t
+	}
+	tunnelsLock.Unlock()
+
+	t.mu.Lock()
+	t.agents = append(t.agents, rc)
+	t.mu.Unlock()
+	tunnelAgents.Add(name, 1)
+	log.Printf("registered tunnel agent for %q", name)
+
+	go func() {
+		<-rc.Closed()
+		t.mu.Lock()
+		for i, agent := range t.agents {
+			if agent == rc {
+				t.agents = append(t.agents[:i], t.agents[i+1:]...)
+				break
+			}
+		}
+		t.mu.Unlock()
+		tunnelAgents.Add(name, -1)
+		log.Printf("unregistered tunnel agent for %q", name)
+	}()
+}
+
+var errNoTunnelAgents = errors.New("no tunnel agents for the requested host")
+
+func (t *tunnel) agent() *httpteleport.ReverseClient {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.agents) == 0 {
+		return nil
+	}
+	n := atomic.AddUint32(&t.n, 1)
+	return t.agents[n%uint32(len(t.agents))]
+}
+
+// doTunnel forwards req to the tunnel agent registered for req host.
+func doTunnel(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	name := string(req.Host())
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	tunnelsLock.Lock()
+	t := tunnels[name]
+	tunnelsLock.Unlock()
+	var rc *httpteleport.ReverseClient
+	if t != nil {
+		rc = t.agent()
+	}
+	if rc == nil {
+		tunnelRequestNotFound.Add(1)
+		return errNoTunnelAgents
+	}
+
+	startTime := time.Now()
+	err := rc.DoTimeout(req, resp, timeout)
+	tunnelRequestDuration.Get(name).UpdateDuration(startTime)
+	switch err {
+	case nil:
+		tunnelRequestSuccess.Add(name, 1)
+	case httpteleport.ErrTimeout:
+		tunnelRequestTimeout.Add(name, 1)
+		err = fasthttp.ErrTimeout
+	default:
+		tunnelRequestError.Add(name, 1)
+	}
+	return err
+}
+
+// initTunnelAgent turns c into tunnel agent if -tunnelName is set.
+func initTunnelAgent(c *httpteleport.Client) {
+	if len(*tunnelName) == 0 {
+		return
+	}
+	c.Name = *tunnelName
+	c.ReverseHandler = tunnelAgentHandler
+	tunnelTargetClient.Addr = *tunnelTarget
+	if len(*tunnelAuthKeyFile) > 0 {
+		data, err := ioutil.ReadFile(*tunnelAuthKeyFile)
+		if err != nil {
+			log.Fatalf("cannot read -tunnelAuthKeyFile=%q: %s", *tunnelAuthKeyFile, err)
+		}
+		c.AuthKey = &httpteleport.AuthKey{
+			ID:     *tunnelName,
+			Secret: []byte(strings.TrimSpace(string(data))),
+		}
+	}
+	go pingTunnel(c)
+}
+
+// pingTunnel periodically pings the server, so the connection
+// to the server is re-established if it is broken.
+func pingTunnel(c *httpteleport.Client) {
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://" + *tunnelName + tunnelPingPath)
+	for {
+		if err := c.DoTimeout(&req, &resp, *outTimeout); err != nil {
+			log.Printf("cannot ping tunnel server at %q: %s", c.Addr, err)
+		}
+		time.Sleep(tunnelPingInterval)
+	}
+}
+
+var tunnelTargetClient = &fasthttp.HostClient{
+	Dial:         newExpvarDial(fasthttp.Dial),
+	ReadTimeout:  120 * time.Second,
+	WriteTimeout: 5 * time.Second,
+}
+
+func tunnelAgentHandler(ctx *fasthttp.RequestCtx) {
+	ctx.Request.Header.ResetConnectionClose()
+	err := tunnelTargetClient.DoTimeout(&ctx.Request, &ctx.Response, *outTimeout)
+	if err == nil {
+		return
+	}
+	ctx.ResetBody()
+	fmt.Fprintf(ctx, "tunnel proxying error: %s", err)
+	if err == fasthttp.ErrTimeout {
+		ctx.SetStatusCode(fasthttp.StatusGatewayTimeout)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+	}
+}
@@ -1,10 +1,57 @@
 package httpteleport
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/valyala/fastrpc"
 )
 
-const protocolVersion = 0
+const protocolVersion = 4
+
+// Each request and response starts with the message type.
+const (
+	// messageHTTP is followed by http request or response.
+	messageHTTP = byte(iota)
+
+	// messagePing has no payload. The server responds to ping
+	// with messagePing without calling Server.Handler.
+	messagePing
+
+	// messageDeferred is sent instead of messageHTTP response if the response
+	// has been deferred via DeferResponse. It is followed by the uvarint id
+	// of the deferred response.
+	messageDeferred
+
+	// messagePoll asks the server for completed deferred responses.
+	// The request contains the uvarint maximum wait time in milliseconds.
+	// The response contains the uvarint number of deferred responses
+	// followed by the uvarint key and http response for each response.
+	// The key is id<<1 for deferred responses and id<<1|1 for responses
+	// to async requests.
+	messagePoll
+)
+
+// messageFlagTrace is set on the request type if the request is traced.
+// The request type is followed by the trace context then.
+const messageFlagTrace = 0x80
+
+// messageFlagAsync is set on the request type if the request is sent
+// via Client.DoAsync. The request type is followed by the uvarint id
+// of the async request then. The id follows the trace context
+// if messageFlagTrace is set.
+//
+// The server doesn't respond to async requests directly. Their responses
+// are sent in response to polls like deferred responses.
+const messageFlagAsync = 0x40
+
+// messageFlagDrain is set on the response type if the server is draining.
+// The response type is followed by the address to reconnect to then.
+// The address is empty if the client must reconnect to Client.Addr.
+const messageFlagDrain = 0x80
+
+// messageFlagLoad is set on the response type if the server sends its load.
+// The load follows the drain address if messageFlagDrain is set.
+const messageFlagLoad = 0x40
 
 var sniffHeader = "httpteleport"
 
@@ -43,3 +90,12 @@ const (
 	//
 	CompressSnappy = CompressType(fastrpc.CompressSnappy)
 )
+
+// skipBody skips the body with the given length in br.
+func skipBody(br *bufio.Reader, contentLength int) error {
+	if contentLength < 0 {
+		return fmt.Errorf("cannot skip body with unknown length")
+	}
+	_, err := br.Discard(contentLength)
+	return err
+}
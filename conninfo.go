@@ -0,0 +1,229 @@
+package httpteleport
+
+import (
+	"crypto/tls"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ConnInfo contains information about the client connection a request
+// has been received from.
+type ConnInfo struct {
+	// ID is the connection id, which is unique across the process.
+	ID uint64
+
+	// ClientName is Client.Name sent by the client in the handshake.
+	ClientName string
+
+	// ClientVersion is Client.Version sent by the client in the handshake.
+	ClientVersion string
+
+	// AuthKeyID is the id of the key the client has been authenticated with.
+	//
+	// AuthKeyID is empty if the server doesn't require authentication.
+	AuthKeyID string
+
+	// TLS is the TLS connection state.
+	//
+	// TLS.PeerCertificates and TLS.VerifiedChains contain client
+	// certificates if Server.TLSConfig requests them.
+	//
+	// TLS is nil for unencrypted connections.
+	TLS *tls.ConnectionState
+}
+
+// GetConnInfo returns information about the connection the request
+// in the given ctx has been received from.
+//
+// nil is returned if ctx isn't served by httpteleport Server.
+//
+// The returned ConnInfo mustn't be modified.
+func GetConnInfo(ctx *fasthttp.RequestCtx) *ConnInfo {
+	sc := getServerConn(ctx.Conn())
+	if sc == nil {
+		return nil
+	}
+	return &sc.info
+}
+
+// serverConn is a connection accepted by Server.
+type serverConn struct {
+	net.Conn
+
+	info ConnInfo
+
+	// budget is Server memory budget. It may be nil.
+	budget *memoryBudget
+
+	// quotas are Server concurrency quotas. They may be nil.
+	quotas *concurrencyQuotas
+	quota  connQuota
+
+	// reverse is set if the client accepts requests from the server.
+	reverse *ReverseClient
+
+	// drainGen is the generation of Server.Drain the client has been
+	// notified about.
+	drainGen uint32
+
+	// stats are Server statistics.
+	stats *serverCounters
+
+	// flushSpans contains spans for responses waiting for flush.
+	flushSpans flushSpans
+
+	// unflushed is the number of http responses buffered since the last
+	// write to the connection.
+	unflushed uint64
+
+	// deferred contains responses deferred via DeferResponse.
+	deferred deferredQueue
+
+	mu     sync.Mutex
+	closed bool
+
+	// bufferedBytes is the number of bytes acquired from budget
+	// by requests and responses on the connection.
+	bufferedBytes int64
+}
+
+// acquireBuffered accounts n bytes acquired from budget for the connection.
+//
+// false is returned if the connection is already closed.
+func (sc *serverConn) acquireBuffered(n int64) bool {
+	sc.mu.Lock()
+	ok := !sc.closed
+	if ok {
+		sc.bufferedBytes += n
+	}
+	sc.mu.Unlock()
+	return ok
+}
+
+// releaseBuffered returns false if n bytes have been already released
+// on connection close.
+func (sc *serverConn) releaseBuffered(n int64) bool {
+	sc.mu.Lock()
+	ok := !sc.closed
+	if ok {
+		sc.bufferedBytes -= n
+	}
+	sc.mu.Unlock()
+	return ok
+}
+
+func (sc *serverConn) Read(p []byte) (int, error) {
+	n, err := sc.Conn.Read(p)
+	sc.stats.addRead(n)
+	return n, err
+}
+
+func (sc *serverConn) Write(p []byte) (int, error) {
+	n, err := sc.Conn.Write(p)
+	sc.stats.addWritten(n, &sc.unflushed)
+	if err == nil {
+		sc.flushSpans.flushed(true, nil)
+	}
+	return n, err
+}
+
+// Close releases the bytes buffered for the connection, since pending
+// responses are never written to closed connections.
+func (sc *serverConn) Close() error {
+	sc.mu.Lock()
+	n := sc.bufferedBytes
+	sc.bufferedBytes = 0
+	wasClosed := sc.closed
+	sc.closed = true
+	sc.mu.Unlock()
+	if !wasClosed {
+		atomic.AddInt64(&sc.stats.openConns, -1)
+	}
+	if sc.budget != nil {
+		sc.budget.release(n)
+	}
+	if sc.quotas != nil {
+		sc.quotas.closeConn(&sc.quota)
+	}
+	sc.flushSpans.flushed(true, errConnClosed)
+	sc.deferred.close()
+	return sc.Conn.Close()
+}
+
+var connIDCounter uint64
+
+func newServerConn(conn net.Conn, info *ConnInfo, s *Server) *serverConn {
+	sc := &serverConn{
+		Conn:   conn,
+		info:   *info,
+		budget: s.budget,
+		quotas: s.quotas,
+		stats:  &s.stats,
+	}
+	atomic.AddUint64(&sc.stats.conns, 1)
+	atomic.AddInt64(&sc.stats.openConns, 1)
+	if ds := s.drainState(); ds != nil {
+		// Connections accepted while draining aren't drained.
+		sc.drainGen = ds.gen
+	}
+	sc.deferred.init()
+	sc.quota.clientID = clientID(conn, info)
+	sc.info.ID = atomic.AddUint64(&connIDCounter, 1)
+	return sc
+}
+
+func getServerConn(conn net.Conn) *serverConn {
+	for {
+		switch c := conn.(type) {
+		case *serverConn:
+			return c
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *muxStream:
+			conn = c.m.conn
+		default:
+			return nil
+		}
+	}
+}
+
+// newServerTLSConfig returns a copy of cfg, which saves TLS connection
+// state into ConnInfo for each serverConn.
+func newServerTLSConfig(cfg *tls.Config) *tls.Config {
+	serverCfg := cfg.Clone()
+	serverCfg.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		connCfg := cfg
+		if cfg.GetConfigForClient != nil {
+			c, err := cfg.GetConfigForClient(hello)
+			if err != nil {
+				return nil, err
+			}
+			if c != nil {
+				connCfg = c
+			}
+		}
+		sc := getServerConn(hello.Conn)
+		if sc == nil {
+			return connCfg, nil
+		}
+
+		// Clone the config on each connection, so the config changes
+		// made after Server start (for instance, tls.Config.SetSessionTicketKeys)
+		// are applied to new connections.
+		connCfg = connCfg.Clone()
+		verifyConnection := connCfg.VerifyConnection
+		connCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verifyConnection != nil {
+				if err := verifyConnection(cs); err != nil {
+					return err
+				}
+			}
+			sc.info.TLS = &cs
+			return nil
+		}
+		return connCfg, nil
+	}
+	return serverCfg
+}
@@ -0,0 +1,177 @@
+package httpteleport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnState is the state of the Client connection to the server.
+//
+// See Client.OnConnStateChange for details.
+type ConnState int
+
+const (
+	// ConnDialing is set when the client starts establishing
+	// the connection to the server.
+	ConnDialing = ConnState(iota)
+
+	// ConnConnected is set when the connection to the server
+	// is established.
+	ConnConnected
+
+	// ConnDisconnected is set when the connection to the server
+	// is closed or cannot be established.
+	ConnDisconnected
+)
+
+// String returns human-readable connection state.
+func (cs ConnState) String() string {
+	switch cs {
+	case ConnDialing:
+		return "dialing"
+	case ConnConnected:
+		return "connected"
+	case ConnDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+const defaultMaxReconnectDelay = 30 * time.Second
+
+func (c *Client) setConnState(state ConnState, err error) {
+	if c.OnConnStateChange != nil {
+		c.OnConnStateChange(state, err)
+	}
+}
+
+// waitReconnect sleeps before reconnecting to the server
+// after failed dials.
+func (c *Client) waitReconnect() {
+	failures := atomic.LoadUint32(&c.dialFailures)
+	if failures == 0 || c.ReconnectDelay <= 0 {
+		return
+	}
+	time.Sleep(c.reconnectDelay(failures))
+}
+
+// reconnectDelay returns the delay before reconnecting to the server
+// after the given number of failed dials.
+func (c *Client) reconnectDelay(failures uint32) time.Duration {
+	maxDelay := c.MaxReconnectDelay
+	if maxDelay <= 0 {
+		maxDelay = defaultMaxReconnectDelay
+	}
+	d := c.ReconnectDelay
+	for i := uint32(1); i < failures && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	if c.ReconnectJitter > 0 {
+		// Randomize the delay in the range [d*(1-jitter) .. d*(1+jitter)),
+		// so clients don't reconnect simultaneously after server restart.
+		jitter := c.ReconnectJitter
+		if jitter > 1 {
+			jitter = 1
+		}
+		d = time.Duration(float64(d) * (1 + jitter*(2*rand.Float64()-1)))
+	}
+	return d
+}
+
+// clientConn is the connection established by Client.
+//
+// It reports ConnDisconnected state on close.
+type clientConn struct {
+	// lastReadNanos is the unix time in nanoseconds of the last
+	// successful read from the connection.
+	lastReadNanos int64
+
+	net.Conn
+	c *Client
+	t *clientTransport
+
+	closeOnce sync.Once
+	closedCh  chan struct{}
+
+	errLock sync.Mutex
+	err     error
+}
+
+func newClientConn(conn net.Conn, t *clientTransport) *clientConn {
+	return &clientConn{
+		Conn:     conn,
+		c:        t.owner,
+		t:        t,
+		closedCh: make(chan struct{}),
+	}
+}
+
+func (cc *clientConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	cc.c.stats.addRead(n)
+	if n > 0 {
+		atomic.StoreInt64(&cc.lastReadNanos, time.Now().UnixNano())
+	}
+	if err != nil {
+		cc.setError(err)
+	}
+	return n, err
+}
+
+func (cc *clientConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	cc.c.stats.addWritten(n, &cc.c.stats.unflushed)
+	if err != nil {
+		cc.setError(err)
+	} else {
+		cc.t.flushSpans.flushed(false, nil)
+	}
+	return n, err
+}
+
+// lastRead returns the time of the last successful read from cc.
+func (cc *clientConn) lastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&cc.lastReadNanos))
+}
+
+// setError remembers the first error on the connection.
+func (cc *clientConn) setError(err error) {
+	cc.errLock.Lock()
+	if cc.err == nil {
+		cc.err = err
+	}
+	cc.errLock.Unlock()
+}
+
+// closeWithError closes the connection due to the given error.
+func (cc *clientConn) closeWithError(err error) error {
+	cc.setError(err)
+	return cc.Close()
+}
+
+func (cc *clientConn) Close() error {
+	err := cc.Conn.Close()
+	cc.closeOnce.Do(func() {
+		close(cc.closedCh)
+		cc.errLock.Lock()
+		err := cc.err
+		cc.errLock.Unlock()
+		if err == nil {
+			err = errConnClosed
+		}
+		cc.t.failDeferred(err)
+		if err != errConnDrained {
+			// The client remains connected to the server
+			// via the new connection after the drain.
+			cc.c.setConnState(ConnDisconnected, err)
+		}
+	})
+	return err
+}
@@ -0,0 +1,503 @@
+package httpteleport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DeferredResponse is a response, which is completed after Server.Handler
+// returns.
+//
+// Deferred responses may be used for long-polling endpoints. Server.Handler
+// returns immediately after DeferResponse call, so neither the Handler
+// goroutine nor the Concurrency slot is occupied while waiting for events.
+// The client waits for the response until the request deadline.
+type DeferredResponse struct {
+	ctx *handlerCtx
+	id  uint64
+
+	timer *time.Timer
+
+	mu        sync.Mutex
+	completed bool
+	timedOut  bool
+	acked     bool
+}
+
+// handlerCtxKey is the RequestCtx user value key for handlerCtx.
+const handlerCtxKey = "httpteleport.handlerCtx"
+
+// DeferResponse detaches the request in ctx from Server.Handler,
+// so the response may be completed later from another goroutine.
+//
+// The response must be set on ctx and then DeferredResponse.Done
+// must be called. The response is sent to the client on the connection
+// the request has been received from.
+//
+// 504 Gateway Timeout response is sent to the client if Done isn't called
+// during the given timeout.
+//
+// nil is returned in the following cases:
+//
+//   - if ctx isn't served by httpteleport Server;
+//   - if Server.PipelineRequests is set, since the following requests
+//     from the client are processed only after the response is sent;
+//   - if Server.MaxDeferredResponses limit is reached.
+//
+// The response must be set before returning from Server.Handler in this case.
+//
+// DeferResponse must be called from Server.Handler.
+func DeferResponse(ctx *fasthttp.RequestCtx, timeout time.Duration) *DeferredResponse {
+	if timeout <= 0 {
+		panic("BUG: timeout must be positive")
+	}
+	hctx, ok := ctx.UserValue(handlerCtxKey).(*handlerCtx)
+	if !ok || hctx.ctx != ctx {
+		return nil
+	}
+	if hctx.deferred != nil {
+		return hctx.deferred
+	}
+	s := hctx.s
+	if s.PipelineRequests || hctx.sc == nil {
+		return nil
+	}
+	if s.MaxDeferredResponses > 0 {
+		if n := atomic.AddInt32(&s.deferredResponses, 1); int(n) > s.MaxDeferredResponses {
+			atomic.AddInt32(&s.deferredResponses, -1)
+			return nil
+		}
+	}
+	dr := &DeferredResponse{
+		ctx: hctx,
+	}
+	if hctx.isAsync {
+		// The response to async request is already pending in the deferred
+		// queue, and the client needn't be notified it is deferred.
+		dr.acked = true
+	} else {
+		id, ok := hctx.sc.deferred.add()
+		if !ok {
+			// The connection is closed, so the response cannot be delivered.
+			if s.MaxDeferredResponses > 0 {
+				atomic.AddInt32(&s.deferredResponses, -1)
+			}
+			return nil
+		}
+		dr.id = id
+	}
+	dr.timer = time.AfterFunc(timeout, dr.timeout)
+	hctx.deferred = dr
+	return dr
+}
+
+// Done sends the response set on the deferred ctx to the client.
+//
+// false is returned if the response has been already timed out.
+// The ctx mustn't be accessed after Done call.
+func (dr *DeferredResponse) Done() bool {
+	if !dr.complete(false) {
+		return false
+	}
+	dr.timer.Stop()
+	return true
+}
+
+func (dr *DeferredResponse) timeout() {
+	if dr.complete(true) {
+		atomic.AddUint64(&dr.ctx.s.stats.deferredTimeouts, 1)
+	}
+}
+
+// complete marks the response as completed.
+//
+// The response is passed to the connection if the client has been
+// already notified the response is deferred.
+func (dr *DeferredResponse) complete(timedOut bool) bool {
+	dr.mu.Lock()
+	if dr.completed {
+		dr.mu.Unlock()
+		return false
+	}
+	dr.completed = true
+	dr.timedOut = timedOut
+	acked := dr.acked
+	dr.mu.Unlock()
+
+	if s := dr.ctx.s; s.MaxDeferredResponses > 0 {
+		atomic.AddInt32(&s.deferredResponses, -1)
+	}
+	if acked {
+		dr.ready()
+	}
+	return true
+}
+
+// ack is called after the client is notified the response is deferred.
+//
+// The completed response is passed to the connection only after that,
+// so the client never receives the response before the notification.
+func (dr *DeferredResponse) ack() {
+	dr.mu.Lock()
+	dr.acked = true
+	completed := dr.completed
+	dr.mu.Unlock()
+
+	if completed {
+		dr.ready()
+	}
+}
+
+// ready passes the completed response to the connection, so it is sent
+// to the client in response to the next poll.
+func (dr *DeferredResponse) ready() {
+	ctx := dr.ctx
+	s := ctx.s
+	if dr.timedOut {
+		// The original ctx may be still in use by the goroutine
+		// completing the response.
+		ctxNew := s.newHandlerCtx().(*handlerCtx)
+		ctxNew.ctx.Error("deferred response timeout", fasthttp.StatusGatewayTimeout)
+		ctxNew.sc = ctx.sc
+		ctxNew.span = ctx.span
+		ctxNew.isAsync = ctx.isAsync
+		ctxNew.asyncID = ctx.asyncID
+		ctx.releaseBuffered()
+		ctx = ctxNew
+	}
+	s.finishResponse(ctx)
+	ctx.deferredID = dr.id
+	ctx.sc.deferred.push(ctx)
+}
+
+// deferredQueue contains deferred responses for a single connection.
+type deferredQueue struct {
+	mu      sync.Mutex
+	nextID  uint64
+	pending int
+	ready   []*handlerCtx
+	closed  bool
+
+	// readyCh is signaled when ready responses are added.
+	// It is closed when the connection is closed.
+	readyCh chan struct{}
+}
+
+func (q *deferredQueue) init() {
+	q.readyCh = make(chan struct{}, 1)
+}
+
+// add registers new deferred response and returns its id.
+//
+// false is returned if the connection is closed.
+func (q *deferredQueue) add() (uint64, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return 0, false
+	}
+	q.nextID++
+	q.pending++
+	return q.nextID, true
+}
+
+// reserve registers pending response to async request.
+//
+// false is returned if the connection is closed.
+func (q *deferredQueue) reserve() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false
+	}
+	q.pending++
+	return true
+}
+
+func (q *deferredQueue) push(ctx *handlerCtx) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		ctx.releaseBuffered()
+		if ctx.span != nil {
+			ctx.span.end(errConnClosed)
+		}
+		return
+	}
+	q.pending--
+	q.ready = append(q.ready, ctx)
+	select {
+	case q.readyCh <- struct{}{}:
+	default:
+	}
+	q.mu.Unlock()
+}
+
+// wait waits for ready responses during the given timeout.
+//
+// It returns immediately if there are no pending responses.
+func (q *deferredQueue) wait(timeout time.Duration) []*handlerCtx {
+	var t *time.Timer
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 || q.pending == 0 || q.closed || timeout <= 0 {
+			ready := q.ready
+			q.ready = nil
+			q.mu.Unlock()
+			if t != nil {
+				fasthttp.ReleaseTimer(t)
+			}
+			return ready
+		}
+		q.mu.Unlock()
+
+		if t == nil {
+			t = fasthttp.AcquireTimer(timeout)
+		}
+		select {
+		case <-q.readyCh:
+		case <-t.C:
+			timeout = 0
+		}
+	}
+}
+
+// close drops ready responses, since they cannot be sent
+// over the closed connection.
+func (q *deferredQueue) close() {
+	q.mu.Lock()
+	ready := q.ready
+	q.ready = nil
+	if !q.closed {
+		q.closed = true
+		close(q.readyCh)
+	}
+	q.mu.Unlock()
+	for _, ctx := range ready {
+		if ctx.span != nil {
+			ctx.span.end(errConnClosed)
+		}
+	}
+}
+
+// maxPollTimeout is the maximum duration the server waits for deferred
+// responses before responding to poll.
+const maxPollTimeout = time.Second
+
+// writeDeferred writes deferred responses for the poll to bw.
+func (ctx *handlerCtx) writeDeferred(bw *bufio.Writer) error {
+	if err := ctx.writeMessageType(bw, messagePoll); err != nil {
+		return err
+	}
+	polled := ctx.polled
+	ctx.polled = nil
+	var b [binary.MaxVarintLen64]byte
+	if _, err := bw.Write(appendUvarint(b[:0], uint64(len(polled)))); err != nil {
+		return err
+	}
+	for _, p := range polled {
+		key := p.deferredID << 1
+		if p.isAsync {
+			key = p.asyncID<<1 | 1
+		}
+		if _, err := bw.Write(appendUvarint(b[:0], key)); err != nil {
+			return err
+		}
+		if err := p.writeHTTP(bw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deferredWaiter waits for the deferred response or for the response
+// to async request on the client.
+type deferredWaiter struct {
+	// key is the key of the response in poll responses.
+	// See messagePoll for details.
+	key    uint64
+	r      *responseReader
+	doneCh chan error
+
+	// async is set if the waiter waits for the response to async request.
+	// doneCh is nil then.
+	async *asyncCall
+}
+
+// done passes the result to the waiter.
+func (w *deferredWaiter) done(err error) {
+	if w.async != nil {
+		w.async.finish(err)
+		return
+	}
+	w.doneCh <- err
+}
+
+// addDeferredWaiter registers r as waiting for the deferred response
+// with the given id.
+func (t *clientTransport) addDeferredWaiter(id uint64, r *responseReader) *deferredWaiter {
+	w := &deferredWaiter{
+		key:    id << 1,
+		r:      r,
+		doneCh: make(chan error, 1),
+	}
+	t.deferredMu.Lock()
+	startPoller := t.addWaiterLocked(w)
+	t.deferredMu.Unlock()
+
+	if startPoller {
+		go t.poller()
+	}
+	return w
+}
+
+// addWaiterLocked registers w. It must be called with deferredMu held.
+//
+// true is returned if the poller must be started.
+func (t *clientTransport) addWaiterLocked(w *deferredWaiter) bool {
+	if t.deferredWaiters == nil {
+		t.deferredWaiters = make(map[uint64]*deferredWaiter)
+	}
+	t.deferredWaiters[w.key] = w
+	startPoller := !t.polling
+	t.polling = true
+	return startPoller
+}
+
+// takeDeferredWaiter unregisters the waiter with the given key.
+//
+// nil is returned if there is no such waiter.
+func (t *clientTransport) takeDeferredWaiter(key uint64) *deferredWaiter {
+	t.deferredMu.Lock()
+	w := t.deferredWaiters[key]
+	delete(t.deferredWaiters, key)
+	t.deferredMu.Unlock()
+	return w
+}
+
+// failDeferred fails all the deferred waiters with the given error.
+//
+// It is called when the connection is closed, since deferred responses
+// cannot be received over another connection.
+func (t *clientTransport) failDeferred(err error) {
+	t.deferredMu.Lock()
+	waiters := t.deferredWaiters
+	t.deferredWaiters = nil
+	t.deferredMu.Unlock()
+	for _, w := range waiters {
+		w.done(err)
+	}
+}
+
+// waitDeferred waits for the deferred response until the deadline.
+func (t *clientTransport) waitDeferred(w *deferredWaiter, deadline time.Time) error {
+	tm := fasthttp.AcquireTimer(-time.Since(deadline))
+	defer fasthttp.ReleaseTimer(tm)
+	select {
+	case err := <-w.doneCh:
+		return err
+	case <-tm.C:
+	}
+	if t.takeDeferredWaiter(w.key) != nil {
+		return ErrTimeout
+	}
+	// The response is being read concurrently.
+	return <-w.doneCh
+}
+
+// minPollInterval is the minimum interval between polls, which return
+// without deferred responses.
+const minPollInterval = 10 * time.Millisecond
+
+// poller polls the server for deferred responses and for responses
+// to async requests while there are waiters.
+func (t *clientTransport) poller() {
+	c := t.owner
+	timeout := maxPollTimeout
+	if c.ReadTimeout > 0 && c.ReadTimeout/2 < timeout {
+		// The connection mustn't be closed due to ReadTimeout
+		// while the server waits for deferred responses.
+		timeout = c.ReadTimeout / 2
+	}
+	for {
+		t.deferredMu.Lock()
+		if len(t.deferredWaiters) == 0 {
+			t.polling = false
+			t.deferredMu.Unlock()
+			return
+		}
+		t.deferredMu.Unlock()
+
+		startTime := time.Now()
+		r := &pollResponse{t: t}
+		err := t.c.DoDeadline(pollRequest{timeout}, r, startTime.Add(2*timeout))
+		if (err != nil || r.n == 0) && time.Since(startTime) < minPollInterval {
+			time.Sleep(minPollInterval)
+		}
+	}
+}
+
+type pollRequest struct {
+	timeout time.Duration
+}
+
+func (r pollRequest) WriteRequest(bw *bufio.Writer) error {
+	var b [1 + binary.MaxVarintLen64]byte
+	buf := append(b[:0], messagePoll)
+	buf = appendUvarint(buf, uint64(r.timeout/time.Millisecond))
+	_, err := bw.Write(buf)
+	return err
+}
+
+type pollResponse struct {
+	t *clientTransport
+
+	// n is the number of received deferred responses.
+	n int
+}
+
+func (r *pollResponse) ReadResponse(br *bufio.Reader) error {
+	if err := r.t.expectMessageType(br, messagePoll); err != nil {
+		return err
+	}
+	n, err := r.t.readDeferred(br)
+	r.n = n
+	return err
+}
+
+// readDeferred reads deferred responses and responses to async requests
+// sent in response to poll and passes them to waiters.
+func (t *clientTransport) readDeferred(br *bufio.Reader) (int, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read the number of deferred responses: %s", err)
+	}
+	for i := 0; i < int(n); i++ {
+		key, err := binary.ReadUvarint(br)
+		if err != nil {
+			return i, fmt.Errorf("cannot read deferred response key: %s", err)
+		}
+		w := t.takeDeferredWaiter(key)
+		if w == nil {
+			// The request has been timed out.
+			resp := fasthttp.AcquireResponse()
+			err = resp.Read(br)
+			fasthttp.ReleaseResponse(resp)
+			if err != nil {
+				return i, err
+			}
+			continue
+		}
+		err = w.r.readHTTP(br)
+		w.done(err)
+		if err != nil {
+			return i, err
+		}
+	}
+	return int(n), nil
+}
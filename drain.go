@@ -0,0 +1,417 @@
+package httpteleport
+
+import (
+	"errors"
+	"github.com/valyala/fastrpc"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Drain asks clients to stop sending new requests over the current
+// connections to the server.
+//
+// Clients establish new connections right away and send new requests
+// over them, while outstanding requests are completed over the draining
+// connections. The draining connections are closed after that.
+// Clients connect to addr if it isn't empty. Otherwise they reconnect
+// to Client.Addr. Clients fall back to Client.Addr if addr cannot
+// be dialed.
+//
+// Clients are notified in responses, so idle clients are notified on the
+// next request or ping. Connections accepted after Drain call aren't
+// drained, so reconnecting clients aren't drained again. The server
+// continues serving requests while draining, so close the listener
+// passed to Serve in order to stop accepting new connections.
+//
+// Drain may be used before server restart, so clients switch
+// to another server without failed requests.
+//
+// The drain may be cancelled via CancelDrain.
+func (s *Server) Drain(addr string) {
+	if len(addr) > 255 {
+		panic("BUG: addr length cannot exceed 255 bytes")
+	}
+	s.drainMu.Lock()
+	s.drainGen++
+	s.drain.Store(&drainState{
+		addr: addr,
+		gen:  s.drainGen,
+	})
+	s.drainMu.Unlock()
+}
+
+// CancelDrain stops notifying clients about the drain started via Drain.
+//
+// Clients, which have been already notified, continue draining
+// their connections.
+func (s *Server) CancelDrain() {
+	s.drain.Store((*drainState)(nil))
+}
+
+// drainState is the state of Server.Drain.
+type drainState struct {
+	addr string
+
+	// gen is incremented on each Drain call, so connections are drained
+	// once per Drain call.
+	gen uint32
+}
+
+// drainState returns the current drain state.
+//
+// nil is returned if the server isn't draining.
+func (s *Server) drainState() *drainState {
+	ds, _ := s.drain.Load().(*drainState)
+	return ds
+}
+
+// shouldDrain returns true if the client must be notified about the drain
+// in the response sent over sc.
+func (sc *serverConn) shouldDrain(ds *drainState) bool {
+	for {
+		gen := atomic.LoadUint32(&sc.drainGen)
+		if gen >= ds.gen {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(&sc.drainGen, gen, ds.gen) {
+			return true
+		}
+	}
+}
+
+// clientTransport sends requests to the server over a single connection
+// at a time.
+//
+// The client switches to another transport when the server asks it
+// to drain the connection, so new requests are sent over the new
+// connection while outstanding requests are completed over the draining
+// connection. fastrpc.Client cannot be stopped, so drained transports
+// are reused on the next drain instead of leaking a goroutine per drain.
+type clientTransport struct {
+	c     fastrpc.Client
+	owner *Client
+
+	flushSpans flushSpans
+
+	// deferredMu protects deferred waiters, which wait for responses
+	// deferred via DeferResponse and for responses to async requests.
+	// These responses are bound to the connection, so they are tracked
+	// per transport.
+	deferredMu      sync.Mutex
+	deferredWaiters map[uint64]*deferredWaiter
+	polling         bool
+
+	// lastAsyncID is the id of the last async request.
+	// It is protected by deferredMu.
+	lastAsyncID uint64
+
+	// asyncInFlight is the number of sent async requests waiting
+	// for responses.
+	asyncInFlight int32
+
+	// wakeCh is notified when the idle transport is reused.
+	wakeCh chan struct{}
+
+	// The fields below are protected by owner.drainMu.
+	conn        *clientConn
+	outstanding int
+	draining    bool
+	idle        bool
+
+	// pooled is set when the idle transport is in owner.idleTransports.
+	pooled bool
+}
+
+func (c *Client) newTransport() *clientTransport {
+	t := &clientTransport{
+		owner:  c,
+		wakeCh: make(chan struct{}, 1),
+	}
+	t.c.SniffHeader = sniffHeader
+	t.c.ProtocolVersion = protocolVersion
+	t.c.NewResponse = t.newResponse
+
+	t.c.Addr = c.addr
+	t.c.CompressType = fastrpc.CompressType(c.CompressType)
+	t.c.Dial = t.dial
+	t.c.TLSConfig = c.TLSConfig
+	t.c.MaxPendingRequests = c.MaxPendingRequests
+	t.c.MaxBatchDelay = c.MaxBatchDelay
+	t.c.ReadTimeout = c.ReadTimeout
+	t.c.WriteTimeout = c.WriteTimeout
+	t.c.ReadBufferSize = c.ReadBufferSize
+	t.c.WriteBufferSize = c.WriteBufferSize
+
+	if c.ReverseHandler != nil {
+		// TLS is established before multiplexing the connection,
+		// so fastrpc mustn't encrypt the forward stream again.
+		t.c.TLSConfig = nil
+	}
+	if c.pendingSem != nil {
+		// Pings and polls for deferred responses bypass pendingSem,
+		// so reserve room for them in the pending requests queue.
+		// Otherwise requests, which obtained pendingSem slot, could
+		// fail with ErrPendingRequestsOverflow.
+		t.c.MaxPendingRequests = c.pendingSem.maxSlots + reservedPendingRequests
+	}
+	return t
+}
+
+// dial is called by t.c for establishing the connection.
+//
+// addr is ignored, since the client may be reused for another address.
+// See Client.restart for details.
+func (t *clientTransport) dial(addr string) (net.Conn, error) {
+	c := t.owner
+	for {
+		c.drainMu.Lock()
+		if t.draining {
+			c.drainMu.Unlock()
+			// The draining connection has been closed before
+			// outstanding requests are completed. There is no need
+			// in the new connection, since new requests are sent
+			// over another transport.
+			return nil, errConnDrained
+		}
+		if !t.idle {
+			c.drainMu.Unlock()
+			break
+		}
+		if !t.pooled {
+			// The previous connection is completely closed, so
+			// requests sent over the reused transport cannot be
+			// written to it.
+			t.pooled = true
+			c.idleTransports = append(c.idleTransports, t)
+		}
+		c.drainMu.Unlock()
+
+		// The transport waits until it is reused.
+		<-t.wakeCh
+	}
+	return c.dial(t)
+}
+
+// acquireTransport returns the transport for sending n new requests
+// and registers the requests as outstanding on the transport.
+func (c *Client) acquireTransport(n int) (*clientTransport, error) {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if c.stopped {
+		return nil, errClientStopped
+	}
+	t := c.t
+	t.outstanding += n
+	return t, nil
+}
+
+// releaseTransport unregisters outstanding request acquired
+// via acquireTransport. It is called once per request.
+//
+// The draining connection is closed after the last outstanding request.
+func (c *Client) releaseTransport(t *clientTransport) {
+	c.drainMu.Lock()
+	t.outstanding--
+	var conn *clientConn
+	if t.draining && t.outstanding == 0 {
+		conn = c.retireTransport(t)
+	}
+	c.drainMu.Unlock()
+	if conn != nil {
+		conn.closeWithError(errConnDrained)
+	}
+}
+
+// pendingRequests returns the number of pending requests
+// on the transport, including async requests waiting for responses.
+func (t *clientTransport) pendingRequests() int {
+	return t.c.PendingRequests() + int(atomic.LoadInt32(&t.asyncInFlight))
+}
+
+var errConnDrained = errors.New("the connection has been drained on server request")
+
+// drain switches new requests to the new connection.
+//
+// It is called when the server notifies the client it is draining
+// the connection of the transport t.
+func (c *Client) drain(t *clientTransport, addr string) {
+	c.drainMu.Lock()
+	if t != c.t || c.stopped {
+		// The connection is already draining.
+		c.drainMu.Unlock()
+		return
+	}
+	atomic.AddUint64(&c.drains, 1)
+	// Empty addr means the client must reconnect to Client.Addr,
+	// so reset the address from the previous drain.
+	c.redirectAddr = addr
+	nt, isNew := c.acquireIdleTransport()
+	c.t = nt
+	conn := c.startDraining(t)
+	c.drainMu.Unlock()
+	if conn != nil {
+		conn.closeWithError(errConnDrained)
+	}
+
+	// Establish the new connection right away, so new requests
+	// don't wait for outstanding requests on the draining connection.
+	if isNew {
+		// fastrpc.Client starts connecting on the first call.
+		go nt.c.DoDeadline(pingRequest{}, pingResponse{nt}, time.Now().Add(handshakeTimeout))
+	} else {
+		nt.wake()
+	}
+}
+
+// wake resumes establishing connections by the reused transport.
+func (t *clientTransport) wake() {
+	select {
+	case t.wakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// acquireIdleTransport returns the transport from idleTransports
+// or a new transport if there are no idle transports.
+//
+// isNew is set for new transports.
+//
+// c.drainMu must be held.
+func (c *Client) acquireIdleTransport() (t *clientTransport, isNew bool) {
+	n := len(c.idleTransports)
+	if n == 0 {
+		return c.newTransport(), true
+	}
+	t = c.idleTransports[n-1]
+	c.idleTransports[n-1] = nil
+	c.idleTransports = c.idleTransports[:n-1]
+	t.idle = false
+	t.pooled = false
+	return t, false
+}
+
+// startDraining stops sending new requests over t.
+//
+// It returns the connection, which must be closed by the caller,
+// if t has no outstanding requests.
+//
+// c.drainMu must be held.
+func (c *Client) startDraining(t *clientTransport) *clientConn {
+	t.draining = true
+	c.draining = append(c.draining, t)
+	if t.outstanding > 0 {
+		return nil
+	}
+	return c.retireTransport(t)
+}
+
+// retireTransport marks the drained transport t as idle.
+//
+// The transport is moved to idleTransports when its connection is closed.
+// It returns the connection, which must be closed by the caller.
+//
+// c.drainMu must be held.
+func (c *Client) retireTransport(t *clientTransport) *clientConn {
+	for i, dt := range c.draining {
+		if dt == t {
+			c.draining = append(c.draining[:i], c.draining[i+1:]...)
+			break
+		}
+	}
+	t.draining = false
+	t.idle = true
+	conn := t.conn
+	t.conn = nil
+	return conn
+}
+
+// stop closes the connection to the server after outstanding requests
+// are completed and prevents establishing new connections.
+//
+// New requests to the stopped client fail with errClientStopped.
+func (c *Client) stop() {
+	c.once.Do(c.init)
+	c.drainMu.Lock()
+	if c.stopped {
+		c.drainMu.Unlock()
+		return
+	}
+	c.stopped = true
+	conn := c.startDraining(c.t)
+	c.drainMu.Unlock()
+	if conn != nil {
+		conn.closeWithError(errClientStopped)
+	}
+}
+
+var errClientStopped = errors.New("the client has been stopped")
+
+// restart resumes sending requests by the client stopped via stop.
+//
+// Requests are sent to addr after that. fastrpc.Client cannot be stopped,
+// so stopped clients are reused instead of leaking their goroutines.
+func (c *Client) restart(addr string) {
+	c.once.Do(c.init)
+	c.drainMu.Lock()
+	if !c.stopped {
+		c.drainMu.Unlock()
+		panic("BUG: only stopped client may be restarted")
+	}
+	c.stopped = false
+	c.Addr = addr
+	c.addr = addr
+	c.redirectAddr = ""
+	t, isNew := c.acquireIdleTransport()
+	c.t = t
+	c.drainMu.Unlock()
+	if !isNew {
+		t.wake()
+	}
+}
+
+// setConn sets the connection established by the transport t.
+//
+// false is returned if the transport has been drained or stopped
+// while establishing the connection, so the connection must be closed.
+func (c *Client) setConn(t *clientTransport, conn *clientConn) bool {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if t.draining || t.idle {
+		return false
+	}
+	t.conn = conn
+	return true
+}
+
+// dialAddr returns the address to connect to.
+//
+// redirected is set if the client has been redirected to the address
+// on drain.
+func (c *Client) dialAddr() (addr string, redirected bool) {
+	c.drainMu.Lock()
+	defer c.drainMu.Unlock()
+	if len(c.redirectAddr) > 0 {
+		return c.redirectAddr, true
+	}
+	return c.addr, false
+}
+
+// resetRedirect makes the client connect to Client.Addr instead
+// of the given redirectAddr, which cannot be dialed.
+func (c *Client) resetRedirect(redirectAddr string) {
+	c.drainMu.Lock()
+	if c.redirectAddr == redirectAddr {
+		c.redirectAddr = ""
+	}
+	c.drainMu.Unlock()
+}
+
+// Drains returns the number of times the client drained connections
+// on server requests.
+//
+// See Server.Drain for details.
+func (c *Client) Drains() uint64 {
+	return atomic.LoadUint64(&c.drains)
+}
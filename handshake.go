@@ -0,0 +1,469 @@
+package httpteleport
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// AuthKey is a pre-shared key used for authenticating connections
+// between Client and Server.
+//
+// The key secret is never sent over the network. The client proves
+// it knows the secret via HMAC challenge-response, and the server proves
+// it knows the secret in return.
+type AuthKey struct {
+	// ID identifies the key on the server.
+	//
+	// ID is sent to the server in plaintext, so it mustn't contain
+	// sensitive information. ID length cannot exceed 255 bytes.
+	ID string
+
+	// Secret is the shared secret known to both Client and Server.
+	//
+	// Bearer tokens may be used as secrets.
+	Secret []byte
+}
+
+// SetAuthKeys replaces Server.AuthKeys on the running server.
+//
+// The new keys are used for connections accepted after the call,
+// while already authenticated connections remain open.
+// SetAuthKeys may be called concurrently with Serve.
+func (s *Server) SetAuthKeys(keys []AuthKey) {
+	keysCopy := append([]AuthKey{}, keys...)
+	s.authKeysV.Store(keysCopy)
+}
+
+// authKeys returns keys set via SetAuthKeys or Server.AuthKeys.
+func (s *Server) authKeys() []AuthKey {
+	if keys, ok := s.authKeysV.Load().([]AuthKey); ok {
+		return keys
+	}
+	return s.AuthKeys
+}
+
+// The handshake is performed before handing the connection to fastrpc
+// if the client sets AuthKey, ReverseHandler, Name or Version.
+// Otherwise the client skips the handshake and the server distinguishes
+// such connections by the fastrpc header. See sniffHandshake.
+//
+// The handshake is sent in plaintext before TLS is established,
+// so the key ID, client name and client version are visible on the network.
+// The handshake looks like:
+//
+//	client -> server: handshakeHeader, handshakeVersion, flags, keyID,
+//	                  clientName, clientVersion, clientNonce
+//	server -> client: handshakeOK
+//	                | handshakeError, message
+//	                | handshakeChallenge, serverNonce
+//
+// The following messages are sent only after handshakeChallenge:
+//
+//	client -> server: clientMAC
+//	server -> client: handshakeAuthOK, serverMAC
+//	                | handshakeError, message
+//
+// The connection is multiplexed via muxConn after the handshake
+// if flags contain handshakeFlagBidi. TLS is established before
+// multiplexing if flags contain handshakeFlagTLS.
+const (
+	handshakeHeader  = "httpteleport-handshake"
+	handshakeVersion = 2
+
+	handshakeTimeout = 3 * time.Second
+
+	nonceSize = 32
+	macSize   = sha256.Size
+)
+
+const (
+	// handshakeFlagBidi is set by clients accepting requests
+	// from the server. See Client.ReverseHandler.
+	handshakeFlagBidi = byte(1 << iota)
+
+	// handshakeFlagTLS is set by bidirectional clients with TLS.
+	handshakeFlagTLS
+)
+
+const (
+	handshakeOK = byte(iota)
+	handshakeError
+	handshakeChallenge
+	handshakeAuthOK
+)
+
+var (
+	errAuthRequired = errors.New("the server requires authentication. Set Client.AuthKey")
+	errAuthMissing  = errors.New("authentication required. The client must set Client.AuthKey")
+
+	errTLSUnsupported = errors.New("the server doesn't accept encrypted connections. Set Server.TLSConfig")
+)
+
+func handshakeClient(conn net.Conn, c *Client) error {
+	key := c.AuthKey
+	var keyID string
+	if key != nil {
+		keyID = key.ID
+		if len(keyID) > 255 {
+			return fmt.Errorf("too long AuthKey.ID: %d bytes. It cannot exceed 255 bytes", len(keyID))
+		}
+	}
+	if len(c.Name) > 255 {
+		return fmt.Errorf("too long Client.Name: %d bytes. It cannot exceed 255 bytes", len(c.Name))
+	}
+	if len(c.Version) > 255 {
+		return fmt.Errorf("too long Client.Version: %d bytes. It cannot exceed 255 bytes", len(c.Version))
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return fmt.Errorf("cannot set handshake deadline: %s", err)
+	}
+
+	var clientNonce [nonceSize]byte
+	if _, err := rand.Read(clientNonce[:]); err != nil {
+		return fmt.Errorf("cannot generate nonce: %s", err)
+	}
+	buf := append([]byte(handshakeHeader), handshakeVersion, c.handshakeFlags())
+	buf = appendHandshakeString(buf, keyID)
+	buf = appendHandshakeString(buf, c.Name)
+	buf = appendHandshakeString(buf, c.Version)
+	buf = append(buf, clientNonce[:]...)
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("cannot send handshake to the server: %s", err)
+	}
+
+	status, err := readHandshakeStatus(conn)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case handshakeOK:
+		return conn.SetDeadline(time.Time{})
+	case handshakeChallenge:
+		// Handled below.
+	default:
+		return fmt.Errorf("unexpected handshake status from the server: %d", status)
+	}
+	if key == nil {
+		return errAuthRequired
+	}
+
+	var serverNonce [nonceSize]byte
+	if _, err := io.ReadFull(conn, serverNonce[:]); err != nil {
+		return fmt.Errorf("cannot read server nonce: %s", err)
+	}
+	mac := handshakeMAC("client", key, clientNonce[:], serverNonce[:])
+	if _, err := conn.Write(mac); err != nil {
+		return fmt.Errorf("cannot send auth response to the server: %s", err)
+	}
+
+	if status, err = readHandshakeStatus(conn); err != nil {
+		return err
+	}
+	if status != handshakeAuthOK {
+		return fmt.Errorf("unexpected auth status from the server: %d", status)
+	}
+	var serverMAC [macSize]byte
+	if _, err := io.ReadFull(conn, serverMAC[:]); err != nil {
+		return fmt.Errorf("cannot read server auth response: %s", err)
+	}
+	expectedMAC := handshakeMAC("server", key, clientNonce[:], serverNonce[:])
+	if !hmac.Equal(serverMAC[:], expectedMAC) {
+		return fmt.Errorf("the server doesn't know the secret for AuthKey.ID=%q", keyID)
+	}
+	return conn.SetDeadline(time.Time{})
+}
+
+// readHandshakeStatus reads handshake status from the server.
+//
+// handshakeError is converted to an error.
+func readHandshakeStatus(conn net.Conn) (byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(conn, b[:]); err != nil {
+		return 0, fmt.Errorf("cannot read handshake response from the server: %s", err)
+	}
+	if b[0] != handshakeError {
+		return b[0], nil
+	}
+	msg, err := readHandshakeString(conn)
+	if err != nil {
+		return 0, fmt.Errorf("cannot read handshake error from the server: %s", err)
+	}
+	return 0, fmt.Errorf("the server rejected the connection: %s", msg)
+}
+
+// needsHandshake returns true if the client must perform the handshake.
+func (c *Client) needsHandshake() bool {
+	return c.AuthKey != nil || c.ReverseHandler != nil || c.Name != "" || c.Version != ""
+}
+
+func (c *Client) handshakeFlags() byte {
+	var flags byte
+	if c.ReverseHandler != nil {
+		flags |= handshakeFlagBidi
+		if c.TLSConfig != nil {
+			flags |= handshakeFlagTLS
+		}
+	}
+	return flags
+}
+
+// sniffHandshake reads the beginning of conn in order to determine
+// whether the client performs the handshake.
+//
+// Both handshakeHeader and fastrpc header start with sniffHeader,
+// while only handshakeHeader continues with '-'. The returned conn
+// replays the read bytes.
+func sniffHandshake(conn net.Conn) (net.Conn, bool, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, false, fmt.Errorf("cannot set handshake deadline: %s", err)
+	}
+	buf := make([]byte, len(sniffHeader)+1)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, false, fmt.Errorf("cannot read connection header: %s", err)
+	}
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, false, fmt.Errorf("cannot reset handshake deadline: %s", err)
+	}
+	pc := &peekedConn{
+		Conn: conn,
+		buf:  buf,
+	}
+	return pc, string(buf) == handshakeHeader[:len(buf)], nil
+}
+
+// peekedConn returns buf contents before reading from Conn.
+type peekedConn struct {
+	net.Conn
+	buf []byte
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	if len(c.buf) == 0 {
+		return c.Conn.Read(p)
+	}
+	n := copy(p, c.buf)
+	c.buf = c.buf[n:]
+	return n, nil
+}
+
+// handshakeServer performs the server side of the handshake.
+//
+// It returns information about the client and flags sent by the client.
+func handshakeServer(conn net.Conn, keys []AuthKey, acceptTLS bool) (*ConnInfo, byte, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return nil, 0, fmt.Errorf("cannot set handshake deadline: %s", err)
+	}
+
+	buf := make([]byte, len(handshakeHeader)+2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return nil, 0, fmt.Errorf("cannot read handshake header: %s", err)
+	}
+	if string(buf[:len(handshakeHeader)]) != handshakeHeader {
+		return nil, 0, fmt.Errorf("unexpected handshake header: %q. Expecting %q", buf[:len(handshakeHeader)], handshakeHeader)
+	}
+	if v := buf[len(handshakeHeader)]; v != handshakeVersion {
+		err := fmt.Errorf("unsupported handshake version: %d. Expecting %d", v, handshakeVersion)
+		return nil, 0, writeHandshakeError(conn, err)
+	}
+	flags := buf[len(handshakeHeader)+1]
+	if flags&handshakeFlagTLS != 0 && !acceptTLS {
+		return nil, 0, writeHandshakeError(conn, errTLSUnsupported)
+	}
+	keyID, err := readHandshakeString(conn)
+	if err != nil {
+		return nil, 0, fmt.Errorf("cannot read key id: %s", err)
+	}
+	var info ConnInfo
+	if info.ClientName, err = readHandshakeString(conn); err != nil {
+		return nil, 0, fmt.Errorf("cannot read client name: %s", err)
+	}
+	if info.ClientVersion, err = readHandshakeString(conn); err != nil {
+		return nil, 0, fmt.Errorf("cannot read client version: %s", err)
+	}
+	var clientNonce [nonceSize]byte
+	if _, err := io.ReadFull(conn, clientNonce[:]); err != nil {
+		return nil, 0, fmt.Errorf("cannot read client nonce: %s", err)
+	}
+
+	if len(keys) == 0 {
+		if _, err := conn.Write([]byte{handshakeOK}); err != nil {
+			return nil, 0, fmt.Errorf("cannot send handshake response: %s", err)
+		}
+		return &info, flags, conn.SetDeadline(time.Time{})
+	}
+
+	if len(keyID) == 0 {
+		return nil, 0, writeHandshakeError(conn, errAuthMissing)
+	}
+	var key *AuthKey
+	for i := range keys {
+		if keys[i].ID == keyID {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, 0, writeHandshakeError(conn, fmt.Errorf("unknown key id %q", keyID))
+	}
+
+	var serverNonce [nonceSize]byte
+	if _, err := rand.Read(serverNonce[:]); err != nil {
+		return nil, 0, fmt.Errorf("cannot generate nonce: %s", err)
+	}
+	buf = append(buf[:0], handshakeChallenge)
+	buf = append(buf, serverNonce[:]...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, 0, fmt.Errorf("cannot send auth challenge: %s", err)
+	}
+
+	var clientMAC [macSize]byte
+	if _, err := io.ReadFull(conn, clientMAC[:]); err != nil {
+		return nil, 0, fmt.Errorf("cannot read auth response for key id %q: %s", keyID, err)
+	}
+	expectedMAC := handshakeMAC("client", key, clientNonce[:], serverNonce[:])
+	if !hmac.Equal(clientMAC[:], expectedMAC) {
+		return nil, 0, writeHandshakeError(conn, fmt.Errorf("invalid secret for key id %q", keyID))
+	}
+
+	buf = append(buf[:0], handshakeAuthOK)
+	buf = append(buf, handshakeMAC("server", key, clientNonce[:], serverNonce[:])...)
+	if _, err := conn.Write(buf); err != nil {
+		return nil, 0, fmt.Errorf("cannot send auth response: %s", err)
+	}
+	info.AuthKeyID = keyID
+	return &info, flags, conn.SetDeadline(time.Time{})
+}
+
+// writeHandshakeError sends err to the client and returns it.
+func writeHandshakeError(conn net.Conn, err error) error {
+	buf := []byte{handshakeError}
+	buf = appendHandshakeString(buf, err.Error())
+	conn.Write(buf)
+	return err
+}
+
+func handshakeMAC(label string, key *AuthKey, clientNonce, serverNonce []byte) []byte {
+	h := hmac.New(sha256.New, key.Secret)
+	h.Write([]byte(label))
+	h.Write([]byte(key.ID))
+	h.Write(clientNonce)
+	h.Write(serverNonce)
+	return h.Sum(nil)
+}
+
+func appendHandshakeString(dst []byte, s string) []byte {
+	if len(s) > 255 {
+		s = s[:255]
+	}
+	dst = append(dst, byte(len(s)))
+	return append(dst, s...)
+}
+
+func readHandshakeString(r io.Reader) (string, error) {
+	var b [256]byte
+	if _, err := io.ReadFull(r, b[:1]); err != nil {
+		return "", err
+	}
+	n := int(b[0])
+	if _, err := io.ReadFull(r, b[1:n+1]); err != nil {
+		return "", err
+	}
+	return string(b[1 : n+1]), nil
+}
+
+// handshakeListener performs the server side of the handshake
+// on accepted connections.
+//
+// Handshakes are performed in background goroutines, so slow clients
+// cannot block accepting new connections.
+type handshakeListener struct {
+	net.Listener
+	s *Server
+
+	connCh chan net.Conn
+	errCh  chan error
+	doneCh chan struct{}
+}
+
+func newHandshakeListener(ln net.Listener, s *Server) *handshakeListener {
+	hln := &handshakeListener{
+		Listener: ln,
+		s:        s,
+		connCh:   make(chan net.Conn),
+		errCh:    make(chan error),
+		doneCh:   make(chan struct{}),
+	}
+	go hln.acceptLoop()
+	return hln
+}
+
+func (ln *handshakeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connCh:
+		return conn, nil
+	case err := <-ln.errCh:
+		return nil, err
+	}
+}
+
+func (ln *handshakeListener) acceptLoop() {
+	defer close(ln.doneCh)
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			ln.errCh <- err
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go ln.handshake(conn)
+	}
+}
+
+func (ln *handshakeListener) handshake(rawConn net.Conn) {
+	conn, ok, err := sniffHandshake(rawConn)
+	keys := ln.s.authKeys()
+	var info *ConnInfo
+	var flags byte
+	switch {
+	case err != nil:
+		conn = rawConn
+	case ok:
+		info, flags, err = handshakeServer(conn, keys, ln.s.s.TLSConfig != nil)
+	case len(keys) > 0:
+		// The client skipped the handshake, so it cannot be notified
+		// about the error. Just close the connection.
+		err = errAuthMissing
+	default:
+		info = &ConnInfo{}
+	}
+	if err != nil {
+		atomic.AddUint64(&ln.s.stats.handshakeErrors, 1)
+		ln.s.logger().Printf("handshake error with %s<->%s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+		conn.Close()
+		return
+	}
+	sc := newServerConn(conn, info, ln.s)
+	var c net.Conn = sc
+	if flags&handshakeFlagBidi != 0 {
+		if c, err = ln.s.newBidiConn(sc, flags); err != nil {
+			ln.s.logger().Printf("cannot establish bidirectional connection with %s<->%s: %s", conn.RemoteAddr(), conn.LocalAddr(), err)
+			sc.Close()
+			return
+		}
+	}
+	select {
+	case ln.connCh <- c:
+	case <-ln.doneCh:
+		c.Close()
+	}
+}
@@ -0,0 +1,83 @@
+package httpteleport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// ServerLoad is the server load sent to clients if Server.SendLoad is set.
+//
+// ServerLoad may be obtained via Client.ServerLoad.
+type ServerLoad struct {
+	// Running is the number of running Server.Handler calls.
+	Running int
+
+	// Queued is the number of requests waiting for free Server.Handler
+	// slot due to Server.Concurrency limit.
+	//
+	// See Server.MaxQueueSize for details.
+	Queued int
+
+	// Concurrency is the maximum number of concurrently running
+	// Server.Handler calls.
+	Concurrency int
+}
+
+// Utilization returns the share of busy Server.Handler slots including
+// queued requests.
+//
+// The returned value may exceed 1 if the server queues requests.
+func (l *ServerLoad) Utilization() float64 {
+	if l.Concurrency <= 0 {
+		return 0
+	}
+	return float64(l.Running+l.Queued) / float64(l.Concurrency)
+}
+
+// appendLoad appends the current server load to dst.
+func (s *Server) appendLoad(dst []byte) []byte {
+	dst = appendUvarint(dst, uint64(atomic.LoadInt32(&s.running)))
+	dst = appendUvarint(dst, uint64(atomic.LoadInt32(&s.queued)))
+	return appendUvarint(dst, uint64(s.concurrency()))
+}
+
+func appendUvarint(dst []byte, n uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	size := binary.PutUvarint(b[:], n)
+	return append(dst, b[:size]...)
+}
+
+// ServerLoad returns the server load received in the last response.
+//
+// This function may be used for load balancing purposes.
+//
+// Zero ServerLoad is returned if Server.SendLoad isn't set
+// or if no responses have been received yet. Set Client.PingInterval
+// in order to refresh the load on idle connections.
+func (c *Client) ServerLoad() ServerLoad {
+	return ServerLoad{
+		Running:     int(atomic.LoadUint32(&c.loadRunning)),
+		Queued:      int(atomic.LoadUint32(&c.loadQueued)),
+		Concurrency: int(atomic.LoadUint32(&c.loadConcurrency)),
+	}
+}
+
+func (c *Client) readServerLoad(br *bufio.Reader) error {
+	running, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	queued, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	concurrency, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	atomic.StoreUint32(&c.loadRunning, uint32(running))
+	atomic.StoreUint32(&c.loadQueued, uint32(queued))
+	atomic.StoreUint32(&c.loadConcurrency, uint32(concurrency))
+	return nil
+}
@@ -0,0 +1,221 @@
+// Package metrics exports httpteleport Client and Server statistics
+// in Prometheus text format.
+//
+// Usage:
+//
+//	var e metrics.Exporter
+//	e.AddClient(c)
+//	e.AddServer("in", s)
+//
+//	// fasthttp
+//	fasthttp.ListenAndServe(":8040", e.RequestHandler)
+//
+//	// net/http
+//	http.Handle("/metrics", &e)
+package metrics
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/httpteleport"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Exporter exports statistics for the registered clients and servers
+// in Prometheus text format.
+//
+// Client metrics are labeled with addr=Client.Addr, while server metrics
+// are labeled with server=name passed to AddServer.
+//
+// It is safe calling Exporter methods from concurrently running goroutines.
+type Exporter struct {
+	// Prefix is prepended to all the metric names.
+	//
+	// DefaultPrefix is used by default.
+	Prefix string
+
+	mu      sync.Mutex
+	clients []*httpteleport.Client
+	servers []*namedServer
+}
+
+// DefaultPrefix is the default prefix for metric names.
+const DefaultPrefix = "httpteleport_"
+
+type namedServer struct {
+	name string
+	s    *httpteleport.Server
+}
+
+// AddClient registers c for exporting its statistics.
+func (e *Exporter) AddClient(c *httpteleport.Client) {
+	e.mu.Lock()
+	e.clients = append(e.clients, c)
+	e.mu.Unlock()
+}
+
+// AddServer registers s for exporting its statistics under the given name.
+func (e *Exporter) AddServer(name string, s *httpteleport.Server) {
+	e.mu.Lock()
+	e.servers = append(e.servers, &namedServer{
+		name: name,
+		s:    s,
+	})
+	e.mu.Unlock()
+}
+
+// RequestHandler writes metrics to ctx.
+//
+// It may be used as fasthttp.RequestHandler.
+func (e *Exporter) RequestHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType(contentType)
+	e.WritePrometheus(ctx)
+}
+
+// ServeHTTP writes metrics to w.
+//
+// It implements http.Handler.
+func (e *Exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+	e.WritePrometheus(w)
+}
+
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes metrics for all the registered clients
+// and servers to w in Prometheus text format.
+func (e *Exporter) WritePrometheus(w io.Writer) {
+	e.mu.Lock()
+	clients := append([]*httpteleport.Client{}, e.clients...)
+	servers := append([]*namedServer{}, e.servers...)
+	e.mu.Unlock()
+
+	prefix := e.Prefix
+	if len(prefix) == 0 {
+		prefix = DefaultPrefix
+	}
+
+	if len(clients) > 0 {
+		sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+		ss := make([]*labeledStats, len(clients))
+		for i, c := range clients {
+			cs := c.Stats()
+			ss[i] = &labeledStats{
+				label: fmt.Sprintf("addr=%q", c.Addr),
+				stats: &cs,
+			}
+		}
+		writeMetrics(w, prefix+"client_", ss, clientMetrics)
+	}
+
+	if len(servers) > 0 {
+		sort.Slice(servers, func(i, j int) bool { return servers[i].name < servers[j].name })
+		ss := make([]*labeledStats, len(servers))
+		for i, ns := range servers {
+			st := ns.s.Stats()
+			ss[i] = &labeledStats{
+				label: fmt.Sprintf("server=%q", ns.name),
+				stats: &st,
+			}
+		}
+		writeMetrics(w, prefix+"server_", ss, serverMetrics)
+	}
+}
+
+type labeledStats struct {
+	label string
+
+	// stats is either *httpteleport.ClientStats or *httpteleport.ServerStats.
+	stats interface{}
+}
+
+type metricType int
+
+const (
+	counter = metricType(iota)
+	gauge
+	histogram
+)
+
+func (mt metricType) String() string {
+	switch mt {
+	case counter:
+		return "counter"
+	case gauge:
+		return "gauge"
+	case histogram:
+		return "histogram"
+	default:
+		panic(fmt.Sprintf("BUG: unknown metric type %d", mt))
+	}
+}
+
+type metric struct {
+	name string
+	typ  metricType
+	help string
+
+	// extraLabel is appended to the stats label if set.
+	extraLabel string
+
+	// value returns the metric value for counters and gauges.
+	value func(stats interface{}) float64
+
+	// hist returns the histogram for histogram metrics.
+	hist func(stats interface{}) *httpteleport.Histogram
+}
+
+// writeMetrics writes metrics for ss to w.
+//
+// Samples for the same metric are grouped under a single TYPE line
+// as required by Prometheus text format.
+func writeMetrics(w io.Writer, prefix string, ss []*labeledStats, metrics []*metric) {
+	lastName := ""
+	for _, m := range metrics {
+		name := prefix + m.name
+		if name != lastName {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, m.help)
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, m.typ)
+			lastName = name
+		}
+		for _, s := range ss {
+			label := s.label
+			if len(m.extraLabel) > 0 {
+				label += "," + m.extraLabel
+			}
+			if m.typ == histogram {
+				WriteHistogram(w, name, label, m.hist(s.stats))
+				continue
+			}
+			fmt.Fprintf(w, "%s{%s} %s\n", name, label, formatFloat(m.value(s.stats)))
+		}
+	}
+}
+
+// WriteHistogram writes samples for h with the given name and labels
+// in Prometheus text format to w.
+//
+// labels may be empty. Otherwise they must look like `foo="bar",baz="aaa"`.
+// Durations are written in seconds. The caller is responsible
+// for writing TYPE line for the metric.
+func WriteHistogram(w io.Writer, name, labels string, h *httpteleport.Histogram) {
+	bucketLabels := ""
+	if len(labels) > 0 {
+		bucketLabels = labels + ","
+		labels = "{" + labels + "}"
+	}
+	for i, b := range httpteleport.LatencyBuckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=%q} %d\n", name, bucketLabels, formatFloat(b.Seconds()), h.Counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, bucketLabels, h.Count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.Sum.Seconds()))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.Count)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
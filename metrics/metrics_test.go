@@ -0,0 +1,160 @@
+package metrics
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"github.com/valyala/httpteleport"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExporter(t *testing.T) {
+	ln := fasthttputil.NewInmemoryListener()
+	s := &httpteleport.Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("foobar"))
+		},
+	}
+	serverResultCh := make(chan error, 1)
+	go func() {
+		serverResultCh <- s.Serve(ln)
+	}()
+	c := &httpteleport.Client{
+		Addr: "foobar",
+		Dial: func(addr string) (net.Conn, error) {
+			return ln.Dial()
+		},
+	}
+
+	for i := 0; i < 10; i++ {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/aaa")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+
+	var e Exporter
+	e.AddClient(c)
+	e.AddServer("in", s)
+
+	var bb bytes.Buffer
+	e.WritePrometheus(&bb)
+	expectedLines := []string{
+		"# TYPE httpteleport_client_requests_total counter",
+		`httpteleport_client_requests_total{addr="foobar"} 10`,
+		`httpteleport_client_errors_total{addr="foobar",kind="timeout"} 0`,
+		"# TYPE httpteleport_client_pending_requests gauge",
+		`httpteleport_client_pending_requests{addr="foobar"} 0`,
+		"# TYPE httpteleport_client_request_duration_seconds histogram",
+		`httpteleport_client_request_duration_seconds_bucket{addr="foobar",le="10"} 10`,
+		`httpteleport_client_request_duration_seconds_bucket{addr="foobar",le="+Inf"} 10`,
+		`httpteleport_client_request_duration_seconds_count{addr="foobar"} 10`,
+		`httpteleport_server_requests_total{server="in"} 10`,
+		`httpteleport_server_responses_total{server="in"} 10`,
+		"# TYPE httpteleport_server_open_conns gauge",
+		`httpteleport_server_open_conns{server="in"} 1`,
+		`httpteleport_server_request_duration_seconds_count{server="in"} 10`,
+	}
+	testExporterLines(t, bb.String(), expectedLines)
+
+	// Every metric must be declared only once.
+	types := make(map[string]bool)
+	for _, line := range strings.Split(bb.String(), "\n") {
+		if !strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		if types[line] {
+			t.Fatalf("duplicate metric declaration %q", line)
+		}
+		types[line] = true
+	}
+
+	// net/http handler
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", w.Code, http.StatusOK)
+	}
+	testExporterLines(t, w.Body.String(), expectedLines)
+
+	// fasthttp handler
+	var ctx fasthttp.RequestCtx
+	e.RequestHandler(&ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("unexpected status code: %d. Expecting %d", ctx.Response.StatusCode(), fasthttp.StatusOK)
+	}
+	testExporterLines(t, string(ctx.Response.Body()), expectedLines)
+
+	ln.Close()
+	select {
+	case err := <-serverResultCh:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestExporterPrefix(t *testing.T) {
+	e := &Exporter{
+		Prefix: "foo_",
+	}
+	e.AddServer("bar", &httpteleport.Server{})
+
+	var bb bytes.Buffer
+	e.WritePrometheus(&bb)
+	testExporterLines(t, bb.String(), []string{
+		`foo_server_requests_total{server="bar"} 0`,
+		`foo_server_request_duration_seconds_bucket{server="bar",le="0.001"} 0`,
+	})
+	if strings.Contains(bb.String(), "client") {
+		t.Fatalf("unexpected client metrics without clients:\n%s", bb.String())
+	}
+}
+
+func testExporterLines(t *testing.T, s string, expectedLines []string) {
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(s, "\n") {
+		lines[line] = true
+	}
+	for _, line := range expectedLines {
+		if !lines[line] {
+			t.Fatalf("missing line %q in\n%s", line, s)
+		}
+	}
+}
+
+func TestWriteHistogram(t *testing.T) {
+	var lh httpteleport.LatencyHistogram
+	lh.Add(time.Millisecond)
+	lh.Add(3 * time.Second)
+	h := lh.Histogram()
+
+	var bb bytes.Buffer
+	WriteHistogram(&bb, "foo", "", &h)
+	testExporterLines(t, bb.String(), []string{
+		`foo_bucket{le="0.001"} 1`,
+		`foo_bucket{le="2"} 1`,
+		`foo_bucket{le="5"} 2`,
+		`foo_bucket{le="+Inf"} 2`,
+		`foo_sum 3.001`,
+		`foo_count 2`,
+	})
+
+	bb.Reset()
+	WriteHistogram(&bb, "foo", `addr="bar"`, &h)
+	testExporterLines(t, bb.String(), []string{
+		`foo_bucket{addr="bar",le="0.001"} 1`,
+		`foo_bucket{addr="bar",le="+Inf"} 2`,
+		`foo_sum{addr="bar"} 3.001`,
+		`foo_count{addr="bar"} 2`,
+	})
+}
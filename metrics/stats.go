@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"github.com/valyala/httpteleport"
+)
+
+var clientMetrics = []*metric{
+	clientCounter("requests_total", "The number of requests sent by the client.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.Requests }),
+	clientCounter("responses_total", "The number of successfully received responses.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.Responses }),
+	clientCounter("errors_total", "The number of failed requests by error kind.", `kind="timeout"`,
+		func(cs *httpteleport.ClientStats) uint64 { return cs.Timeouts }),
+	clientCounter("errors_total", "", `kind="pending_requests_overflow"`,
+		func(cs *httpteleport.ClientStats) uint64 { return cs.PendingRequestsOverflows }),
+	clientCounter("errors_total", "", `kind="response_too_large"`,
+		func(cs *httpteleport.ClientStats) uint64 { return cs.ResponsesTooLarge }),
+	clientCounter("errors_total", "", `kind="other"`,
+		func(cs *httpteleport.ClientStats) uint64 { return cs.OtherErrors }),
+	clientCounter("bytes_written_total", "The number of bytes written to connections after compression.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.BytesWritten }),
+	clientCounter("bytes_read_total", "The number of bytes read from connections before decompression.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.BytesRead }),
+	clientCounter("uncompressed_bytes_written_total", "The number of bytes in sent requests before compression.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.UncompressedBytesWritten }),
+	clientCounter("uncompressed_bytes_read_total", "The number of bytes in received responses after decompression.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.UncompressedBytesRead }),
+	clientCounter("batches_flushed_total", "The number of flushed batches with requests.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.BatchesFlushed }),
+	clientCounter("batched_requests_total", "The number of requests in flushed batches.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.BatchedRequests }),
+	clientCounter("dials_total", "The number of attempts to establish connection to the server.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.Dials }),
+	clientCounter("dial_errors_total", "The number of failed attempts to establish connection to the server.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.DialErrors }),
+	clientCounter("reconnects_total", "The number of connections established after the first connection.", "",
+		func(cs *httpteleport.ClientStats) uint64 { return cs.Reconnects }),
+	{
+		name: "pending_requests",
+		typ:  gauge,
+		help: "The number of pending requests.",
+		value: func(stats interface{}) float64 {
+			return float64(stats.(*httpteleport.ClientStats).PendingRequests)
+		},
+	},
+	{
+		name: "rtt_seconds",
+		typ:  gauge,
+		help: "The round-trip time measured by the last ping.",
+		value: func(stats interface{}) float64 {
+			return stats.(*httpteleport.ClientStats).RTT.Seconds()
+		},
+	},
+	{
+		name: "request_duration_seconds",
+		typ:  histogram,
+		help: "Request durations including failed requests.",
+		hist: func(stats interface{}) *httpteleport.Histogram {
+			return &stats.(*httpteleport.ClientStats).Latency
+		},
+	},
+}
+
+var serverMetrics = []*metric{
+	serverCounter("conns_total", "The number of accepted connections.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.Conns }),
+	serverCounter("handshake_errors_total", "The number of connections closed due to handshake errors.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.HandshakeErrors }),
+	serverCounter("requests_total", "The number of read requests.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.Requests }),
+	serverCounter("responses_total", "The number of written responses.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.Responses }),
+	serverCounter("errors_total", "The number of rejected or timed out requests by error kind.", `kind="concurrency_limit"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.ConcurrencyLimitErrors }),
+	serverCounter("errors_total", "", `kind="queue_timeout"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.QueueTimeouts }),
+	serverCounter("errors_total", "", `kind="request_too_large"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.RequestsTooLarge }),
+	serverCounter("errors_total", "", `kind="handler_timeout"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.HandlerTimeouts }),
+	serverCounter("errors_total", "", `kind="deferred_timeout"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.DeferredTimeouts }),
+	serverCounter("errors_total", "", `kind="panic"`,
+		func(ss *httpteleport.ServerStats) uint64 { return ss.Panics }),
+	serverCounter("bytes_written_total", "The number of bytes written to connections after compression.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.BytesWritten }),
+	serverCounter("bytes_read_total", "The number of bytes read from connections before decompression.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.BytesRead }),
+	serverCounter("uncompressed_bytes_written_total", "The number of bytes in sent responses before compression.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.UncompressedBytesWritten }),
+	serverCounter("uncompressed_bytes_read_total", "The number of bytes in received requests after decompression.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.UncompressedBytesRead }),
+	serverCounter("batches_flushed_total", "The number of flushed batches with responses.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.BatchesFlushed }),
+	serverCounter("batched_responses_total", "The number of http responses in flushed batches.", "",
+		func(ss *httpteleport.ServerStats) uint64 { return ss.BatchedResponses }),
+	serverGauge("open_conns", "The number of open connections.",
+		func(ss *httpteleport.ServerStats) int64 { return int64(ss.OpenConns) }),
+	serverGauge("running_requests", "The number of running Handler calls.",
+		func(ss *httpteleport.ServerStats) int64 { return int64(ss.Running) }),
+	serverGauge("queued_requests", "The number of requests waiting for free Handler slot.",
+		func(ss *httpteleport.ServerStats) int64 { return int64(ss.Queued) }),
+	serverGauge("buffered_bytes", "The number of buffered bytes.",
+		func(ss *httpteleport.ServerStats) int64 { return ss.BufferedBytes }),
+	{
+		name: "request_duration_seconds",
+		typ:  histogram,
+		help: "Durations since reading the request till writing the response.",
+		hist: func(stats interface{}) *httpteleport.Histogram {
+			return &stats.(*httpteleport.ServerStats).Latency
+		},
+	},
+}
+
+func clientCounter(name, help, extraLabel string, f func(cs *httpteleport.ClientStats) uint64) *metric {
+	return &metric{
+		name:       name,
+		typ:        counter,
+		help:       help,
+		extraLabel: extraLabel,
+		value: func(stats interface{}) float64 {
+			return float64(f(stats.(*httpteleport.ClientStats)))
+		},
+	}
+}
+
+func serverCounter(name, help, extraLabel string, f func(ss *httpteleport.ServerStats) uint64) *metric {
+	return &metric{
+		name:       name,
+		typ:        counter,
+		help:       help,
+		extraLabel: extraLabel,
+		value: func(stats interface{}) float64 {
+			return float64(f(stats.(*httpteleport.ServerStats)))
+		},
+	}
+}
+
+func serverGauge(name, help string, f func(ss *httpteleport.ServerStats) int64) *metric {
+	return &metric{
+		name: name,
+		typ:  gauge,
+		help: help,
+		value: func(stats interface{}) float64 {
+			return float64(f(stats.(*httpteleport.ServerStats)))
+		},
+	}
+}
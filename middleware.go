@@ -0,0 +1,40 @@
+package httpteleport
+
+import (
+	"github.com/valyala/fasthttp"
+	"time"
+)
+
+// Doer performs http requests.
+//
+// Client, ResolvingClient and fasthttp clients implement Doer.
+type Doer interface {
+	// DoDeadline performs the given request and waits for the response
+	// until the given deadline.
+	DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error
+}
+
+// DoerFunc is an adapter for using ordinary functions as Doer.
+type DoerFunc func(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error
+
+// DoDeadline calls f(req, resp, deadline).
+func (f DoerFunc) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	return f(req, resp, deadline)
+}
+
+// Middleware returns Doer wrapping next.
+//
+// Middleware may modify requests and responses, measure timings,
+// log failures, retry requests, etc.
+//
+// See Client.Middlewares for details.
+type Middleware func(next Doer) Doer
+
+// applyMiddlewares wraps d into middlewares, so middlewares[0]
+// is called first.
+func applyMiddlewares(d Doer, middlewares []Middleware) Doer {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		d = middlewares[i](d)
+	}
+	return d
+}
@@ -0,0 +1,147 @@
+package httpteleport
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientMiddlewares(t *testing.T) {
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", ctx.Request.Header.Peek("X-Middlewares"))
+	})
+	var calls []string
+	newMiddleware := func(name string) Middleware {
+		return func(next Doer) Doer {
+			return DoerFunc(func(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+				calls = append(calls, name)
+				v := req.Header.Peek("X-Middlewares")
+				req.Header.Set("X-Middlewares", string(v)+name)
+				err := next.DoDeadline(req, resp, deadline)
+				calls = append(calls, name+" done")
+				return err
+			})
+		}
+	}
+	c.Middlewares = []Middleware{newMiddleware("a"), newMiddleware("b")}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "ab" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "ab")
+	}
+	expectedCalls := []string{"a", "b", "b done", "a done"}
+	if !reflect.DeepEqual(calls, expectedCalls) {
+		t.Fatalf("unexpected calls: %q. Expecting %q", calls, expectedCalls)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientLifecycleCallbacks(t *testing.T) {
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+	var mu sync.Mutex
+	var events []string
+	addEvent := func(name string, req *fasthttp.Request) {
+		mu.Lock()
+		events = append(events, fmt.Sprintf("%s %s", name, req.URI().Path()))
+		mu.Unlock()
+	}
+	c.OnRequestQueued = func(req *fasthttp.Request) {
+		addEvent("queued", req)
+	}
+	c.OnRequestSent = func(req *fasthttp.Request) {
+		addEvent("sent", req)
+	}
+	c.OnResponseFirstByte = func(req *fasthttp.Request) {
+		addEvent("firstByte", req)
+	}
+	c.OnRequestDone = func(req *fasthttp.Request, resp *fasthttp.Response, err error) {
+		addEvent(fmt.Sprintf("done %q %v", resp.Body(), err), req)
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	expectedEvents := []string{
+		"queued /aaa",
+		"sent /aaa",
+		"firstByte /aaa",
+		`done "done" <nil> /aaa`,
+	}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Fatalf("unexpected events: %q. Expecting %q", events, expectedEvents)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestClientResponseFirstByteDeferred(t *testing.T) {
+	completedCh := make(chan struct{})
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			dr := DeferResponse(ctx, time.Second)
+			if dr == nil {
+				ctx.Error("cannot defer response", fasthttp.StatusInternalServerError)
+				return
+			}
+			go func() {
+				time.Sleep(10 * time.Millisecond)
+				ctx.Success("text/plain", []byte("deferred"))
+				close(completedCh)
+				dr.Done()
+			}()
+		},
+	}
+	serverStop, c := newTestServerClientExt(s)
+	var calls, earlyCalls uint32
+	c.OnResponseFirstByte = func(req *fasthttp.Request) {
+		atomic.AddUint32(&calls, 1)
+		select {
+		case <-completedCh:
+		default:
+			// The deferred response notification mustn't be reported.
+			atomic.AddUint32(&earlyCalls, 1)
+		}
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(resp.Body()) != "deferred" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "deferred")
+	}
+	if n := atomic.LoadUint32(&calls); n != 1 {
+		t.Fatalf("unexpected number of OnResponseFirstByte calls: %d. Expecting 1", n)
+	}
+	if n := atomic.LoadUint32(&earlyCalls); n != 0 {
+		t.Fatalf("OnResponseFirstByte has been called %d times before the deferred response is ready", n)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
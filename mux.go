@@ -0,0 +1,330 @@
+package httpteleport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// muxConn multiplexes two streams over a single connection.
+//
+// It is used by bidirectional connections, where the forward stream
+// carries requests from Client to Server, while the reverse stream
+// carries requests from Server to Client.
+//
+// Each frame looks like:
+//
+//	frameType, streamID, length (uint32, big endian), payload
+//
+// Each stream has its own flow control window, so a slow reader on one
+// stream cannot block the other stream.
+type muxConn struct {
+	conn net.Conn
+
+	// wmu serializes frame writes to conn.
+	wmu  sync.Mutex
+	wbuf []byte
+
+	streams [2]*muxStream
+
+	closeOnce sync.Once
+	closedCh  chan struct{}
+	err       error
+}
+
+const (
+	muxStreamForward = 0
+	muxStreamReverse = 1
+)
+
+const (
+	muxFrameData = byte(iota)
+	muxFrameWindow
+)
+
+const (
+	muxHeaderSize   = 6
+	muxMaxFrameSize = 32 * 1024
+	muxWindowSize   = 256 * 1024
+)
+
+func newMuxConn(conn net.Conn) *muxConn {
+	m := &muxConn{
+		conn:     conn,
+		closedCh: make(chan struct{}),
+	}
+	for i := range m.streams {
+		m.streams[i] = &muxStream{
+			m:          m,
+			id:         byte(i),
+			sendWindow: muxWindowSize,
+			readCh:     make(chan struct{}, 1),
+			writeCh:    make(chan struct{}, 1),
+		}
+	}
+	go m.readLoop()
+	return m
+}
+
+func (m *muxConn) stream(id byte) *muxStream {
+	return m.streams[id]
+}
+
+func (m *muxConn) close(err error) {
+	m.closeOnce.Do(func() {
+		m.err = err
+		close(m.closedCh)
+		m.conn.Close()
+	})
+}
+
+func (m *muxConn) readLoop() {
+	br := bufio.NewReaderSize(m.conn, muxMaxFrameSize+muxHeaderSize)
+	var header [muxHeaderSize]byte
+	payload := make([]byte, muxMaxFrameSize)
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			m.close(err)
+			return
+		}
+		frameType := header[0]
+		id := header[1]
+		n := binary.BigEndian.Uint32(header[2:])
+		if int(id) >= len(m.streams) {
+			m.close(fmt.Errorf("unexpected stream id: %d", id))
+			return
+		}
+		s := m.streams[id]
+		switch frameType {
+		case muxFrameData:
+			if n > muxMaxFrameSize {
+				m.close(fmt.Errorf("too big frame size: %d. It cannot exceed %d", n, muxMaxFrameSize))
+				return
+			}
+			if _, err := io.ReadFull(br, payload[:n]); err != nil {
+				m.close(err)
+				return
+			}
+			if err := s.received(payload[:n]); err != nil {
+				m.close(err)
+				return
+			}
+		case muxFrameWindow:
+			s.addSendWindow(int(n))
+		default:
+			m.close(fmt.Errorf("unexpected frame type: %d", frameType))
+			return
+		}
+	}
+}
+
+func (m *muxConn) writeFrame(frameType, id byte, n int, payload []byte, deadline time.Time) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+
+	buf := append(m.wbuf[:0], frameType, id, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(buf[2:], uint32(n))
+	buf = append(buf, payload...)
+	m.wbuf = buf
+
+	if err := m.conn.SetWriteDeadline(deadline); err != nil {
+		m.close(err)
+		return err
+	}
+	if _, err := m.conn.Write(buf); err != nil {
+		// The frame may be partially written, so the connection
+		// cannot be used anymore.
+		m.close(err)
+		return err
+	}
+	return nil
+}
+
+// muxStream is a virtual connection multiplexed over muxConn.
+//
+// Closing the stream closes the underlying connection with all
+// the streams.
+type muxStream struct {
+	m  *muxConn
+	id byte
+
+	mu sync.Mutex
+
+	// rbuf contains received data, which isn't read yet.
+	rbuf bytes.Buffer
+
+	// consumed is the number of bytes read since the last window update.
+	consumed int
+
+	sendWindow int
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	// readCh and writeCh wake up Read and Write waiting
+	// for data and send window.
+	readCh  chan struct{}
+	writeCh chan struct{}
+}
+
+func (s *muxStream) received(data []byte) error {
+	s.mu.Lock()
+	if s.rbuf.Len()+len(data) > muxWindowSize {
+		s.mu.Unlock()
+		return fmt.Errorf("flow control window exceeded for stream %d", s.id)
+	}
+	s.rbuf.Write(data)
+	s.mu.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+func (s *muxStream) addSendWindow(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+	notify(s.writeCh)
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if s.rbuf.Len() > 0 {
+			n, _ := s.rbuf.Read(p)
+			s.consumed += n
+			update := 0
+			if s.consumed >= muxWindowSize/4 {
+				update = s.consumed
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+			if update > 0 {
+				s.m.writeFrame(muxFrameWindow, s.id, update, nil, time.Time{})
+			}
+			return n, nil
+		}
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		if err := s.wait(s.readCh, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		s.mu.Lock()
+		n := s.sendWindow
+		if n > len(p) {
+			n = len(p)
+		}
+		if n > muxMaxFrameSize {
+			n = muxMaxFrameSize
+		}
+		s.sendWindow -= n
+		deadline := s.writeDeadline
+		s.mu.Unlock()
+
+		if n == 0 {
+			if err := s.wait(s.writeCh, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if err := s.m.writeFrame(muxFrameData, s.id, n, p[:n], deadline); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait waits for notification on ch until the deadline.
+func (s *muxStream) wait(ch <-chan struct{}, deadline time.Time) error {
+	select {
+	case <-s.m.closedCh:
+		return s.closedError()
+	default:
+	}
+	if deadline.IsZero() {
+		select {
+		case <-ch:
+			return nil
+		case <-s.m.closedCh:
+			return s.closedError()
+		}
+	}
+	timeout := -time.Since(deadline)
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	t := fasthttp.AcquireTimer(timeout)
+	defer fasthttp.ReleaseTimer(t)
+	select {
+	case <-ch:
+		return nil
+	case <-s.m.closedCh:
+		return s.closedError()
+	case <-t.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (s *muxStream) closedError() error {
+	if s.m.err == nil {
+		return io.EOF
+	}
+	return s.m.err
+}
+
+func (s *muxStream) Close() error {
+	s.m.close(io.EOF)
+	return nil
+}
+
+func (s *muxStream) LocalAddr() net.Addr {
+	return s.m.conn.LocalAddr()
+}
+
+func (s *muxStream) RemoteAddr() net.Addr {
+	return s.m.conn.RemoteAddr()
+}
+
+func (s *muxStream) SetDeadline(deadline time.Time) error {
+	s.SetReadDeadline(deadline)
+	return s.SetWriteDeadline(deadline)
+}
+
+func (s *muxStream) SetReadDeadline(deadline time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = deadline
+	s.mu.Unlock()
+	notify(s.readCh)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(deadline time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = deadline
+	s.mu.Unlock()
+	notify(s.writeCh)
+	return nil
+}
+
+// notify wakes up a goroutine waiting on ch.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,95 @@
+package httpteleport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMuxConnStreams(t *testing.T) {
+	c1, c2 := net.Pipe()
+	m1 := newMuxConn(c1)
+	m2 := newMuxConn(c2)
+	defer m1.close(nil)
+
+	// Send more data than the flow control window on both streams,
+	// while the forward stream is read only after the reverse stream.
+	data := bytes.Repeat([]byte("0123456789"), muxWindowSize/5)
+	resultCh := make(chan error, 2)
+	for _, id := range []byte{muxStreamForward, muxStreamReverse} {
+		go func(s *muxStream) {
+			_, err := s.Write(data)
+			resultCh <- err
+		}(m1.stream(id))
+	}
+
+	for _, id := range []byte{muxStreamReverse, muxStreamForward} {
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(m2.stream(id), buf); err != nil {
+			t.Fatalf("cannot read stream %d: %s", id, err)
+		}
+		if !bytes.Equal(buf, data) {
+			t.Fatalf("unexpected data for stream %d", id)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestMuxConnDeadline(t *testing.T) {
+	c1, c2 := net.Pipe()
+	m1 := newMuxConn(c1)
+	newMuxConn(c2)
+	defer m1.close(nil)
+
+	s := m1.stream(muxStreamForward)
+	s.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	var buf [1]byte
+	_, err := s.Read(buf[:])
+	ne, ok := err.(net.Error)
+	if !ok || !ne.Timeout() {
+		t.Fatalf("expecting timeout error; got %v", err)
+	}
+}
+
+func TestMuxConnClose(t *testing.T) {
+	c1, c2 := net.Pipe()
+	m1 := newMuxConn(c1)
+	m2 := newMuxConn(c2)
+
+	readCh := make(chan error, 1)
+	go func() {
+		var buf [1]byte
+		_, err := m2.stream(muxStreamReverse).Read(buf[:])
+		readCh <- err
+	}()
+
+	// Closing a stream must close all the streams on both sides.
+	m1.stream(muxStreamForward).Close()
+	select {
+	case err := <-readCh:
+		if err == nil {
+			t.Fatalf("expecting non-nil error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if _, err := m1.stream(muxStreamReverse).Write([]byte("foo")); err == nil {
+		t.Fatalf("expecting non-nil error when writing to closed stream")
+	}
+	select {
+	case <-m2.closedCh:
+	default:
+		t.Fatalf("the connection must be closed")
+	}
+}
@@ -0,0 +1,73 @@
+package httpteleport
+
+import (
+	"bufio"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// RTT returns round-trip time measured by the last ping to the server.
+//
+// This function may be used for load balancing purposes.
+//
+// 0 is returned if Client.PingInterval isn't set or if no pings
+// have been completed yet.
+func (c *Client) RTT() time.Duration {
+	return time.Duration(atomic.LoadUint64(&c.rttNanos))
+}
+
+// pinger sends pings over cc until it is closed.
+func (c *Client) pinger(cc *clientConn) {
+	timeout := c.PingTimeout
+	if timeout <= 0 {
+		timeout = c.PingInterval
+	}
+	t := time.NewTicker(c.PingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-cc.closedCh:
+			return
+		case <-t.C:
+		}
+		startTime := time.Now()
+		err := cc.t.c.DoDeadline(pingRequest{}, pingResponse{cc.t}, startTime.Add(timeout))
+		switch err {
+		case nil:
+			atomic.StoreUint64(&c.rttNanos, uint64(time.Since(startTime)))
+		case ErrTimeout:
+			if cc.lastRead().After(startTime) {
+				// The server reads the ping only after the requests
+				// sent before it. It may delay reading them due to
+				// backpressure such as Server.MaxBufferedBytes, while
+				// still sending responses, so the connection is alive.
+				continue
+			}
+			// The server is dead or the network is broken, so close
+			// the connection instead of waiting for request timeouts.
+			// The connection is re-established on the next request.
+			cc.closeWithError(errPingTimeout)
+			return
+		default:
+			// Pings may fail due to MaxPendingRequests limit
+			// on overloaded connections. Such connections are alive.
+		}
+	}
+}
+
+var errPingTimeout = errors.New("the server didn't respond to ping during Client.PingTimeout")
+
+type pingRequest struct{}
+
+func (pingRequest) WriteRequest(bw *bufio.Writer) error {
+	return bw.WriteByte(messagePing)
+}
+
+type pingResponse struct {
+	t *clientTransport
+}
+
+func (r pingResponse) ReadResponse(br *bufio.Reader) error {
+	return r.t.expectMessageType(br, messagePing)
+}
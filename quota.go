@@ -0,0 +1,145 @@
+package httpteleport
+
+import (
+	"net"
+	"sync"
+)
+
+// concurrencyQuotas limits the number of concurrently running handlers
+// per connection and per client.
+//
+// Requests exceeding quotas aren't rejected. Instead, reading requests
+// from the connection is paused until the quota becomes available.
+// This prevents a single client from occupying all the handler slots
+// limited by Server.Concurrency.
+type concurrencyQuotas struct {
+	maxPerConn   int
+	maxPerClient int
+
+	// concurrency is the number of handler slots fairly shared
+	// among busy connections. It is 0 if fair sharing is disabled.
+	concurrency int
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	// busyConns is the number of connections with running
+	// or waiting requests.
+	busyConns int
+
+	// clients contains the number of running handlers per client.
+	clients map[string]int
+}
+
+func newConcurrencyQuotas(s *Server) *concurrencyQuotas {
+	if s.MaxConcurrencyPerConn <= 0 && s.MaxConcurrencyPerClient <= 0 && !s.FairConcurrency {
+		return nil
+	}
+	q := &concurrencyQuotas{
+		maxPerConn:   s.MaxConcurrencyPerConn,
+		maxPerClient: s.MaxConcurrencyPerClient,
+		clients:      make(map[string]int),
+	}
+	if s.FairConcurrency {
+		q.concurrency = s.concurrency()
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// connQuota is the quota state for a single connection.
+//
+// It is protected by concurrencyQuotas.mu.
+type connQuota struct {
+	// clientID identifies the client the connection belongs to.
+	clientID string
+
+	running int
+	waiting int
+	closed  bool
+}
+
+// clientID returns the identity for the client with the given info.
+//
+// Authenticated clients are identified by their AuthKeyID, while other
+// clients are identified by their IP address.
+func clientID(conn net.Conn, info *ConnInfo) string {
+	if info.AuthKeyID != "" {
+		return "key:" + info.AuthKeyID
+	}
+	addr := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return "ip:" + addr
+}
+
+// acquire waits until the connection may run a new handler.
+//
+// false is returned if the connection has been closed while waiting.
+func (q *concurrencyQuotas) acquire(cq *connQuota) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if cq.running+cq.waiting == 0 {
+		q.busyConns++
+	}
+	cq.waiting++
+	for !cq.closed && !q.mayRun(cq) {
+		q.cond.Wait()
+	}
+	cq.waiting--
+	if cq.closed {
+		q.updateBusyConns(cq)
+		return false
+	}
+	cq.running++
+	q.clients[cq.clientID]++
+	return true
+}
+
+func (q *concurrencyQuotas) mayRun(cq *connQuota) bool {
+	if q.maxPerConn > 0 && cq.running >= q.maxPerConn {
+		return false
+	}
+	if q.maxPerClient > 0 && q.clients[cq.clientID] >= q.maxPerClient {
+		return false
+	}
+	if q.concurrency > 0 && cq.running > 0 {
+		// Reserve a share for a new connection, so its requests
+		// aren't rejected due to Server.Concurrency limit.
+		// Each busy connection may run at least one handler.
+		if cq.running >= q.concurrency/(q.busyConns+1) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *concurrencyQuotas) release(cq *connQuota) {
+	q.mu.Lock()
+	cq.running--
+	n := q.clients[cq.clientID] - 1
+	if n > 0 {
+		q.clients[cq.clientID] = n
+	} else {
+		delete(q.clients, cq.clientID)
+	}
+	q.updateBusyConns(cq)
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
+
+func (q *concurrencyQuotas) updateBusyConns(cq *connQuota) {
+	if cq.running+cq.waiting == 0 {
+		q.busyConns--
+	}
+}
+
+// closeConn wakes up requests waiting for quota on the closed connection.
+func (q *concurrencyQuotas) closeConn(cq *connQuota) {
+	q.mu.Lock()
+	cq.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,357 @@
+package httpteleport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ResolvingClient teleports http requests to all the addresses
+// the Addr hostname resolves to.
+//
+// It periodically re-resolves the hostname, establishes connections
+// to new addresses and gracefully drains connections to addresses,
+// which disappeared. This allows following services, which move
+// to other hosts, over long-lived connections.
+//
+// Each request is sent to the least loaded address.
+type ResolvingClient struct {
+	// Addr is the httpteleport Server address in the form host:port.
+	Addr string
+
+	// ResolveInterval is the interval for re-resolving Addr hostname.
+	//
+	// DefaultResolveInterval is used by default.
+	ResolveInterval time.Duration
+
+	// Resolve returns addresses for the given host.
+	//
+	// net.LookupHost is used by default.
+	Resolve func(host string) ([]string, error)
+
+	// NewClient returns Client for the given resolved address in the form
+	// ip:port. The returned Client.Addr must be set to addr.
+	//
+	// NewClient may be used for setting up Client options. Clients
+	// for addresses, which disappeared, are reused for new addresses,
+	// so the options mustn't depend on addr. TLS connections
+	// are verified against Addr hostname unless Client.TLSConfig.ServerName
+	// is set.
+	//
+	// Client with default options is used by default.
+	NewClient func(addr string) *Client
+
+	// Logger is used for logging resolve errors.
+	//
+	// Standard logger from log package is used by default.
+	Logger fasthttp.Logger
+
+	once    sync.Once
+	initErr error
+	host    string
+	port    string
+
+	// resolveMu serializes resolves.
+	resolveMu sync.Mutex
+	resolved  uint32
+
+	mu      sync.Mutex
+	clients []*Client
+	stopCh  chan struct{}
+	stopped bool
+
+	// idleClients contains clients for addresses, which disappeared.
+	// They are reused for new addresses.
+	idleClients []*Client
+
+	n uint32
+
+	resolveErrors uint64
+}
+
+// DefaultResolveInterval is the default interval for re-resolving
+// ResolvingClient.Addr.
+const DefaultResolveInterval = time.Minute
+
+var errResolvingClientStopped = errors.New("the ResolvingClient has been stopped")
+
+// DoTimeout teleports the given request to the least loaded address
+// ResolvingClient.Addr resolves to.
+//
+// ErrTimeout is returned if the server didn't return response during
+// the given timeout.
+func (rc *ResolvingClient) DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	return rc.DoDeadline(req, resp, deadline)
+}
+
+// DoDeadline teleports the given request to the least loaded address
+// ResolvingClient.Addr resolves to.
+//
+// ErrTimeout is returned if the server didn't return response until
+// the given deadline.
+func (rc *ResolvingClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	rc.once.Do(rc.init)
+	if rc.initErr != nil {
+		return rc.initErr
+	}
+	if err := rc.ensureResolved(); err != nil {
+		return err
+	}
+	for {
+		c, err := rc.client()
+		if err != nil {
+			return err
+		}
+		err = c.DoDeadline(req, resp, deadline)
+		if err != errClientStopped {
+			return err
+		}
+		// The address has been removed after the client is selected.
+		// Retry with the current addresses.
+	}
+}
+
+// PendingRequests returns the number of pending requests
+// to all the addresses at the moment.
+//
+// This function may be used either for informational purposes
+// or for load balancing purposes.
+func (rc *ResolvingClient) PendingRequests() int {
+	rc.mu.Lock()
+	n := 0
+	for _, c := range rc.clients {
+		n += c.PendingRequests()
+	}
+	rc.mu.Unlock()
+	return n
+}
+
+// Addrs returns the addresses requests are sent to at the moment.
+func (rc *ResolvingClient) Addrs() []string {
+	rc.mu.Lock()
+	addrs := make([]string, 0, len(rc.clients))
+	for _, c := range rc.clients {
+		addrs = append(addrs, c.Addr)
+	}
+	rc.mu.Unlock()
+	return addrs
+}
+
+// Stop stops re-resolving Addr hostname and closes connections
+// to all the addresses after outstanding requests are completed.
+//
+// New requests fail after Stop call.
+func (rc *ResolvingClient) Stop() {
+	rc.mu.Lock()
+	clients := rc.clients
+	rc.clients = nil
+	if !rc.stopped {
+		rc.stopped = true
+		if rc.stopCh != nil {
+			close(rc.stopCh)
+		}
+	}
+	rc.mu.Unlock()
+	for _, c := range clients {
+		c.stop()
+	}
+}
+
+// ResolveErrors returns the number of failed attempts to resolve
+// Addr hostname.
+//
+// Requests are sent to the previously resolved addresses on errors.
+// Requests fail until Addr hostname is resolved for the first time.
+func (rc *ResolvingClient) ResolveErrors() uint64 {
+	return atomic.LoadUint64(&rc.resolveErrors)
+}
+
+func (rc *ResolvingClient) init() {
+	host, port, err := net.SplitHostPort(rc.Addr)
+	if err != nil {
+		rc.initErr = fmt.Errorf("cannot parse ResolvingClient.Addr=%q: %s", rc.Addr, err)
+		return
+	}
+	rc.host = host
+	rc.port = port
+	rc.mu.Lock()
+	if !rc.stopped {
+		rc.stopCh = make(chan struct{})
+		go rc.resolver(rc.stopCh)
+	}
+	rc.mu.Unlock()
+}
+
+// ensureResolved resolves Addr hostname if it hasn't been resolved yet.
+//
+// The first resolve may fail due to temporary DNS errors, so it is retried
+// on each request until it succeeds.
+func (rc *ResolvingClient) ensureResolved() error {
+	if atomic.LoadUint32(&rc.resolved) != 0 {
+		return nil
+	}
+	rc.resolveMu.Lock()
+	defer rc.resolveMu.Unlock()
+	if atomic.LoadUint32(&rc.resolved) != 0 {
+		// The hostname has been resolved by concurrent goroutine.
+		return nil
+	}
+	if err := rc.resolve(); err != nil {
+		atomic.AddUint64(&rc.resolveErrors, 1)
+		return err
+	}
+	return nil
+}
+
+func (rc *ResolvingClient) resolver(stopCh <-chan struct{}) {
+	interval := rc.ResolveInterval
+	if interval <= 0 {
+		interval = DefaultResolveInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+		}
+		rc.resolveMu.Lock()
+		err := rc.resolve()
+		rc.resolveMu.Unlock()
+		if err != nil {
+			// Keep the current addresses on temporary resolving errors.
+			atomic.AddUint64(&rc.resolveErrors, 1)
+			rc.logger().Printf("%s; continue using the previously resolved addresses", err)
+		}
+	}
+}
+
+func (rc *ResolvingClient) logger() fasthttp.Logger {
+	if rc.Logger != nil {
+		return rc.Logger
+	}
+	return defaultLogger
+}
+
+// resolve updates clients according to addresses Addr hostname resolves to.
+//
+// rc.resolveMu must be held.
+func (rc *ResolvingClient) resolve() error {
+	resolve := rc.Resolve
+	if resolve == nil {
+		resolve = net.LookupHost
+	}
+	ips, err := resolve(rc.host)
+	if err != nil {
+		return fmt.Errorf("cannot resolve %q: %s", rc.host, err)
+	}
+	if len(ips) == 0 {
+		return fmt.Errorf("cannot resolve %q: no addresses found", rc.host)
+	}
+	atomic.StoreUint32(&rc.resolved, 1)
+	addrs := make(map[string]struct{}, len(ips))
+	for _, ip := range ips {
+		addrs[net.JoinHostPort(ip, rc.port)] = struct{}{}
+	}
+
+	rc.mu.Lock()
+	if rc.stopped {
+		rc.mu.Unlock()
+		return nil
+	}
+	var clients []*Client
+	for _, c := range rc.clients {
+		if _, ok := addrs[c.Addr]; ok {
+			clients = append(clients, c)
+			delete(addrs, c.Addr)
+		} else {
+			// Requests aren't sent to the removed client anymore,
+			// so its connection is closed after outstanding requests
+			// are completed.
+			c.stop()
+			rc.idleClients = append(rc.idleClients, c)
+		}
+	}
+	newAddrs := make([]string, 0, len(addrs))
+	for addr := range addrs {
+		newAddrs = append(newAddrs, addr)
+	}
+	sort.Strings(newAddrs)
+	for _, addr := range newAddrs {
+		clients = append(clients, rc.acquireClient(addr))
+	}
+	rc.clients = clients
+	rc.mu.Unlock()
+	return nil
+}
+
+// acquireClient returns the client for the given addr.
+//
+// Idle clients are reused if possible.
+//
+// rc.mu must be held.
+func (rc *ResolvingClient) acquireClient(addr string) *Client {
+	if n := len(rc.idleClients); n > 0 {
+		c := rc.idleClients[n-1]
+		rc.idleClients[n-1] = nil
+		rc.idleClients = rc.idleClients[:n-1]
+		c.restart(addr)
+		return c
+	}
+	return rc.newClient(addr)
+}
+
+func (rc *ResolvingClient) newClient(addr string) *Client {
+	var c *Client
+	if rc.NewClient == nil {
+		c = &Client{
+			Addr: addr,
+		}
+	} else {
+		c = rc.NewClient(addr)
+		if c.Addr != addr {
+			panic(fmt.Sprintf("BUG: ResolvingClient.NewClient must return Client with Addr=%q; got %q", addr, c.Addr))
+		}
+	}
+	if tc := c.TLSConfig; tc != nil && tc.ServerName == "" && !tc.InsecureSkipVerify {
+		// The client may be reused for other addresses, so verify
+		// the server certificate against the hostname instead of ip.
+		tc = tc.Clone()
+		tc.ServerName = rc.host
+		c.TLSConfig = tc
+	}
+	return c
+}
+
+// client returns the least loaded client.
+func (rc *ResolvingClient) client() (*Client, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.stopped {
+		return nil, errResolvingClientStopped
+	}
+	clients := rc.clients
+	if len(clients) == 0 {
+		return nil, fmt.Errorf("no addresses for %q", rc.Addr)
+	}
+	// Start from the next client on each call, so requests are spread
+	// among equally loaded clients.
+	n := int(atomic.AddUint32(&rc.n, 1) % uint32(len(clients)))
+	best := clients[n]
+	minPending := best.PendingRequests()
+	for i := 1; i < len(clients); i++ {
+		c := clients[(n+i)%len(clients)]
+		if pending := c.PendingRequests(); pending < minPending {
+			best = c
+			minPending = pending
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,312 @@
+package httpteleport
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestResolvingClient(t *testing.T) {
+	serverStop1, ln1, doneCh, handlerCh := newTestQuotaServer(&Server{})
+	serverStop2, ln2 := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+	lns := map[string]*fasthttputil.InmemoryListener{
+		"10.0.0.1:8043": ln1,
+		"10.0.0.2:8043": ln2,
+	}
+
+	var mu sync.Mutex
+	ips := []string{"10.0.0.1"}
+	rc := &ResolvingClient{
+		Addr:            "foobar.com:8043",
+		ResolveInterval: 10 * time.Millisecond,
+		Resolve: func(host string) ([]string, error) {
+			if host != "foobar.com" {
+				return nil, fmt.Errorf("unexpected host %q", host)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]string{}, ips...), nil
+		},
+		NewClient: func(addr string) *Client {
+			return &Client{
+				Addr: addr,
+				Dial: func(addr string) (net.Conn, error) {
+					ln := lns[addr]
+					if ln == nil {
+						return nil, fmt.Errorf("unexpected addr %q", addr)
+					}
+					return ln.Dial()
+				},
+			}
+		},
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/block")
+	resultCh := make(chan error, 1)
+	go func() {
+		resultCh <- testResolvingClientDo(rc, &req, &resp, time.Hour)
+	}()
+	testQuotaHandlers(t, handlerCh, 1)
+	testResolvingClientAddrs(t, rc, []string{"10.0.0.1:8043"})
+
+	// The service moves to another address.
+	mu.Lock()
+	ips = []string{"10.0.0.2"}
+	mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	testResolvingClientAddrs(t, rc, []string{"10.0.0.2:8043"})
+
+	// New requests must be sent to the new address, while the outstanding
+	// request to the old address must be completed.
+	for i := 0; i < 10; i++ {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/fast")
+		if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+	testQuotaHandlers(t, handlerCh, 0)
+	close(doneCh)
+	testQuotaResults(t, resultCh, 1)
+
+	if err := serverStop1(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+	if err := serverStop2(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestResolvingClientResolveRetry(t *testing.T) {
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+
+	var mu sync.Mutex
+	resolveErr := fmt.Errorf("temporary error")
+	rc := &ResolvingClient{
+		Addr: "foobar.com:8043",
+		Resolve: func(host string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if resolveErr != nil {
+				return nil, resolveErr
+			}
+			return []string{"10.0.0.1"}, nil
+		},
+		NewClient: func(addr string) *Client {
+			c := newTestClient(ln)
+			c.Addr = addr
+			return c
+		},
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := testResolvingClientDo(rc, &req, &resp, time.Second); err == nil {
+		t.Fatalf("expecting non-nil error when the hostname cannot be resolved")
+	}
+	if n := rc.ResolveErrors(); n != 1 {
+		t.Fatalf("unexpected number of resolve errors: %d. Expecting 1", n)
+	}
+
+	// The failed resolve must be retried on the next request.
+	mu.Lock()
+	resolveErr = nil
+	mu.Unlock()
+	if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testResolvingClientAddrs(t, rc, []string{"10.0.0.1:8043"})
+
+	rc.Stop()
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestResolvingClientReuse(t *testing.T) {
+	lns := make(map[string]*fasthttputil.InmemoryListener)
+	for _, addr := range []string{"10.0.0.1:8043", "10.0.0.2:8043", "10.0.0.3:8043"} {
+		serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("done"))
+		})
+		defer serverStop()
+		lns[addr] = ln
+	}
+
+	var mu sync.Mutex
+	ip := "10.0.0.1"
+	var newClients int
+	var dialsMu sync.Mutex
+	dials := make(map[string]int)
+	rc := &ResolvingClient{
+		Addr: "foobar.com:8043",
+		Resolve: func(host string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return []string{ip}, nil
+		},
+		NewClient: func(addr string) *Client {
+			newClients++
+			return &Client{
+				Addr: addr,
+				Dial: func(addr string) (net.Conn, error) {
+					dialsMu.Lock()
+					dials[addr]++
+					dialsMu.Unlock()
+					ln := lns[addr]
+					if ln == nil {
+						return nil, fmt.Errorf("unexpected addr %q", addr)
+					}
+					return ln.Dial()
+				},
+			}
+		},
+	}
+
+	for _, nextIP := range []string{"10.0.0.2", "10.0.0.3", "10.0.0.1"} {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/aaa")
+		if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+
+		// The service moves to another address.
+		mu.Lock()
+		ip = nextIP
+		mu.Unlock()
+		rc.resolveMu.Lock()
+		err := rc.resolve()
+		rc.resolveMu.Unlock()
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		testResolvingClientAddrs(t, rc, []string{nextIP + ":8043"})
+	}
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// The client for the disappeared address must be reused
+	// for the new address.
+	if newClients != 1 {
+		t.Fatalf("unexpected number of created clients: %d. Expecting 1", newClients)
+	}
+	dialsMu.Lock()
+	expectedDials := map[string]int{
+		"10.0.0.1:8043": 2,
+		"10.0.0.2:8043": 1,
+		"10.0.0.3:8043": 1,
+	}
+	if !reflect.DeepEqual(dials, expectedDials) {
+		t.Fatalf("unexpected dials: %v. Expecting %v", dials, expectedDials)
+	}
+	dialsMu.Unlock()
+
+	rc.Stop()
+}
+
+func testResolvingClientDo(rc *ResolvingClient, req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	if err := rc.DoTimeout(req, resp, timeout); err != nil {
+		return err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusOK)
+	}
+	if string(resp.Body()) != "done" {
+		return fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "done")
+	}
+	return nil
+}
+
+func testResolvingClientAddrs(t *testing.T, rc *ResolvingClient, expectedAddrs []string) {
+	if addrs := rc.Addrs(); !reflect.DeepEqual(addrs, expectedAddrs) {
+		t.Fatalf("unexpected addrs: %q. Expecting %q", addrs, expectedAddrs)
+	}
+}
+
+func TestResolvingClientStop(t *testing.T) {
+	serverStop, ln := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+
+	var mu sync.Mutex
+	var resolveErr error
+	var logged []string
+	rc := &ResolvingClient{
+		Addr:            "foobar.com:8043",
+		ResolveInterval: time.Millisecond,
+		Resolve: func(host string) ([]string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			return []string{"10.0.0.1"}, resolveErr
+		},
+		NewClient: func(addr string) *Client {
+			c := newTestClient(ln)
+			c.Addr = addr
+			return c
+		},
+		Logger: testLoggerFunc(func(format string, args ...interface{}) {
+			mu.Lock()
+			logged = append(logged, fmt.Sprintf(format, args...))
+			mu.Unlock()
+		}),
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Resolve errors must be reported, while requests are sent
+	// to the previously resolved addresses.
+	mu.Lock()
+	resolveErr = fmt.Errorf("temporary error")
+	mu.Unlock()
+	if err := testWaitFor(func() bool { return rc.ResolveErrors() > 0 }); err != nil {
+		t.Fatalf("timeout when waiting for resolve errors")
+	}
+	if err := testResolvingClientDo(rc, &req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testResolvingClientAddrs(t, rc, []string{"10.0.0.1:8043"})
+	mu.Lock()
+	if len(logged) == 0 {
+		t.Fatalf("resolve errors must be logged")
+	}
+	mu.Unlock()
+
+	rc.Stop()
+	if err := rc.DoTimeout(&req, &resp, time.Second); err != errResolvingClientStopped {
+		t.Fatalf("unexpected error: %v. Expecting %v", err, errResolvingClientStopped)
+	}
+	testResolvingClientAddrs(t, rc, []string{})
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+type testLoggerFunc func(format string, args ...interface{})
+
+func (f testLoggerFunc) Printf(format string, args ...interface{}) {
+	f(format, args...)
+}
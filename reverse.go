@@ -0,0 +1,293 @@
+package httpteleport
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReverseClient sends requests from Server to Client over the connection
+// established by the Client.
+//
+// This allows sending requests to clients behind NAT. Clients accept
+// requests from the server only if Client.ReverseHandler is set.
+//
+// ReverseClient may be obtained via GetReverseClient
+// or Server.OnReverseConn.
+type ReverseClient struct {
+	t *reverseTransport
+
+	info     *ConnInfo
+	stream   net.Conn
+	closedCh <-chan struct{}
+
+	// mu protects the fields below, which prevent sending requests
+	// over the transport after it is passed to another ReverseClient.
+	mu       sync.Mutex
+	inflight int
+	detached bool
+}
+
+// ErrReverseConnClosed is returned from ReverseClient calls after
+// the connection to the client is closed.
+var ErrReverseConnClosed = errors.New("the connection to the client has been closed")
+
+// GetReverseClient returns ReverseClient for sending requests to the client
+// the request in ctx has been received from.
+//
+// nil is returned if ctx isn't served by httpteleport Server or if
+// the client doesn't accept requests from the server.
+func GetReverseClient(ctx *fasthttp.RequestCtx) *ReverseClient {
+	sc := getServerConn(ctx.Conn())
+	if sc == nil {
+		return nil
+	}
+	return sc.reverse
+}
+
+// DoTimeout sends the given request to the client.
+//
+// ErrTimeout is returned if the client didn't return response during
+// the given timeout.
+func (rc *ReverseClient) DoTimeout(req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	return rc.DoDeadline(req, resp, deadline)
+}
+
+// DoDeadline sends the given request to the client.
+//
+// ErrTimeout is returned if the client didn't return response until
+// the given deadline. ErrReverseConnClosed is returned if the connection
+// to the client is closed.
+func (rc *ReverseClient) DoDeadline(req *fasthttp.Request, resp *fasthttp.Response, deadline time.Time) error {
+	if !rc.acquire() {
+		return ErrReverseConnClosed
+	}
+	err := rc.t.c.DoDeadline(req, resp, deadline)
+	rc.release()
+	return err
+}
+
+func (rc *ReverseClient) acquire() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.detached {
+		return false
+	}
+	select {
+	case <-rc.closedCh:
+		return false
+	default:
+	}
+	rc.inflight++
+	return true
+}
+
+func (rc *ReverseClient) release() {
+	rc.mu.Lock()
+	rc.inflight--
+	rc.mu.Unlock()
+}
+
+// detach detaches rc from the transport, so the transport may be used
+// by another ReverseClient.
+//
+// false is returned if rc has outstanding requests.
+func (rc *ReverseClient) detach() bool {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.inflight > 0 {
+		return false
+	}
+	rc.detached = true
+	return true
+}
+
+// ConnInfo returns information about the client connection.
+//
+// The returned ConnInfo mustn't be modified.
+func (rc *ReverseClient) ConnInfo() *ConnInfo {
+	return rc.info
+}
+
+// RemoteAddr returns the client address.
+func (rc *ReverseClient) RemoteAddr() net.Addr {
+	return rc.stream.RemoteAddr()
+}
+
+// Close closes the connection to the client.
+//
+// The client re-establishes the connection after that.
+func (rc *ReverseClient) Close() error {
+	return rc.stream.Close()
+}
+
+// Closed returns a channel, which is closed when the connection
+// to the client is closed.
+func (rc *ReverseClient) Closed() <-chan struct{} {
+	return rc.closedCh
+}
+
+// reverseTransport sends requests from ReverseClient to the client.
+//
+// fastrpc.Client cannot be stopped, so transports are reused
+// for new ReverseClients after connections to clients are closed
+// instead of leaking a goroutine per connection.
+type reverseTransport struct {
+	c Client
+	s *Server
+
+	// rc is the current ReverseClient. It is accessed only from dial,
+	// which is called serially by c.
+	rc *ReverseClient
+
+	rcCh chan *ReverseClient
+}
+
+func (t *reverseTransport) dial(addr string) (net.Conn, error) {
+	if rc := t.rc; rc != nil {
+		// The connection to the client cannot be re-established from
+		// the server side. ReverseClient calls return ErrReverseConnClosed
+		// from now on.
+		rc.stream.Close()
+		if !rc.detach() {
+			// Fail outstanding requests before passing the transport
+			// to another ReverseClient.
+			return nil, ErrReverseConnClosed
+		}
+		t.rc = nil
+		t.s.releaseReverseTransport(t)
+	}
+	t.rc = <-t.rcCh
+	return t.rc.stream, nil
+}
+
+func (s *Server) acquireReverseTransport() *reverseTransport {
+	s.reverseMu.Lock()
+	defer s.reverseMu.Unlock()
+	if n := len(s.reverseTransports); n > 0 {
+		t := s.reverseTransports[n-1]
+		s.reverseTransports[n-1] = nil
+		s.reverseTransports = s.reverseTransports[:n-1]
+		return t
+	}
+	t := &reverseTransport{
+		s:    s,
+		rcCh: make(chan *ReverseClient, 1),
+	}
+	t.c.Addr = reverseAddr{}.String()
+	t.c.CompressType = s.CompressType
+	t.c.Dial = t.dial
+	return t
+}
+
+func (s *Server) releaseReverseTransport(t *reverseTransport) {
+	s.reverseMu.Lock()
+	s.reverseTransports = append(s.reverseTransports, t)
+	s.reverseMu.Unlock()
+}
+
+// newBidiConn multiplexes the connection from the client accepting
+// requests from the server.
+//
+// It returns the forward stream for serving requests from the client.
+func (s *Server) newBidiConn(sc *serverConn, flags byte) (net.Conn, error) {
+	var conn net.Conn = sc
+	if flags&handshakeFlagTLS != 0 {
+		tc := tls.Server(sc, s.s.TLSConfig)
+		if err := tlsHandshake(tc); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	m := newMuxConn(conn)
+	rc := &ReverseClient{
+		t:        s.acquireReverseTransport(),
+		info:     &sc.info,
+		stream:   m.stream(muxStreamReverse),
+		closedCh: m.closedCh,
+	}
+	rc.t.rcCh <- rc
+	sc.reverse = rc
+	if s.OnReverseConn != nil {
+		s.OnReverseConn(rc)
+	}
+	return m.stream(muxStreamForward), nil
+}
+
+// newBidiConn multiplexes the connection to the server, so the server
+// may send requests to Client.ReverseHandler.
+//
+// It returns the forward stream for sending requests to the server.
+func (c *Client) newBidiConn(conn net.Conn) (net.Conn, error) {
+	if c.TLSConfig != nil {
+		tc := tls.Client(conn, c.TLSConfig)
+		if err := tlsHandshake(tc); err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	m := newMuxConn(conn)
+	go c.reverseServer.serve(newReverseListener(m.stream(muxStreamReverse), m.closedCh))
+	return m.stream(muxStreamForward), nil
+}
+
+func tlsHandshake(tc *tls.Conn) error {
+	if err := tc.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return fmt.Errorf("cannot set TLS handshake deadline: %s", err)
+	}
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("TLS handshake error: %s", err)
+	}
+	return tc.SetDeadline(time.Time{})
+}
+
+// reverseListener passes the reverse stream to the Server serving
+// Client.ReverseHandler.
+//
+// The listener is closed when the connection to the server is closed,
+// so the Server stops serving it.
+type reverseListener struct {
+	connCh   chan net.Conn
+	closedCh <-chan struct{}
+}
+
+func newReverseListener(conn net.Conn, closedCh <-chan struct{}) *reverseListener {
+	ln := &reverseListener{
+		connCh:   make(chan net.Conn, 1),
+		closedCh: closedCh,
+	}
+	ln.connCh <- conn
+	return ln
+}
+
+func (ln *reverseListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.connCh:
+		return conn, nil
+	case <-ln.closedCh:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *reverseListener) Close() error {
+	return nil
+}
+
+func (ln *reverseListener) Addr() net.Addr {
+	return reverseAddr{}
+}
+
+type reverseAddr struct{}
+
+func (reverseAddr) Network() string {
+	return "httpteleport-reverse"
+}
+
+func (reverseAddr) String() string {
+	return "httpteleport-reverse"
+}
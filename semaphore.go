@@ -0,0 +1,100 @@
+package httpteleport
+
+import (
+	"github.com/valyala/fasthttp"
+	"sync"
+	"time"
+)
+
+// fifoSemaphore is a semaphore granting slots to waiters in FIFO order.
+type fifoSemaphore struct {
+	maxSlots int
+
+	mu      sync.Mutex
+	slots   int
+	waiters []chan struct{}
+}
+
+func newFIFOSemaphore(maxSlots int) *fifoSemaphore {
+	return &fifoSemaphore{
+		maxSlots: maxSlots,
+	}
+}
+
+// acquire waits for a free slot until the given deadline.
+//
+// It returns the duration spent in waiting for the slot. false is returned
+// if the slot couldn't be acquired until the deadline.
+func (s *fifoSemaphore) acquire(deadline time.Time) (time.Duration, bool) {
+	s.mu.Lock()
+	if s.slots < s.maxSlots && len(s.waiters) == 0 {
+		s.slots++
+		s.mu.Unlock()
+		return 0, true
+	}
+	ch := make(chan struct{})
+	s.waiters = append(s.waiters, ch)
+	s.mu.Unlock()
+
+	startTime := time.Now()
+	timeout := -time.Since(deadline)
+	if timeout <= 0 {
+		s.cancel(ch)
+		return 0, false
+	}
+	t := fasthttp.AcquireTimer(timeout)
+	defer fasthttp.ReleaseTimer(t)
+	select {
+	case <-ch:
+		return time.Since(startTime), true
+	case <-t.C:
+		s.cancel(ch)
+		return time.Since(startTime), false
+	}
+}
+
+// tryAcquire acquires n slots without waiting.
+//
+// false is returned if n slots aren't free at the moment.
+func (s *fifoSemaphore) tryAcquire(n int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slots+n > s.maxSlots || len(s.waiters) > 0 {
+		return false
+	}
+	s.slots += n
+	return true
+}
+
+// cancel removes ch from waiters.
+func (s *fifoSemaphore) cancel(ch chan struct{}) {
+	s.mu.Lock()
+	for i, w := range s.waiters {
+		if w == ch {
+			s.waiters = append(s.waiters[:i], s.waiters[i+1:]...)
+			s.mu.Unlock()
+			return
+		}
+	}
+	s.mu.Unlock()
+
+	// The slot has been granted concurrently with the cancellation,
+	// so return it back.
+	<-ch
+	s.release()
+}
+
+func (s *fifoSemaphore) release() {
+	s.mu.Lock()
+	if len(s.waiters) > 0 {
+		// Pass the slot to the oldest waiter.
+		ch := s.waiters[0]
+		s.waiters[0] = nil
+		s.waiters = s.waiters[1:]
+		s.mu.Unlock()
+		close(ch)
+		return
+	}
+	s.slots--
+	s.mu.Unlock()
+}
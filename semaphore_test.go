@@ -0,0 +1,72 @@
+package httpteleport
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFIFOSemaphoreOrder(t *testing.T) {
+	s := newFIFOSemaphore(1)
+	deadline := time.Now().Add(time.Hour)
+	if _, ok := s.acquire(deadline); !ok {
+		t.Fatalf("cannot acquire free slot")
+	}
+
+	const waiters = 10
+	orderCh := make(chan int, waiters)
+	for i := 0; i < waiters; i++ {
+		go func(n int) {
+			if _, ok := s.acquire(deadline); !ok {
+				t.Errorf("cannot acquire slot")
+			}
+			orderCh <- n
+			s.release()
+		}(i)
+
+		// Wait until the goroutine is enqueued.
+		for testFIFOSemaphoreWaiters(s) != i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	s.release()
+	for i := 0; i < waiters; i++ {
+		select {
+		case n := <-orderCh:
+			if n != i {
+				t.Fatalf("unexpected waiter: %d. Expecting %d", n, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+}
+
+func TestFIFOSemaphoreTimeout(t *testing.T) {
+	s := newFIFOSemaphore(1)
+	if _, ok := s.acquire(time.Now().Add(time.Hour)); !ok {
+		t.Fatalf("cannot acquire free slot")
+	}
+	d, ok := s.acquire(time.Now().Add(20 * time.Millisecond))
+	if ok {
+		t.Fatalf("expecting timeout when acquiring busy slot")
+	}
+	if d < 20*time.Millisecond {
+		t.Fatalf("unexpected wait duration: %s. Expecting at least 20ms", d)
+	}
+	if n := testFIFOSemaphoreWaiters(s); n != 0 {
+		t.Fatalf("unexpected number of waiters after timeout: %d. Expecting 0", n)
+	}
+
+	s.release()
+	if _, ok := s.acquire(time.Now().Add(time.Hour)); !ok {
+		t.Fatalf("cannot acquire released slot")
+	}
+}
+
+func testFIFOSemaphoreWaiters(s *fifoSemaphore) int {
+	s.mu.Lock()
+	n := len(s.waiters)
+	s.mu.Unlock()
+	return n
+}
@@ -3,11 +3,18 @@ package httpteleport
 import (
 	"bufio"
 	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/valyala/fasthttp"
 	"github.com/valyala/fastrpc"
 	"github.com/valyala/tcplisten"
+	"log"
 	"net"
+	"os"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -19,8 +26,23 @@ type Server struct {
 	//
 	//   - Connection hijacking, i.e. RequestCtx.Hijack
 	//   - Streamed response bodies, i.e. RequestCtx.*BodyStream*
+	//
+	// Information about the client connection may be obtained
+	// via GetConnInfo.
+	//
+	// The response may be completed after Handler returns
+	// via DeferResponse.
 	Handler fasthttp.RequestHandler
 
+	// OnReverseConn is called when a client accepting requests from
+	// the server connects to the server.
+	//
+	// rc may be used for sending requests to the client until
+	// rc.Closed is closed. See also GetReverseClient.
+	//
+	// OnReverseConn mustn't block.
+	OnReverseConn func(rc *ReverseClient)
+
 	// CompressType is the compression type used for responses.
 	//
 	// CompressFlate is used by default.
@@ -32,6 +54,97 @@ type Server struct {
 	// DefaultConcurrency is used by default.
 	Concurrency int
 
+	// MaxQueueSize is the maximum number of requests waiting for a free
+	// Handler slot when Concurrency is exceeded.
+	//
+	// Requests exceeding the queue are rejected via
+	// ConcurrencyLimitHandler.
+	//
+	// By default requests exceeding Concurrency are rejected immediately.
+	MaxQueueSize int
+
+	// QueueTimeout is the maximum duration a request may wait
+	// in the queue for a free Handler slot.
+	//
+	// Requests waiting longer are rejected via ConcurrencyLimitHandler.
+	//
+	// By default queued requests wait until a free Handler slot
+	// is available.
+	QueueTimeout time.Duration
+
+	// ConcurrencyLimitHandler is called instead of Handler for requests
+	// rejected due to Concurrency limit.
+	//
+	// concurrency is the current Concurrency limit.
+	//
+	// By default 429 Too Many Requests response is sent to the client.
+	ConcurrencyLimitHandler func(ctx *fasthttp.RequestCtx, concurrency int)
+
+	// MaxDeferredResponses is the maximum number of pending responses
+	// deferred via DeferResponse.
+	//
+	// DeferResponse returns nil when the limit is reached.
+	//
+	// Clients poll connections with pending deferred responses.
+	// Polls aren't counted in Concurrency if MaxDeferredResponses is set.
+	//
+	// By default the number of deferred responses isn't limited, but polls
+	// are counted in Concurrency.
+	MaxDeferredResponses int
+
+	// MaxConcurrencyPerConn is the maximum number of concurrent goroutines
+	// with Server.Handler the server may run for a single connection.
+	//
+	// The server stops reading requests from the connection until
+	// the number of running handlers for the connection drops below
+	// the limit.
+	//
+	// By default the number of goroutines per connection is limited
+	// only by Concurrency.
+	MaxConcurrencyPerConn int
+
+	// MaxConcurrencyPerClient is the maximum number of concurrent goroutines
+	// with Server.Handler the server may run for all the connections
+	// from a single client.
+	//
+	// Clients are identified by ConnInfo.AuthKeyID if AuthKeys are set.
+	// Otherwise clients are identified by IP address.
+	//
+	// The server stops reading requests from the client connections until
+	// the number of running handlers for the client drops below the limit.
+	//
+	// By default the number of goroutines per client is limited
+	// only by Concurrency.
+	MaxConcurrencyPerClient int
+
+	// FairConcurrency enables fair sharing of Concurrency among
+	// connections with outstanding requests.
+	//
+	// Each connection may run up to Concurrency/(N+1) handlers,
+	// where N is the number of connections with outstanding requests.
+	// A share is reserved for new connections, so they aren't rejected
+	// due to Concurrency limit.
+	// The server stops reading requests from the connection exceeding
+	// its share, so a single client cannot occupy all the handler slots.
+	//
+	// By default handler slots are shared on a first come, first served
+	// basis.
+	FairConcurrency bool
+
+	// AuthKeys contains pre-shared keys for authenticating clients.
+	//
+	// Clients must set Client.AuthKey to one of these keys if AuthKeys
+	// isn't empty. Multiple keys may be set simultaneously in order
+	// to rotate keys without downtime: add a new key via SetAuthKeys,
+	// switch clients to the new key and then remove the old key
+	// via SetAuthKeys.
+	//
+	// AuthKeys mustn't be modified after Serve call - use SetAuthKeys
+	// instead.
+	//
+	// By default clients aren't authenticated.
+	AuthKeys []AuthKey
+
 	// TLSConfig is TLS (aka SSL) config used for accepting encrypted
 	// client connections.
 	//
@@ -52,6 +165,8 @@ type Server struct {
 	// Maximum duration for reading the full request (including body).
 	//
 	// This also limits the maximum lifetime for idle connections.
+	// Connections from clients with Client.PingInterval smaller than
+	// ReadTimeout aren't considered idle.
 	//
 	// By default request read timeout is unlimited.
 	ReadTimeout time.Duration
@@ -61,6 +176,42 @@ type Server struct {
 	// By default response write timeout is unlimited.
 	WriteTimeout time.Duration
 
+	// MaxRequestBodySize is the maximum request body size the server reads.
+	//
+	// Requests with bigger bodies are rejected with 413 status code
+	// without calling Handler. The connection remains open, so other
+	// requests from the client are processed as usual.
+	//
+	// By default request body size is unlimited.
+	MaxRequestBodySize int
+
+	// MaxRequestHeaderSize is the maximum request header size.
+	//
+	// Requests with bigger headers are rejected with 431 status code
+	// without calling Handler. The connection remains open, so other
+	// requests from the client are processed as usual.
+	//
+	// Request headers cannot exceed ReadBufferSize in any case.
+	//
+	// By default request header size is limited only by ReadBufferSize.
+	MaxRequestHeaderSize int
+
+	// MaxBufferedBytes is the maximum number of bytes the server may
+	// buffer for request and response bodies across all the connections.
+	//
+	// The server stops reading requests from clients when the limit
+	// is reached until responses for the buffered requests are sent.
+	// This limits memory usage under high load with big requests,
+	// since clients are slowed down by TCP backpressure.
+	//
+	// A request with body exceeding MaxBufferedBytes is read only
+	// when there are no other buffered bodies.
+	//
+	// Current usage may be obtained via BufferedBytes.
+	//
+	// By default the number of buffered bytes is unlimited.
+	MaxBufferedBytes int
+
 	// ReduceMemoryUsage leads to reduced memory usage at the cost
 	// of higher CPU usage if set to true.
 	//
@@ -96,7 +247,68 @@ type Server struct {
 	// By default requests from a single client are processed concurrently.
 	PipelineRequests bool
 
+	// DisablePanicRecovery disables recovering from panics in Handler.
+	//
+	// By default panics in Handler are recovered and converted
+	// to responses with 500 status code, so a single buggy request
+	// doesn't take down the whole process with all the connected clients.
+	// Panics are logged with stack traces via Logger.
+	//
+	// Set DisablePanicRecovery to true if the process must crash on panic.
+	DisablePanicRecovery bool
+
+	// SendLoad enables sending the server load to clients in responses.
+	//
+	// Clients expose the load via Client.ServerLoad, so client-side
+	// load balancers may prefer less loaded servers.
+	//
+	// By default the load isn't sent.
+	SendLoad bool
+
+	// Tracer creates server spans for requests.
+	//
+	// The span parent is the trace context sent by the client
+	// in the request frame. The traceparent header in requests passed
+	// to Handler is set to the server span context, so Handler may
+	// propagate it further, for instance, via Client.
+	//
+	// By default requests aren't traced. The traceparent header is set
+	// to the client trace context in this case.
+	Tracer Tracer
+
 	s fastrpc.Server
+
+	budget *memoryBudget
+	quotas *concurrencyQuotas
+
+	// concurrencyCh limits the number of concurrently running handlers
+	// if MaxQueueSize or MaxDeferredResponses is set.
+	concurrencyCh chan struct{}
+
+	deferredResponses int32
+
+	// running is the number of running Handler calls.
+	running int32
+
+	// queued is the number of requests waiting for free Handler slot.
+	queued int32
+
+	panics uint64
+
+	stats serverCounters
+
+	// authKeysV holds []AuthKey set by SetAuthKeys.
+	authKeysV atomic.Value
+
+	// drain holds *drainState set by Drain.
+	drain    atomic.Value
+	drainMu  sync.Mutex
+	drainGen uint32
+
+	// reverseTransports contains transports for ReverseClient,
+	// which may be reused.
+	reverseMu         sync.Mutex
+	reverseTransports []*reverseTransport
 }
 
 // ListenAndServe serves httpteleport requests accepted from the given
@@ -113,7 +325,11 @@ func (s *Server) ListenAndServe(addr string) error {
 // Serve serves httpteleport requests accepted from the given listener.
 func (s *Server) Serve(ln net.Listener) error {
 	s.init()
-	return s.s.Serve(ln)
+	return s.serve(ln)
+}
+
+func (s *Server) serve(ln net.Listener) error {
+	return s.s.Serve(newHandshakeListener(ln, s))
 }
 
 func (s *Server) init() {
@@ -126,9 +342,28 @@ func (s *Server) init() {
 	s.s.NewHandlerCtx = s.newHandlerCtx
 	s.s.Handler = s.requestHandler
 
+	if s.MaxBufferedBytes > 0 && s.budget == nil {
+		s.budget = newMemoryBudget(s.MaxBufferedBytes)
+	}
+	if s.quotas == nil {
+		s.quotas = newConcurrencyQuotas(s)
+	}
+
 	s.s.CompressType = fastrpc.CompressType(s.CompressType)
 	s.s.Concurrency = s.Concurrency
-	s.s.TLSConfig = s.TLSConfig
+	if s.MaxQueueSize > 0 || s.MaxDeferredResponses > 0 {
+		// Let fastrpc accept queued requests and polls for deferred
+		// responses, while the number of running handlers is limited
+		// by concurrencyCh. There is at most one poll per connection
+		// with pending deferred responses.
+		s.s.Concurrency = s.concurrency() + s.MaxQueueSize + s.MaxDeferredResponses
+		if s.concurrencyCh == nil {
+			s.concurrencyCh = make(chan struct{}, s.concurrency())
+		}
+	}
+	if s.TLSConfig != nil {
+		s.s.TLSConfig = newServerTLSConfig(s.TLSConfig)
+	}
 	s.s.MaxBatchDelay = s.MaxBatchDelay
 	s.s.ReadTimeout = s.ReadTimeout
 	s.s.WriteTimeout = s.WriteTimeout
@@ -138,9 +373,76 @@ func (s *Server) init() {
 	s.s.PipelineRequests = s.PipelineRequests
 }
 
+func (s *Server) concurrency() int {
+	if s.Concurrency > 0 {
+		return s.Concurrency
+	}
+	return fastrpc.DefaultConcurrency
+}
+
+func (s *Server) logger() fasthttp.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return defaultLogger
+}
+
+var defaultLogger = fasthttp.Logger(log.New(os.Stderr, "", log.LstdFlags))
+
 type handlerCtx struct {
 	ctx *fasthttp.RequestCtx
 	s   *Server
+
+	// errStatusCode is the status code to respond with instead
+	// of calling Server.Handler if non-zero.
+	errStatusCode int
+
+	// sc is the connection the request has been read from.
+	sc *serverConn
+
+	// bufferedBytes is the number of bytes acquired from Server.budget.
+	bufferedBytes int64
+
+	// hasQuota is set if the request holds the connection quota
+	// in Server.quotas.
+	hasQuota bool
+
+	// deferred is set if the handler called DeferResponse.
+	deferred *DeferredResponse
+
+	// deferredAck is set if the client must be notified the response
+	// is deferred.
+	deferredAck *DeferredResponse
+
+	// deferredID is the id of the deferred response.
+	deferredID uint64
+
+	// isAsync is set if the request has been sent via Client.DoAsync.
+	// The response is sent to the client in response to poll then.
+	isAsync bool
+
+	// asyncID is the id of the async request.
+	asyncID uint64
+
+	// isPing is set if ping has been read instead of http request.
+	isPing bool
+
+	// isPoll is set if poll for deferred responses has been read
+	// instead of http request.
+	isPoll bool
+
+	// pollTimeout is the maximum duration the poll may wait
+	// for deferred responses.
+	pollTimeout time.Duration
+
+	// polled contains deferred responses sent in response to the poll.
+	polled []*handlerCtx
+
+	// readTime is the time the request has been read.
+	readTime time.Time
+
+	// span is set if Server.Tracer is set.
+	span *traceSpan
 }
 
 func (s *Server) newHandlerCtx() fastrpc.HandlerCtx {
@@ -152,48 +454,437 @@ func (s *Server) newHandlerCtx() fastrpc.HandlerCtx {
 
 func (ctx *handlerCtx) Init(conn net.Conn, logger fasthttp.Logger) {
 	ctx.ctx.Init2(conn, logger, ctx.s.ReduceMemoryUsage)
+	ctx.sc = getServerConn(conn)
 }
 
 func (ctx *handlerCtx) ReadRequest(br *bufio.Reader) error {
-	return ctx.ctx.Request.Read(br)
+	ctx.errStatusCode = 0
+	ctx.span = nil
+	ctx.deferredAck = nil
+	ctx.isPoll = false
+	ctx.polled = nil
+	ctx.isAsync = false
+	typ, err := br.ReadByte()
+	if err != nil {
+		return err
+	}
+	var tc TraceContext
+	if typ&messageFlagTrace != 0 {
+		if tc, err = readTraceContext(br); err != nil {
+			return err
+		}
+		typ &^= messageFlagTrace
+	}
+	if typ&messageFlagAsync != 0 {
+		if ctx.sc == nil {
+			return fmt.Errorf("async requests aren't supported over %T", ctx.ctx.Conn())
+		}
+		if ctx.asyncID, err = binary.ReadUvarint(br); err != nil {
+			return fmt.Errorf("cannot read async request id: %s", err)
+		}
+		if !ctx.sc.deferred.reserve() {
+			return errConnClosed
+		}
+		ctx.isAsync = true
+		typ &^= messageFlagAsync
+	}
+	switch typ {
+	case messageHTTP:
+		ctx.isPing = false
+	case messagePing:
+		ctx.isPing = true
+		atomic.AddUint64(&ctx.s.stats.uncompressedBytesRead, 1)
+		return nil
+	case messagePoll:
+		ctx.isPing = false
+		ctx.isPoll = true
+		timeout, err := binary.ReadUvarint(br)
+		if err != nil {
+			return fmt.Errorf("cannot read poll timeout: %s", err)
+		}
+		ctx.pollTimeout = time.Duration(timeout) * time.Millisecond
+		if ctx.pollTimeout > maxPollTimeout {
+			ctx.pollTimeout = maxPollTimeout
+		}
+		atomic.AddUint64(&ctx.s.stats.uncompressedBytesRead, 2)
+		return nil
+	default:
+		return fmt.Errorf("unexpected message type: %d", typ)
+	}
+	req := &ctx.ctx.Request
+
+	// Read the header at first in order to check body size
+	// before reading the body.
+	req.Reset()
+	if err := req.Header.Read(br); err != nil {
+		return err
+	}
+	n := req.Header.ContentLength()
+	if ctx.s.MaxRequestBodySize > 0 && n > ctx.s.MaxRequestBodySize {
+		// Skip the body, so the following requests may be read from br.
+		if err := skipBody(br, n); err != nil {
+			return err
+		}
+		ctx.s.stats.addRequest(req, n)
+		ctx.readTime = time.Now()
+		ctx.startSpan(tc)
+		atomic.AddUint64(&ctx.s.stats.requestsTooLarge, 1)
+		ctx.errStatusCode = fasthttp.StatusRequestEntityTooLarge
+		return nil
+	}
+	if n < 0 {
+		n = 0
+	}
+	// This blocks reading from the connection until the memory
+	// budget is available.
+	ctx.acquireBuffered(int64(n), true)
+	if err := req.ContinueReadBody(br, ctx.s.MaxRequestBodySize); err != nil {
+		ctx.releaseBuffered()
+		return err
+	}
+	if n = len(req.Body()) - n; n > 0 {
+		// The body size wasn't known in advance, i.e. the body is chunked.
+		ctx.acquireBuffered(int64(n), false)
+	}
+
+	ctx.s.stats.addRequest(req, 0)
+	ctx.readTime = time.Now()
+	ctx.startSpan(tc)
+	if ctx.s.MaxRequestHeaderSize > 0 && len(req.Header.Header()) > ctx.s.MaxRequestHeaderSize {
+		atomic.AddUint64(&ctx.s.stats.requestsTooLarge, 1)
+		ctx.errStatusCode = fasthttp.StatusRequestHeaderFieldsTooLarge
+	}
+	return ctx.acquireQuota()
+}
+
+// acquireQuota waits until the request fits concurrency quotas
+// for the connection.
+//
+// This blocks reading new requests from the connection.
+func (ctx *handlerCtx) acquireQuota() error {
+	q := ctx.s.quotas
+	if q == nil || ctx.sc == nil {
+		return nil
+	}
+	if !q.acquire(&ctx.sc.quota) {
+		ctx.releaseBuffered()
+		return errConnClosed
+	}
+	ctx.hasQuota = true
+	return nil
+}
+
+func (ctx *handlerCtx) releaseQuota() {
+	if !ctx.hasQuota {
+		return
+	}
+	ctx.hasQuota = false
+	ctx.s.quotas.release(&ctx.sc.quota)
+}
+
+var errConnClosed = errors.New("the connection has been closed")
+
+// acquireBuffered acquires n bytes from Server.budget.
+//
+// It waits until the budget is available if wait is set.
+func (ctx *handlerCtx) acquireBuffered(n int64, wait bool) {
+	b := ctx.s.budget
+	if b == nil || n == 0 {
+		return
+	}
+	if wait {
+		b.acquire(n)
+	} else {
+		b.forceAcquire(n)
+	}
+	if ctx.sc != nil && !ctx.sc.acquireBuffered(n) {
+		// The connection is closed, so the request won't be processed.
+		b.release(n)
+		return
+	}
+	ctx.bufferedBytes += n
+}
+
+// releaseBuffered releases all the bytes acquired by ctx.
+func (ctx *handlerCtx) releaseBuffered() {
+	n := ctx.bufferedBytes
+	if n == 0 {
+		return
+	}
+	ctx.bufferedBytes = 0
+	if ctx.sc != nil && !ctx.sc.releaseBuffered(n) {
+		// The bytes have been already released on connection close.
+		return
+	}
+	ctx.s.budget.release(n)
+}
+
+// startSpan starts the server span for the read request.
+//
+// tc is the trace context sent by the client.
+func (ctx *handlerCtx) startSpan(tc TraceContext) {
+	req := &ctx.ctx.Request
+	if ctx.s.Tracer != nil {
+		ctx.span = newTraceSpan(ctx.s.Tracer.StartSpan("httpteleport.Server", tc, req))
+		tc = ctx.span.s.Context()
+	}
+	if tc.IsValid() {
+		req.Header.Set(TraceparentHeader, tc.String())
+	}
 }
 
 func (ctx *handlerCtx) WriteResponse(bw *bufio.Writer) error {
+	if ctx.isPing {
+		atomic.AddUint64(&ctx.s.stats.uncompressedBytesWritten, 1)
+		return ctx.writeMessageType(bw, messagePing)
+	}
+	if ctx.isPoll {
+		return ctx.writeDeferred(bw)
+	}
+	if dr := ctx.deferredAck; dr != nil {
+		ctx.deferredAck = nil
+		if err := ctx.writeMessageType(bw, messageDeferred); err != nil {
+			return err
+		}
+		var b [binary.MaxVarintLen64]byte
+		if _, err := bw.Write(appendUvarint(b[:0], dr.id)); err != nil {
+			return err
+		}
+		dr.ack()
+		return nil
+	}
+	if err := ctx.writeMessageType(bw, messageHTTP); err != nil {
+		return err
+	}
+	return ctx.writeHTTP(bw)
+}
+
+// writeHTTP writes http response without the message type to bw.
+func (ctx *handlerCtx) writeHTTP(bw *bufio.Writer) error {
+	ctx.s.stats.addResponse(&ctx.ctx.Response, time.Since(ctx.readTime))
 	err := ctx.ctx.Response.Write(bw)
+	if ctx.sc != nil {
+		atomic.AddUint64(&ctx.sc.unflushed, 1)
+	}
 
 	// Response is no longer needed, so reset it in order to release
 	// resources occupied by the response.
 	ctx.ctx.Response.Reset()
+	ctx.releaseBuffered()
 
+	if ctx.span != nil {
+		if ctx.sc != nil {
+			// The span is finished when the response is flushed.
+			ctx.sc.flushSpans.add(ctx.span)
+		} else {
+			ctx.span.end(err)
+		}
+		ctx.span = nil
+	}
+
+	return err
+}
+
+// writeMessageType writes the type of the response to the client.
+//
+// The type is followed by the drain address if the server is draining
+// and the client isn't notified about this yet. Then the server load
+// follows if Server.SendLoad is set.
+func (ctx *handlerCtx) writeMessageType(bw *bufio.Writer, typ byte) error {
+	var b [32]byte
+	buf := append(b[:0], typ)
+	if ds := ctx.s.drainState(); ds != nil && ctx.sc != nil && ctx.sc.shouldDrain(ds) {
+		buf[0] |= messageFlagDrain
+		buf = appendHandshakeString(buf, ds.addr)
+	}
+	if ctx.s.SendLoad {
+		buf[0] |= messageFlagLoad
+		buf = ctx.s.appendLoad(buf)
+	}
+	_, err := bw.Write(buf)
 	return err
 }
 
 func (ctx *handlerCtx) ConcurrencyLimitError(concurrency int) {
-	fmt.Fprintf(ctx.ctx, "concurrency limit exceeded: %d. Increase Server.Concurrency or decrease load on the server", concurrency)
-	ctx.ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+	if ctx.isPing || ctx.isPoll {
+		// Respond to poll without deferred responses,
+		// so the client polls again later.
+		return
+	}
+	atomic.AddUint64(&ctx.s.stats.concurrencyLimitErrors, 1)
+	ctx.releaseQuota()
+	ctx.s.concurrencyLimitError(ctx.ctx)
+	if ctx.isAsync {
+		// fastrpc doesn't send responses to async requests,
+		// so the error is sent in response to poll.
+		ctx.s.finishResponse(ctx)
+		ctx.sc.deferred.push(ctx)
+	}
+}
+
+func (s *Server) concurrencyLimitError(ctx *fasthttp.RequestCtx) {
+	concurrency := s.concurrency()
+	if s.ConcurrencyLimitHandler != nil {
+		s.ConcurrencyLimitHandler(ctx, concurrency)
+		return
+	}
+	fmt.Fprintf(ctx, "concurrency limit exceeded: %d. Increase Server.Concurrency or decrease load on the server", concurrency)
+	ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+}
+
+// acquireConcurrency waits for a free Handler slot if MaxQueueSize is set.
+//
+// false is returned if the slot isn't obtained during QueueTimeout.
+func (s *Server) acquireConcurrency() bool {
+	ch := s.concurrencyCh
+	if ch == nil {
+		return true
+	}
+	select {
+	case ch <- struct{}{}:
+		return true
+	default:
+	}
+	atomic.AddInt32(&s.queued, 1)
+	defer atomic.AddInt32(&s.queued, -1)
+	if s.QueueTimeout <= 0 {
+		ch <- struct{}{}
+		return true
+	}
+	t := fasthttp.AcquireTimer(s.QueueTimeout)
+	defer fasthttp.ReleaseTimer(t)
+	select {
+	case ch <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+func (s *Server) releaseConcurrency() {
+	if s.concurrencyCh != nil {
+		<-s.concurrencyCh
+	}
 }
 
 func (s *Server) requestHandler(ctxv fastrpc.HandlerCtx) fastrpc.HandlerCtx {
 	ctx := ctxv.(*handlerCtx)
-	s.Handler(ctx.ctx)
-	if ctx.ctx.IsBodyStream() {
-		panic("chunked responses aren't supported")
+	if ctx.isPing {
+		// Respond to ping immediately without calling Handler.
+		return ctx
 	}
-	if ctx.ctx.Hijacked() {
-		panic("hijacking isn't supported")
+	if ctx.isPoll {
+		if ctx.sc != nil {
+			ctx.polled = ctx.sc.deferred.wait(ctx.pollTimeout)
+		}
+		return ctx
+	}
+	if ctx.errStatusCode != 0 {
+		ctx.ctx.Error(fasthttp.StatusMessage(ctx.errStatusCode), ctx.errStatusCode)
+	} else if s.acquireConcurrency() {
+		ctx.ctx.SetUserValue(handlerCtxKey, ctx)
+		if ctx.span != nil {
+			ctx.span.addEvent(SpanEventHandlerStarted, time.Now())
+		}
+		atomic.AddInt32(&s.running, 1)
+		s.callHandler(ctx.ctx)
+		atomic.AddInt32(&s.running, -1)
+		s.releaseConcurrency()
+	} else {
+		atomic.AddUint64(&s.stats.queueTimeouts, 1)
+		s.concurrencyLimitError(ctx.ctx)
+	}
+	ctx.releaseQuota()
+	if dr := ctx.deferred; dr != nil {
+		// The original ctx is owned by the deferred response now,
+		// so notify the client via new ctx.
+		ctx.deferred = nil
+		if ctx.isAsync {
+			// The response is passed to the deferred queue when completed,
+			// while fastrpc doesn't send responses to async requests.
+			return s.newHandlerCtx()
+		}
+		ctxAck := s.newHandlerCtx().(*handlerCtx)
+		ctxAck.sc = ctx.sc
+		ctxAck.deferredAck = dr
+		return ctxAck
 	}
 	timeoutResp := ctx.ctx.LastTimeoutErrorResponse()
 	if timeoutResp != nil {
+		atomic.AddUint64(&s.stats.handlerTimeouts, 1)
 		// The current ctx may be still in use by the handler.
 		// So create new one for passing to pendingResponses.
 		ctxNew := s.newHandlerCtx().(*handlerCtx)
 		timeoutResp.CopyTo(&ctxNew.ctx.Response)
+		ctxNew.sc = ctx.sc
+		ctxNew.span = ctx.span
+		ctxNew.isAsync = ctx.isAsync
+		ctxNew.asyncID = ctx.asyncID
+		ctx.releaseBuffered()
 		ctx = ctxNew
 	}
+	s.finishResponse(ctx)
+	if ctx.isAsync {
+		// fastrpc doesn't send responses to async requests,
+		// so the response is sent in response to poll.
+		ctx.sc.deferred.push(ctx)
+		return s.newHandlerCtx()
+	}
+	return ctx
+}
 
+// finishResponse prepares the response in ctx for sending to the client.
+func (s *Server) finishResponse(ctx *handlerCtx) {
 	// Request is no longer needed, so reset it in order
 	// to free up resources occupied by the request.
 	ctx.ctx.Request.Reset()
 
-	return ctx
+	// Account the response body instead of the request body,
+	// since the response is buffered until it is sent to the client.
+	ctx.releaseBuffered()
+	ctx.acquireBuffered(int64(len(ctx.ctx.Response.Body())), false)
+
+	if ctx.span != nil {
+		ctx.span.addEvent(SpanEventHandlerFinished, time.Now())
+	}
+}
+
+func (s *Server) callHandler(ctx *fasthttp.RequestCtx) {
+	if !s.DisablePanicRecovery {
+		defer s.recoverPanic(ctx)
+	}
+	s.Handler(ctx)
+	if ctx.IsBodyStream() {
+		panic("chunked responses aren't supported")
+	}
+	if ctx.Hijacked() {
+		panic("hijacking isn't supported")
+	}
+}
+
+func (s *Server) recoverPanic(ctx *fasthttp.RequestCtx) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&s.panics, 1)
+	s.logger().Printf("panic when serving %q from %s: %v\n%s", ctx.RequestURI(), ctx.RemoteAddr(), r, debug.Stack())
+	ctx.Response.Reset()
+	ctx.Error("Internal Server Error", fasthttp.StatusInternalServerError)
+}
+
+// BufferedBytes returns the number of bytes currently buffered
+// for request and response bodies.
+//
+// It always returns 0 if MaxBufferedBytes isn't set.
+func (s *Server) BufferedBytes() int64 {
+	if s.budget == nil {
+		return 0
+	}
+	return s.budget.usage()
+}
+
+// Panics returns the number of panics recovered in Server.Handler.
+func (s *Server) Panics() uint64 {
+	return atomic.LoadUint64(&s.panics)
 }
@@ -8,6 +8,8 @@ import (
 	"github.com/valyala/fasthttp/fasthttputil"
 	"math/rand"
 	"net"
+	"runtime"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -100,10 +102,720 @@ func TestServerTLSConcurrent(t *testing.T) {
 	}
 }
 
+func TestServerAuthKey(t *testing.T) {
+	s := &Server{
+		Handler: testGetHandler,
+		AuthKeys: []AuthKey{
+			{ID: "old", Secret: []byte("old secret")},
+			{ID: "new", Secret: []byte("new secret")},
+		},
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	for _, key := range s.AuthKeys {
+		c := newTestClient(ln)
+		c.AuthKey = &AuthKey{
+			ID:     key.ID,
+			Secret: key.Secret,
+		}
+		if err := testGet(c); err != nil {
+			t.Fatalf("unexpected error for key id %q: %s", key.ID, err)
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerSetAuthKeys(t *testing.T) {
+	oldKey := AuthKey{ID: "old", Secret: []byte("old secret")}
+	newKey := AuthKey{ID: "new", Secret: []byte("new secret")}
+	s := &Server{
+		Handler:  testGetHandler,
+		AuthKeys: []AuthKey{oldKey},
+		Logger:   &nilLogger{},
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	testKey := func(key AuthKey) error {
+		c := newTestClient(ln)
+		c.AuthKey = &key
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/aaa")
+		return c.DoTimeout(&req, &resp, 100*time.Millisecond)
+	}
+
+	if err := testKey(newKey); err == nil {
+		t.Fatalf("expecting non-nil error for the key, which isn't added yet")
+	}
+	s.SetAuthKeys([]AuthKey{oldKey, newKey})
+	for _, key := range []AuthKey{oldKey, newKey} {
+		if err := testKey(key); err != nil {
+			t.Fatalf("unexpected error for key id %q: %s", key.ID, err)
+		}
+	}
+	s.SetAuthKeys([]AuthKey{newKey})
+	if err := testKey(oldKey); err == nil {
+		t.Fatalf("expecting non-nil error for the removed key")
+	}
+	if err := testKey(newKey); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerAuthKeyInvalid(t *testing.T) {
+	s := &Server{
+		Handler: testGetHandler,
+		AuthKeys: []AuthKey{
+			{ID: "foo", Secret: []byte("secret")},
+		},
+		Logger: &nilLogger{},
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	keys := []*AuthKey{
+		nil,
+		{ID: "foo", Secret: []byte("invalid secret")},
+		{ID: "unknown", Secret: []byte("secret")},
+	}
+	for _, key := range keys {
+		c := newTestClient(ln)
+		c.AuthKey = key
+
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/aaa")
+		if err := c.DoTimeout(&req, &resp, 100*time.Millisecond); err == nil {
+			t.Fatalf("expecting non-nil error for key %+v", key)
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerHandshakeOptional(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			info := GetConnInfo(ctx)
+			if info == nil {
+				ctx.Error("missing conn info", fasthttp.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(ctx, "%s/%s", info.ClientName, info.ClientVersion)
+		},
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	for _, name := range []string{"", "test-client"} {
+		c := newTestClient(ln)
+		c.Name = name
+		if c.needsHandshake() != (name != "") {
+			t.Fatalf("unexpected needsHandshake for client name %q: %v", name, c.needsHandshake())
+		}
+
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/aaa")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error for client name %q: %s", name, err)
+		}
+		expectedBody := name + "/"
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), expectedBody)
+		}
+	}
+	if n := s.Stats().HandshakeErrors; n != 0 {
+		t.Fatalf("unexpected number of handshake errors: %d. Expecting 0", n)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerAuthKeyTLS(t *testing.T) {
+	s := &Server{
+		Handler:   testGetHandler,
+		TLSConfig: newTestServerTLSConfig(),
+		AuthKeys: []AuthKey{
+			{ID: "foo", Secret: []byte("secret")},
+		},
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	c.AuthKey = &s.AuthKeys[0]
+
+	if err := testServerClientConcurrent(func() error { return testGet(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerConnInfo(t *testing.T) {
+	testServerConnInfo(t, false)
+}
+
+func TestServerConnInfoTLS(t *testing.T) {
+	testServerConnInfo(t, true)
+}
+
+func testServerConnInfo(t *testing.T, isTLS bool) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			info := GetConnInfo(ctx)
+			if info == nil {
+				ctx.Error("missing conn info", fasthttp.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(ctx, "%s/%s/%s/%v", info.ClientName, info.ClientVersion, info.AuthKeyID, info.TLS != nil)
+		},
+		AuthKeys: []AuthKey{
+			{ID: "foo", Secret: []byte("secret")},
+		},
+	}
+	if isTLS {
+		s.TLSConfig = newTestServerTLSConfig()
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.Name = "test-client"
+	c.Version = "1.2.3"
+	c.AuthKey = &s.AuthKeys[0]
+	if isTLS {
+		c.TLSConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectedBody := fmt.Sprintf("test-client/1.2.3/foo/%v", isTLS)
+	if string(resp.Body()) != expectedBody {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), expectedBody)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerPanicRecovery(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			switch string(ctx.Path()) {
+			case "/panic":
+				panic("foobar")
+			case "/stream":
+				ctx.SetBodyStream(bytes.NewBufferString("foobar"), -1)
+			default:
+				ctx.WriteString("ok")
+			}
+		},
+		Logger: &nilLogger{},
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	for i := 0; i < 10; i++ {
+		for _, path := range []string{"/panic", "/stream"} {
+			req.SetRequestURI("http://foobar.com" + path)
+			if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+			if resp.StatusCode() != fasthttp.StatusInternalServerError {
+				t.Fatalf("unexpected status code on iteration %d: %d. Expecting %d",
+					i, resp.StatusCode(), fasthttp.StatusInternalServerError)
+			}
+		}
+
+		// The connection must remain usable after panics.
+		req.SetRequestURI("http://foobar.com/ok")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		if string(resp.Body()) != "ok" {
+			t.Fatalf("unexpected body on iteration %d: %q. Expecting %q", i, resp.Body(), "ok")
+		}
+	}
+	if n := s.Panics(); n != 20 {
+		t.Fatalf("unexpected number of panics: %d. Expecting 20", n)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerReverseClient(t *testing.T) {
+	testServerReverseClient(t, false)
+}
+
+func TestServerReverseClientTLS(t *testing.T) {
+	testServerReverseClient(t, true)
+}
+
+func testServerReverseClient(t *testing.T, isTLS bool) {
+	rcCh := make(chan *ReverseClient, 1)
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			// Proxy the request back to the client.
+			rc := GetReverseClient(ctx)
+			if rc == nil {
+				ctx.Error("missing reverse client", fasthttp.StatusInternalServerError)
+				return
+			}
+			if err := rc.DoTimeout(&ctx.Request, &ctx.Response, time.Second); err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusBadGateway)
+			}
+		},
+		OnReverseConn: func(rc *ReverseClient) {
+			rcCh <- rc
+		},
+	}
+	if isTLS {
+		s.TLSConfig = newTestServerTLSConfig()
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	c := newTestClient(ln)
+	c.Name = "edge"
+	c.ReverseHandler = func(ctx *fasthttp.RequestCtx) {
+		fmt.Fprintf(ctx, "reverse %s", ctx.Path())
+	}
+	if isTLS {
+		c.TLSConfig = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI(fmt.Sprintf("http://foobar.com/forward/%d", i))
+		if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusOK); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		expectedBody := fmt.Sprintf("reverse /forward/%d", i)
+		if string(resp.Body()) != expectedBody {
+			t.Fatalf("unexpected body on iteration %d: %q. Expecting %q", i, resp.Body(), expectedBody)
+		}
+	}
+
+	var rc *ReverseClient
+	select {
+	case rc = <-rcCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout when waiting for reverse connection")
+	}
+	info := rc.ConnInfo()
+	if info.ClientName != "edge" {
+		t.Fatalf("unexpected client name: %q. Expecting %q", info.ClientName, "edge")
+	}
+	if isTLS != (info.TLS != nil) {
+		t.Fatalf("unexpected TLS state: %v", info.TLS)
+	}
+	err := testServerClientConcurrent(func() error {
+		for i := 0; i < 100; i++ {
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			req.SetRequestURI(fmt.Sprintf("http://foobar.com/%d", i))
+			if err := rc.DoTimeout(&req, &resp, time.Second); err != nil {
+				return err
+			}
+			expectedBody := fmt.Sprintf("reverse /%d", i)
+			if string(resp.Body()) != expectedBody {
+				return fmt.Errorf("unexpected body on iteration %d: %q. Expecting %q", i, resp.Body(), expectedBody)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := rc.Close(); err != nil {
+		t.Fatalf("cannot close reverse client: %s", err)
+	}
+	select {
+	case <-rc.Closed():
+	case <-time.After(time.Second):
+		t.Fatalf("timeout when waiting for reverse connection close")
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerReverseClientReconnect(t *testing.T) {
+	rcCh := make(chan *ReverseClient, 1)
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			rc := GetReverseClient(ctx)
+			if rc == nil {
+				ctx.Error("missing reverse client", fasthttp.StatusInternalServerError)
+				return
+			}
+			if err := rc.DoTimeout(&ctx.Request, &ctx.Response, time.Second); err != nil {
+				ctx.Error(err.Error(), fasthttp.StatusBadGateway)
+			}
+		},
+		OnReverseConn: func(rc *ReverseClient) {
+			rcCh <- rc
+		},
+	}
+	serverStop, ln := newTestServerExt(s)
+
+	connCh := make(chan net.Conn, 1)
+	disconnectedCh := make(chan struct{}, 1)
+	c := &Client{
+		Dial: func(addr string) (net.Conn, error) {
+			conn, err := ln.Dial()
+			if err == nil {
+				connCh <- conn
+			}
+			return conn, err
+		},
+		ReverseHandler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("done"))
+		},
+		OnConnStateChange: func(state ConnState, err error) {
+			if state == ConnDisconnected {
+				disconnectedCh <- struct{}{}
+			}
+		},
+	}
+
+	// Drop the connection after each request, so the client reconnects.
+	reconnect := func() error {
+		if err := testDone(c); err != nil {
+			return err
+		}
+		rc := <-rcCh
+		(<-connCh).Close()
+		select {
+		case <-rc.Closed():
+		case <-time.After(time.Second):
+			return fmt.Errorf("timeout when waiting for reverse connection close")
+		}
+		select {
+		case <-disconnectedCh:
+		case <-time.After(time.Second):
+			return fmt.Errorf("timeout when waiting for client disconnect")
+		}
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		if err := rc.DoTimeout(&req, &resp, time.Second); err != ErrReverseConnClosed {
+			return fmt.Errorf("unexpected error: %v. Expecting %v", err, ErrReverseConnClosed)
+		}
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if err := reconnect(); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+	n := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if err := reconnect(); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+
+	// Goroutines serving the closed connections must exit.
+	err := testWaitFor(func() bool { return runtime.NumGoroutine() <= n+5 })
+	if err != nil {
+		t.Fatalf("goroutines leak: %d goroutines before reconnects; %d goroutines after reconnects", n, runtime.NumGoroutine())
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerMaxRequestSize(t *testing.T) {
+	s := &Server{
+		Handler:              testPostHandler,
+		MaxRequestBodySize:   100,
+		MaxRequestHeaderSize: 200,
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	for i := 0; i < 10; i++ {
+		req.Reset()
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("http://foobar.com/aaa")
+		req.SetBody(bytes.Repeat([]byte("x"), 101))
+		if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusRequestEntityTooLarge); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+
+		req.SetBodyString("foobar")
+		req.Header.Set("X-Foo", string(bytes.Repeat([]byte("x"), 200)))
+		if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusRequestHeaderFieldsTooLarge); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+
+		// The connection must remain usable after rejected requests.
+		req.Header.Del("X-Foo")
+		if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusOK); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		if string(resp.Body()) != "foobar" {
+			t.Fatalf("unexpected body on iteration %d: %q. Expecting %q", i, resp.Body(), "foobar")
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func testDoStatusCode(c *Client, req *fasthttp.Request, resp *fasthttp.Response, expectedStatusCode int) error {
+	if err := c.DoTimeout(req, resp, time.Second); err != nil {
+		return err
+	}
+	if resp.StatusCode() != expectedStatusCode {
+		return fmt.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), expectedStatusCode)
+	}
+	return nil
+}
+
 func TestServerTimeoutErrorSerial(t *testing.T) {
 	serverStop, c := newTestServerClient(testTimeoutErrorHandler)
 
-	if err := testTimeoutError(c); err != nil {
+	if err := testTimeoutError(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerTimeoutErrorConcurrent(t *testing.T) {
+	serverStop, c := newTestServerClient(testTimeoutErrorHandler)
+
+	if err := testServerClientConcurrent(func() error { return testTimeoutError(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerTimeoutSerial(t *testing.T) {
+	stopCh := make(chan struct{})
+	h := func(ctx *fasthttp.RequestCtx) {
+		<-stopCh
+	}
+	serverStop, c := newTestServerClient(h)
+
+	if err := testTimeout(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	close(stopCh)
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerTimeoutConcurrent(t *testing.T) {
+	stopCh := make(chan struct{})
+	h := func(ctx *fasthttp.RequestCtx) {
+		<-stopCh
+	}
+	serverStop, c := newTestServerClient(h)
+
+	if err := testServerClientConcurrent(func() error { return testTimeout(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	close(stopCh)
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayRequestSerial(t *testing.T) {
+	serverStop, c := newTestServerClient(testGetHandler)
+	c.MaxBatchDelay = 10 * time.Millisecond
+
+	if err := testGetBatchDelay(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayRequestConcurrent(t *testing.T) {
+	serverStop, c := newTestServerClient(testGetHandler)
+	c.MaxBatchDelay = 10 * time.Millisecond
+
+	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayResponseSerial(t *testing.T) {
+	s := &Server{
+		Handler:       testGetHandler,
+		MaxBatchDelay: 10 * time.Millisecond,
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	if err := testGetBatchDelay(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayResponseConcurrent(t *testing.T) {
+	s := &Server{
+		Handler:       testGetHandler,
+		MaxBatchDelay: 10 * time.Millisecond,
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayRequestResponseSerial(t *testing.T) {
+	s := &Server{
+		Handler:       testGetHandler,
+		MaxBatchDelay: 10 * time.Millisecond,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.MaxBatchDelay = 10 * time.Millisecond
+
+	if err := testGetBatchDelay(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerBatchDelayRequestResponseConcurrent(t *testing.T) {
+	s := &Server{
+		Handler:       testGetHandler,
+		MaxBatchDelay: 10 * time.Millisecond,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.MaxBatchDelay = 10 * time.Millisecond
+
+	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerCompressNoneSerial(t *testing.T) {
+	testServerCompressSerial(t, CompressNone, CompressNone)
+}
+
+func TestServerCompressNoneConcurrent(t *testing.T) {
+	testServerCompressConcurrent(t, CompressNone, CompressNone)
+}
+
+func TestServerCompressFlateSerial(t *testing.T) {
+	testServerCompressSerial(t, CompressFlate, CompressFlate)
+}
+
+func TestServerCompressFlateConcurrent(t *testing.T) {
+	testServerCompressConcurrent(t, CompressFlate, CompressFlate)
+}
+
+func TestServerCompressSnappySerial(t *testing.T) {
+	testServerCompressSerial(t, CompressSnappy, CompressSnappy)
+}
+
+func TestServerCompressSnappyConcurrent(t *testing.T) {
+	testServerCompressConcurrent(t, CompressSnappy, CompressSnappy)
+}
+
+func TestServerCompressMixedSerial(t *testing.T) {
+	testServerCompressSerial(t, CompressSnappy, CompressFlate)
+	testServerCompressSerial(t, CompressNone, CompressFlate)
+	testServerCompressSerial(t, CompressFlate, CompressSnappy)
+	testServerCompressSerial(t, CompressSnappy, CompressNone)
+}
+
+func TestServerCompressMixedConcurrent(t *testing.T) {
+	testServerCompressConcurrent(t, CompressSnappy, CompressFlate)
+	testServerCompressConcurrent(t, CompressNone, CompressFlate)
+	testServerCompressConcurrent(t, CompressFlate, CompressSnappy)
+	testServerCompressConcurrent(t, CompressSnappy, CompressNone)
+}
+
+func testServerCompressSerial(t *testing.T, reqCompressType, respCompressType CompressType) {
+	s := &Server{
+		Handler:      testGetHandler,
+		CompressType: respCompressType,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.CompressType = reqCompressType
+
+	if err := testGet(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func testServerCompressConcurrent(t *testing.T, reqCompressType, respCompressType CompressType) {
+	s := &Server{
+		Handler:      testGetHandler,
+		CompressType: respCompressType,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.CompressType = reqCompressType
+
+	if err := testServerClientConcurrent(func() error { return testGet(c) }); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
@@ -112,10 +824,14 @@ func TestServerTimeoutErrorSerial(t *testing.T) {
 	}
 }
 
-func TestServerTimeoutErrorConcurrent(t *testing.T) {
-	serverStop, c := newTestServerClient(testTimeoutErrorHandler)
+func TestServerReduceMemoryUsageSerial(t *testing.T) {
+	s := &Server{
+		Handler:           testGetHandler,
+		ReduceMemoryUsage: true,
+	}
+	serverStop, c := newTestServerClientExt(s)
 
-	if err := testServerClientConcurrent(func() error { return testTimeoutError(c) }); err != nil {
+	if err := testGet(c); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
@@ -124,92 +840,445 @@ func TestServerTimeoutErrorConcurrent(t *testing.T) {
 	}
 }
 
-func TestServerTimeoutSerial(t *testing.T) {
-	stopCh := make(chan struct{})
-	h := func(ctx *fasthttp.RequestCtx) {
-		<-stopCh
+func TestServerReduceMemoryUsageConcurrent(t *testing.T) {
+	s := &Server{
+		Handler:           testGetHandler,
+		ReduceMemoryUsage: true,
 	}
-	serverStop, c := newTestServerClient(h)
+	serverStop, c := newTestServerClientExt(s)
 
-	if err := testTimeout(c); err != nil {
+	if err := testServerClientConcurrent(func() error { return testGet(c) }); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
-	close(stopCh)
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerConcurrencyLimit(t *testing.T) {
+	const concurrency = 10
+	doneCh := make(chan struct{})
+	concurrencyCh := make(chan struct{}, concurrency)
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			concurrencyCh <- struct{}{}
+			<-doneCh
+			ctx.SetBodyString("done")
+		},
+		Concurrency: concurrency,
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	// issue concurrency requests to the server.
+	resultCh := make(chan error, concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			req.SetRequestURI("http://foobar.com/baz")
+			if err := c.DoTimeout(&req, &resp, time.Hour); err != nil {
+				resultCh <- err
+				return
+			}
+			statusCode := resp.StatusCode()
+			if statusCode != fasthttp.StatusOK {
+				resultCh <- fmt.Errorf("unexpected status code: %d. Expecting %d", statusCode, fasthttp.StatusOK)
+				return
+			}
+			body := resp.Body()
+			if string(body) != "done" {
+				resultCh <- fmt.Errorf("unexpected body: %q. Expecting %q", body, "done")
+				return
+			}
+			resultCh <- nil
+		}()
+	}
+
+	// make sure the server called request handler for the issued requests
+	for i := 0; i < concurrency; i++ {
+		select {
+		case <-concurrencyCh:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+
+	// now all the requests must fail with 'concurrency limit exceeded'
+	// error.
+	for i := 0; i < 100; i++ {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://aaa.bbb/cc")
+		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		statusCode := resp.StatusCode()
+		if statusCode != fasthttp.StatusTooManyRequests {
+			t.Fatalf("unexpected status code on iteration %d: %d. Expecting %d", i, statusCode, fasthttp.StatusTooManyRequests)
+		}
+	}
+
+	// unblock requests to the server.
+	close(doneCh)
+	for i := 0; i < concurrency; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerTimeoutConcurrent(t *testing.T) {
-	stopCh := make(chan struct{})
-	h := func(ctx *fasthttp.RequestCtx) {
-		<-stopCh
+func TestServerMaxBufferedBytes(t *testing.T) {
+	const requests = 5
+	doneCh := make(chan struct{})
+	handlerCh := make(chan struct{}, requests)
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			handlerCh <- struct{}{}
+			<-doneCh
+			ctx.SetBody(ctx.Request.Body())
+		},
+		MaxBufferedBytes: 250,
 	}
-	serverStop, c := newTestServerClient(h)
+	serverStop, c := newTestServerClientExt(s)
 
-	if err := testServerClientConcurrent(func() error { return testTimeout(c) }); err != nil {
+	body := bytes.Repeat([]byte("x"), 100)
+	resultCh := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			var req fasthttp.Request
+			var resp fasthttp.Response
+			req.Header.SetMethod("POST")
+			req.SetRequestURI("http://foobar.com/baz")
+			req.SetBody(body)
+			if err := c.DoTimeout(&req, &resp, time.Hour); err != nil {
+				resultCh <- err
+				return
+			}
+			if !bytes.Equal(resp.Body(), body) {
+				resultCh <- fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), body)
+				return
+			}
+			resultCh <- nil
+		}()
+	}
+
+	// Only two requests fit the budget.
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handlerCh:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+	select {
+	case <-handlerCh:
+		t.Fatalf("the request mustn't be read when the budget is exhausted")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if n := s.BufferedBytes(); n != 200 {
+		t.Fatalf("unexpected number of buffered bytes: %d. Expecting %d", n, 200)
+	}
+
+	close(doneCh)
+	for i := 0; i < requests; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+
+	// The budget is released after the responses are written,
+	// so wait for a while.
+	deadline := time.Now().Add(time.Second)
+	for s.BufferedBytes() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected number of buffered bytes: %d. Expecting 0", s.BufferedBytes())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerQueue(t *testing.T) {
+	s := &Server{
+		Concurrency:  2,
+		MaxQueueSize: 3,
+		ConcurrencyLimitHandler: func(ctx *fasthttp.RequestCtx, concurrency int) {
+			ctx.Error(fmt.Sprintf("busy %d", concurrency), fasthttp.StatusServiceUnavailable)
+		},
+	}
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c := newTestClient(ln)
+
+	resultCh := testQuotaRequests(c, 2)
+	testQuotaHandlers(t, handlerCh, 2)
+
+	// Requests must be queued instead of rejected.
+	queuedCh := testQuotaRequests(c, 3)
+	testQuotaHandlers(t, handlerCh, 0)
+
+	// The queue is full, so the request must be rejected.
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/fast")
+	if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusServiceUnavailable); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	if string(resp.Body()) != "busy 2" {
+		t.Fatalf("unexpected body: %q. Expecting %q", resp.Body(), "busy 2")
+	}
 
-	close(stopCh)
+	close(doneCh)
+	testQuotaResults(t, resultCh, 2)
+	testQuotaResults(t, queuedCh, 3)
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerBatchDelayRequestSerial(t *testing.T) {
-	serverStop, c := newTestServerClient(testGetHandler)
-	c.MaxBatchDelay = 10 * time.Millisecond
+func TestServerQueueTimeout(t *testing.T) {
+	s := &Server{
+		Concurrency:  1,
+		MaxQueueSize: 10,
+		QueueTimeout: 50 * time.Millisecond,
+	}
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c := newTestClient(ln)
 
-	if err := testGetBatchDelay(c); err != nil {
+	resultCh := testQuotaRequests(c, 1)
+	testQuotaHandlers(t, handlerCh, 1)
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/fast")
+	startTime := time.Now()
+	if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusTooManyRequests); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	if d := time.Since(startTime); d < s.QueueTimeout {
+		t.Fatalf("the request must wait in the queue for at least %s; waited for %s", s.QueueTimeout, d)
+	}
+
+	close(doneCh)
+	testQuotaResults(t, resultCh, 1)
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerBatchDelayRequestConcurrent(t *testing.T) {
-	serverStop, c := newTestServerClient(testGetHandler)
-	c.MaxBatchDelay = 10 * time.Millisecond
+func TestServerDeferResponse(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			dr := DeferResponse(ctx, time.Second)
+			if dr == nil {
+				ctx.Error("cannot defer response", fasthttp.StatusInternalServerError)
+				return
+			}
+			go func() {
+				time.Sleep(time.Millisecond)
+				ctx.SetBody(ctx.Request.Body())
+				dr.Done()
+			}()
+		},
 
-	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
+		// Deferred responses mustn't occupy Concurrency slots.
+		Concurrency:          1,
+		MaxDeferredResponses: 100,
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	if err := testServerClientConcurrent(func() error { return testPost(c) }); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerDeferResponseAsync(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			dr := DeferResponse(ctx, time.Second)
+			if dr == nil {
+				ctx.Error("cannot defer response", fasthttp.StatusInternalServerError)
+				return
+			}
+			go func() {
+				time.Sleep(time.Millisecond)
+				ctx.SetBody(ctx.Request.Body())
+				dr.Done()
+			}()
+		},
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	const requests = 100
+	resultCh := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		req := &fasthttp.Request{}
+		resp := &fasthttp.Response{}
+		body := fmt.Sprintf("request %d", i)
+		req.Header.SetMethod("POST")
+		req.SetRequestURI("http://foobar.com/aaa")
+		req.SetBodyString(body)
+		c.DoAsync(req, resp, time.Now().Add(time.Second), func(err error) {
+			if err == nil && string(resp.Body()) != body {
+				err = fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), body)
+			}
+			resultCh <- err
+		})
+	}
+	for i := 0; i < requests; i++ {
+		select {
+		case err := <-resultCh:
+			if err != nil {
+				t.Fatalf("unexpected error on iteration %d: %s", i, err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout on iteration %d", i)
+		}
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestServerDeferResponseTimeout(t *testing.T) {
+	doneCh := make(chan bool, 1)
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			dr := DeferResponse(ctx, 20*time.Millisecond)
+			go func() {
+				time.Sleep(100 * time.Millisecond)
+				ctx.SetBodyString("too late")
+				doneCh <- dr.Done()
+			}()
+		},
+	}
+	serverStop, c := newTestServerClientExt(s)
+
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if err := testDoStatusCode(c, &req, &resp, fasthttp.StatusGatewayTimeout); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	select {
+	case ok := <-doneCh:
+		if ok {
+			t.Fatalf("Done must return false after timeout")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerBatchDelayResponseSerial(t *testing.T) {
+func TestServerDeferResponseReleasesHandler(t *testing.T) {
+	doneCh := make(chan struct{})
+	deferredCh := make(chan struct{})
 	s := &Server{
-		Handler:       testGetHandler,
-		MaxBatchDelay: 10 * time.Millisecond,
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			if string(ctx.Path()) != "/deferred" {
+				ctx.Success("text/plain", []byte("done"))
+				return
+			}
+			dr := DeferResponse(ctx, 10*time.Second)
+			if dr == nil {
+				ctx.Error("cannot defer response", fasthttp.StatusInternalServerError)
+				return
+			}
+			go func() {
+				<-doneCh
+				ctx.SetBodyString("deferred")
+				dr.Done()
+			}()
+			close(deferredCh)
+		},
+		Concurrency:          1,
+		MaxDeferredResponses: 1,
 	}
 	serverStop, c := newTestServerClientExt(s)
 
-	if err := testGetBatchDelay(c); err != nil {
+	resultCh := make(chan error, 1)
+	go func() {
+		var req fasthttp.Request
+		var resp fasthttp.Response
+		req.SetRequestURI("http://foobar.com/deferred")
+		err := c.DoTimeout(&req, &resp, 10*time.Second)
+		if err == nil && string(resp.Body()) != "deferred" {
+			err = fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "deferred")
+		}
+		resultCh <- err
+	}()
+	select {
+	case <-deferredCh:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The deferred response mustn't occupy the only Handler slot.
+	if err := testDone(c); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	if n := s.Stats().Running; n != 0 {
+		t.Fatalf("unexpected number of running handlers: %d. Expecting 0", n)
+	}
+
+	close(doneCh)
+	select {
+	case err := <-resultCh:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerBatchDelayResponseConcurrent(t *testing.T) {
+func TestServerDeferResponsePipelineRequests(t *testing.T) {
 	s := &Server{
-		Handler:       testGetHandler,
-		MaxBatchDelay: 10 * time.Millisecond,
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			if dr := DeferResponse(ctx, time.Second); dr != nil {
+				ctx.Error("the response mustn't be deferred", fasthttp.StatusInternalServerError)
+				dr.Done()
+				return
+			}
+			ctx.Success("text/plain", []byte("done"))
+		},
+		PipelineRequests: true,
 	}
 	serverStop, c := newTestServerClientExt(s)
 
-	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
+	if err := testDone(c); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
@@ -218,223 +1287,383 @@ func TestServerBatchDelayResponseConcurrent(t *testing.T) {
 	}
 }
 
-func TestServerBatchDelayRequestResponseSerial(t *testing.T) {
+func TestServerMaxConcurrencyPerConn(t *testing.T) {
 	s := &Server{
-		Handler:       testGetHandler,
-		MaxBatchDelay: 10 * time.Millisecond,
+		MaxConcurrencyPerConn: 2,
 	}
-	serverStop, c := newTestServerClientExt(s)
-	c.MaxBatchDelay = 10 * time.Millisecond
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c1 := newTestClient(ln)
+	c2 := newTestClient(ln)
 
-	if err := testGetBatchDelay(c); err != nil {
+	resultCh := testQuotaRequests(c1, 5)
+	testQuotaHandlers(t, handlerCh, 2)
+
+	// Requests from other connections must be processed.
+	if err := testQuotaFastRequest(c2); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	testQuotaHandlers(t, handlerCh, 0)
+
+	close(doneCh)
+	testQuotaResults(t, resultCh, 5)
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerBatchDelayRequestResponseConcurrent(t *testing.T) {
+func TestServerMaxConcurrencyPerClient(t *testing.T) {
 	s := &Server{
-		Handler:       testGetHandler,
-		MaxBatchDelay: 10 * time.Millisecond,
+		MaxConcurrencyPerClient: 3,
 	}
-	serverStop, c := newTestServerClientExt(s)
-	c.MaxBatchDelay = 10 * time.Millisecond
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c1 := newTestClient(ln)
+	c2 := newTestClient(ln)
 
-	if err := testServerClientConcurrent(func() error { return testGetBatchDelay(c) }); err != nil {
-		t.Fatalf("unexpected error: %s", err)
-	}
+	// All the in-memory connections belong to the same client.
+	resultCh1 := testQuotaRequests(c1, 3)
+	resultCh2 := testQuotaRequests(c2, 3)
+	testQuotaHandlers(t, handlerCh, 3)
+
+	close(doneCh)
+	testQuotaResults(t, resultCh1, 3)
+	testQuotaResults(t, resultCh2, 3)
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerCompressNoneSerial(t *testing.T) {
-	testServerCompressSerial(t, CompressNone, CompressNone)
-}
-
-func TestServerCompressNoneConcurrent(t *testing.T) {
-	testServerCompressConcurrent(t, CompressNone, CompressNone)
-}
+func TestServerFairConcurrency(t *testing.T) {
+	s := &Server{
+		Concurrency:     4,
+		FairConcurrency: true,
+	}
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c1 := newTestClient(ln)
+	c2 := newTestClient(ln)
 
-func TestServerCompressFlateSerial(t *testing.T) {
-	testServerCompressSerial(t, CompressFlate, CompressFlate)
-}
+	// The busy connection mustn't occupy all the handler slots.
+	resultCh := testQuotaRequests(c1, 10)
+	testQuotaHandlers(t, handlerCh, 2)
 
-func TestServerCompressFlateConcurrent(t *testing.T) {
-	testServerCompressConcurrent(t, CompressFlate, CompressFlate)
-}
+	// Requests from other connections mustn't be rejected.
+	for i := 0; i < 10; i++ {
+		if err := testQuotaFastRequest(c2); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
 
-func TestServerCompressSnappySerial(t *testing.T) {
-	testServerCompressSerial(t, CompressSnappy, CompressSnappy)
-}
+	close(doneCh)
+	testQuotaResults(t, resultCh, 10)
 
-func TestServerCompressSnappyConcurrent(t *testing.T) {
-	testServerCompressConcurrent(t, CompressSnappy, CompressSnappy)
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
 }
 
-func TestServerCompressMixedSerial(t *testing.T) {
-	testServerCompressSerial(t, CompressSnappy, CompressFlate)
-	testServerCompressSerial(t, CompressNone, CompressFlate)
-	testServerCompressSerial(t, CompressFlate, CompressSnappy)
-	testServerCompressSerial(t, CompressSnappy, CompressNone)
-}
+func TestServerDrain(t *testing.T) {
+	s1 := &Server{}
+	serverStop1, ln1, doneCh, handlerCh := newTestQuotaServer(s1)
+	serverStop2, ln2 := newTestServer(func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
+	})
+	var dials2 uint32
+	c := &Client{
+		Addr: "server1",
+		Dial: func(addr string) (net.Conn, error) {
+			switch addr {
+			case "server1":
+				return ln1.Dial()
+			case "server2":
+				atomic.AddUint32(&dials2, 1)
+				return ln2.Dial()
+			default:
+				return nil, fmt.Errorf("unexpected addr %q", addr)
+			}
+		},
+	}
 
-func TestServerCompressMixedConcurrent(t *testing.T) {
-	testServerCompressConcurrent(t, CompressSnappy, CompressFlate)
-	testServerCompressConcurrent(t, CompressNone, CompressFlate)
-	testServerCompressConcurrent(t, CompressFlate, CompressSnappy)
-	testServerCompressConcurrent(t, CompressSnappy, CompressNone)
-}
+	resultCh := testQuotaRequests(c, 1)
+	testQuotaHandlers(t, handlerCh, 1)
 
-func testServerCompressSerial(t *testing.T, reqCompressType, respCompressType CompressType) {
-	s := &Server{
-		Handler:      testGetHandler,
-		CompressType: respCompressType,
+	// The client is notified about drain in the response.
+	s1.Drain("server2")
+	if err := testDone(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := c.Drains(); n != 1 {
+		t.Fatalf("unexpected number of drains: %d. Expecting 1", n)
 	}
-	serverStop, c := newTestServerClientExt(s)
-	c.CompressType = reqCompressType
 
-	if err := testGet(c); err != nil {
-		t.Fatalf("unexpected error: %s", err)
+	// New requests must be sent to the new address without waiting
+	// for outstanding requests on the draining connection.
+	for i := 0; i < 5; i++ {
+		if err := testDone(c); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+	if n := atomic.LoadUint32(&dials2); n != 1 {
+		t.Fatalf("unexpected number of dials to the new address: %d. Expecting 1", n)
+	}
+	select {
+	case err := <-resultCh:
+		t.Fatalf("unexpected completion of the outstanding request: %v", err)
+	default:
 	}
 
-	if err := serverStop(); err != nil {
+	// The outstanding request must be completed over the draining connection.
+	close(doneCh)
+	testQuotaResults(t, resultCh, 1)
+
+	if err := serverStop1(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+	if err := serverStop2(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func testServerCompressConcurrent(t *testing.T, reqCompressType, respCompressType CompressType) {
+func TestServerDrainRedirectUnavailable(t *testing.T) {
 	s := &Server{
-		Handler:      testGetHandler,
-		CompressType: respCompressType,
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("done"))
+		},
 	}
-	serverStop, c := newTestServerClientExt(s)
-	c.CompressType = reqCompressType
-
-	if err := testServerClientConcurrent(func() error { return testGet(c) }); err != nil {
+	serverStop, ln := newTestServerExt(s)
+	var dials1, dials2 uint32
+	c := &Client{
+		Addr: "server1",
+		Dial: func(addr string) (net.Conn, error) {
+			switch addr {
+			case "server1":
+				atomic.AddUint32(&dials1, 1)
+				return ln.Dial()
+			case "server2":
+				atomic.AddUint32(&dials2, 1)
+				return nil, fmt.Errorf("server2 is unavailable")
+			default:
+				return nil, fmt.Errorf("unexpected addr %q", addr)
+			}
+		},
+	}
+	if err := testDone(c); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
 
+	// The client must fall back to Client.Addr if the drain address
+	// cannot be dialed.
+	s.Drain("server2")
+	for i := 0; i < 3; i++ {
+		if err := testDone(c); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+	if n := atomic.LoadUint32(&dials2); n != 1 {
+		t.Fatalf("unexpected number of dials to server2: %d. Expecting 1", n)
+	}
+	if n := atomic.LoadUint32(&dials1); n != 2 {
+		t.Fatalf("unexpected number of dials to server1: %d. Expecting 2", n)
+	}
+
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerReduceMemoryUsageSerial(t *testing.T) {
-	s := &Server{
-		Handler:           testGetHandler,
-		ReduceMemoryUsage: true,
+func TestServerDrainReconnect(t *testing.T) {
+	handler := func(ctx *fasthttp.RequestCtx) {
+		ctx.Success("text/plain", []byte("done"))
 	}
-	serverStop, c := newTestServerClientExt(s)
-
-	if err := testGet(c); err != nil {
-		t.Fatalf("unexpected error: %s", err)
+	s1 := &Server{
+		Handler: handler,
 	}
+	s2 := &Server{
+		Handler: handler,
+	}
+	serverStop1, ln1 := newTestServerExt(s1)
+	serverStop2, ln2 := newTestServerExt(s2)
+	var dials1, dials2 uint32
+	c := &Client{
+		Addr: "server1",
+		Dial: func(addr string) (net.Conn, error) {
+			switch addr {
+			case "server1":
+				atomic.AddUint32(&dials1, 1)
+				return ln1.Dial()
+			case "server2":
+				atomic.AddUint32(&dials2, 1)
+				return ln2.Dial()
+			default:
+				return nil, fmt.Errorf("unexpected addr %q", addr)
+			}
+		},
+	}
+	f := func(expectedDrains, expectedDials1, expectedDials2 uint32) {
+		t.Helper()
+		for i := 0; i < 3; i++ {
+			if err := testDone(c); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		}
+		if n := c.Drains(); n != uint64(expectedDrains) {
+			t.Fatalf("unexpected number of drains: %d. Expecting %d", n, expectedDrains)
+		}
+		if n := atomic.LoadUint32(&dials1); n != expectedDials1 {
+			t.Fatalf("unexpected number of dials to server1: %d. Expecting %d", n, expectedDials1)
+		}
+		if n := atomic.LoadUint32(&dials2); n != expectedDials2 {
+			t.Fatalf("unexpected number of dials to server2: %d. Expecting %d", n, expectedDials2)
+		}
+	}
+	f(0, 1, 0)
 
-	if err := serverStop(); err != nil {
+	s1.Drain("server2")
+	f(1, 1, 1)
+
+	// Empty drain address must reset the address from the previous drain.
+	s2.Drain("")
+	f(2, 2, 1)
+
+	// The connection accepted after Drain call mustn't be drained.
+	f(2, 2, 1)
+
+	// The connection must be drained on the next Drain call.
+	s1.CancelDrain()
+	f(2, 2, 1)
+	s1.Drain("")
+	f(3, 3, 1)
+
+	if err := serverStop1(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+	if err := serverStop2(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerReduceMemoryUsageConcurrent(t *testing.T) {
+func TestServerSendLoad(t *testing.T) {
 	s := &Server{
-		Handler:           testGetHandler,
-		ReduceMemoryUsage: true,
+		Concurrency: 10,
+		SendLoad:    true,
 	}
-	serverStop, c := newTestServerClientExt(s)
+	serverStop, ln, doneCh, handlerCh := newTestQuotaServer(s)
+	c := newTestClient(ln)
 
-	if err := testServerClientConcurrent(func() error { return testGet(c) }); err != nil {
+	if load := c.ServerLoad(); load != (ServerLoad{}) {
+		t.Fatalf("unexpected load before responses: %+v", load)
+	}
+
+	resultCh := testQuotaRequests(c, 3)
+	testQuotaHandlers(t, handlerCh, 3)
+	if err := testDone(c); err != nil {
 		t.Fatalf("unexpected error: %s", err)
 	}
+	load := c.ServerLoad()
+	expectedLoad := ServerLoad{
+		Running:     3,
+		Concurrency: 10,
+	}
+	if load != expectedLoad {
+		t.Fatalf("unexpected load: %+v. Expecting %+v", load, expectedLoad)
+	}
+	if u := load.Utilization(); u != 0.3 {
+		t.Fatalf("unexpected utilization: %v. Expecting 0.3", u)
+	}
+
+	close(doneCh)
+	testQuotaResults(t, resultCh, 3)
 
 	if err := serverStop(); err != nil {
 		t.Fatalf("cannot shutdown server: %s", err)
 	}
 }
 
-func TestServerConcurrencyLimit(t *testing.T) {
-	const concurrency = 10
+// newTestQuotaServer starts s with a handler, which blocks requests
+// to /block until doneCh is closed.
+func newTestQuotaServer(s *Server) (func() error, *fasthttputil.InmemoryListener, chan struct{}, chan struct{}) {
 	doneCh := make(chan struct{})
-	concurrencyCh := make(chan struct{}, concurrency)
-	s := &Server{
-		Handler: func(ctx *fasthttp.RequestCtx) {
-			concurrencyCh <- struct{}{}
+	handlerCh := make(chan struct{}, 100)
+	s.Handler = func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/block" {
+			handlerCh <- struct{}{}
 			<-doneCh
-			ctx.SetBodyString("done")
-		},
-		Concurrency: concurrency,
+		}
+		ctx.SetBodyString("done")
 	}
-	serverStop, c := newTestServerClientExt(s)
+	serverStop, ln := newTestServerExt(s)
+	return serverStop, ln, doneCh, handlerCh
+}
 
-	// issue concurrency requests to the server.
-	resultCh := make(chan error, concurrency)
-	for i := 0; i < concurrency; i++ {
+func testQuotaRequests(c *Client, n int) <-chan error {
+	resultCh := make(chan error, n)
+	for i := 0; i < n; i++ {
 		go func() {
 			var req fasthttp.Request
 			var resp fasthttp.Response
-			req.SetRequestURI("http://foobar.com/baz")
-			if err := c.DoTimeout(&req, &resp, time.Hour); err != nil {
-				resultCh <- err
-				return
-			}
-			statusCode := resp.StatusCode()
-			if statusCode != fasthttp.StatusOK {
-				resultCh <- fmt.Errorf("unexpected status code: %d. Expecting %d", statusCode, fasthttp.StatusOK)
-				return
-			}
-			body := resp.Body()
-			if string(body) != "done" {
-				resultCh <- fmt.Errorf("unexpected body: %q. Expecting %q", body, "done")
-				return
-			}
-			resultCh <- nil
+			req.SetRequestURI("http://foobar.com/block")
+			resultCh <- testDoDone(c, &req, &resp, time.Hour)
 		}()
 	}
+	return resultCh
+}
 
-	// make sure the server called request handler for the issued requests
-	for i := 0; i < concurrency; i++ {
+func testQuotaFastRequest(c *Client) error {
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/fast")
+	return testDoDone(c, &req, &resp, time.Second)
+}
+
+// testDone sends a request to the server responding with "done".
+func testDone(c *Client) error {
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	return testDoDone(c, &req, &resp, time.Second)
+}
+
+// testDoDone sends req and verifies the server responded with "done".
+func testDoDone(c *Client, req *fasthttp.Request, resp *fasthttp.Response, timeout time.Duration) error {
+	if err := c.DoTimeout(req, resp, timeout); err != nil {
+		return err
+	}
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return fmt.Errorf("unexpected status code: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusOK)
+	}
+	if string(resp.Body()) != "done" {
+		return fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "done")
+	}
+	return nil
+}
+
+// testQuotaHandlers makes sure exactly n handlers are started.
+func testQuotaHandlers(t *testing.T, handlerCh <-chan struct{}, n int) {
+	for i := 0; i < n; i++ {
 		select {
-		case <-concurrencyCh:
+		case <-handlerCh:
 		case <-time.After(3 * time.Second):
 			t.Fatalf("timeout on iteration %d", i)
 		}
 	}
-
-	// now all the requests must fail with 'concurrency limit exceeded'
-	// error.
-	for i := 0; i < 100; i++ {
-		var req fasthttp.Request
-		var resp fasthttp.Response
-		req.SetRequestURI("http://aaa.bbb/cc")
-		if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
-			t.Fatalf("unexpected error on iteration %d: %s", i, err)
-		}
-		statusCode := resp.StatusCode()
-		if statusCode != fasthttp.StatusTooManyRequests {
-			t.Fatalf("unexpected status code on iteration %d: %d. Expecting %d", i, statusCode, fasthttp.StatusTooManyRequests)
-		}
+	select {
+	case <-handlerCh:
+		t.Fatalf("unexpected handler call exceeding %d handlers", n)
+	case <-time.After(100 * time.Millisecond):
 	}
+}
 
-	// unblock requests to the server.
-	close(doneCh)
-	for i := 0; i < concurrency; i++ {
+func testQuotaResults(t *testing.T, resultCh <-chan error, n int) {
+	for i := 0; i < n; i++ {
 		select {
 		case err := <-resultCh:
 			if err != nil {
 				t.Fatalf("unexpected error on iteration %d: %s", i, err)
 			}
-		case <-time.After(time.Second):
+		case <-time.After(3 * time.Second):
 			t.Fatalf("timeout on iteration %d", i)
 		}
 	}
-
-	if err := serverStop(); err != nil {
-		t.Fatalf("cannot shutdown server: %s", err)
-	}
 }
 
 func TestServerGetSerial(t *testing.T) {
@@ -737,6 +1966,18 @@ func newTestClient(ln *fasthttputil.InmemoryListener) *Client {
 	}
 }
 
+// testWaitFor waits until f returns true.
+func testWaitFor(f func() bool) error {
+	deadline := time.Now().Add(3 * time.Second)
+	for !f() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
 var testTimeoutErrorHandler = fasthttp.TimeoutHandler(func(ctx *fasthttp.RequestCtx) {
 	time.Sleep(10 * time.Millisecond)
 	ctx.WriteString("this should be ignored due to timeout")
@@ -0,0 +1,436 @@
+package httpteleport
+
+import (
+	"github.com/valyala/fasthttp"
+	"sync/atomic"
+	"time"
+)
+
+// ClientStats contains Client statistics.
+//
+// Counters are accumulated since the Client start.
+type ClientStats struct {
+	// Requests is the number of DoDeadline calls.
+	Requests uint64
+
+	// Responses is the number of successfully received responses.
+	Responses uint64
+
+	// Timeouts is the number of requests failed with ErrTimeout.
+	Timeouts uint64
+
+	// PendingRequestsOverflows is the number of requests failed
+	// with ErrPendingRequestsOverflow.
+	PendingRequestsOverflows uint64
+
+	// ResponsesTooLarge is the number of requests failed with
+	// ErrResponseBodyTooLarge or ErrResponseHeaderTooLarge.
+	ResponsesTooLarge uint64
+
+	// OtherErrors is the number of requests failed with other errors.
+	OtherErrors uint64
+
+	// BytesWritten is the number of bytes written to connections
+	// after compression.
+	BytesWritten uint64
+
+	// BytesRead is the number of bytes read from connections
+	// before decompression.
+	BytesRead uint64
+
+	// UncompressedBytesWritten is the number of bytes in sent requests
+	// before compression.
+	UncompressedBytesWritten uint64
+
+	// UncompressedBytesRead is the number of bytes in received responses
+	// after decompression.
+	UncompressedBytesRead uint64
+
+	// BatchesFlushed is the number of flushed batches containing
+	// at least one request.
+	//
+	// Requests are batched according to Client.MaxBatchDelay.
+	// A batch is counted on the first write to the connection after
+	// the requests have been buffered. So a batch exceeding
+	// WriteBufferSize may be counted multiple times. Pings aren't counted.
+	BatchesFlushed uint64
+
+	// BatchedRequests is the number of requests in flushed batches.
+	BatchedRequests uint64
+
+	// Dials is the number of attempts to establish connection
+	// to the server.
+	Dials uint64
+
+	// DialErrors is the number of failed attempts to establish
+	// connection to the server.
+	DialErrors uint64
+
+	// Reconnects is the number of connections established after
+	// the first connection.
+	Reconnects uint64
+
+	// PendingRequests is the number of pending requests at the moment.
+	PendingRequests int
+
+	// RTT is the round-trip time measured by the last ping.
+	//
+	// See Client.PingInterval for details.
+	RTT time.Duration
+
+	// Latency is the histogram of DoDeadline durations
+	// for all the requests including failed ones.
+	Latency Histogram
+}
+
+// AvgBatchSize returns the average number of requests per flushed batch.
+//
+// Requests failed before being written to the connection aren't counted.
+func (s *ClientStats) AvgBatchSize() float64 {
+	return avgBatchSize(s.BatchedRequests, s.BatchesFlushed)
+}
+
+// ServerStats contains Server statistics.
+//
+// Counters are accumulated since the Server start.
+type ServerStats struct {
+	// Conns is the number of accepted connections.
+	Conns uint64
+
+	// HandshakeErrors is the number of connections closed
+	// due to handshake errors.
+	HandshakeErrors uint64
+
+	// Requests is the number of read requests.
+	Requests uint64
+
+	// Responses is the number of written responses.
+	Responses uint64
+
+	// ConcurrencyLimitErrors is the number of requests rejected due
+	// to Concurrency limit.
+	ConcurrencyLimitErrors uint64
+
+	// QueueTimeouts is the number of requests rejected due to QueueTimeout.
+	QueueTimeouts uint64
+
+	// RequestsTooLarge is the number of requests rejected due to
+	// MaxRequestBodySize or MaxRequestHeaderSize limits.
+	RequestsTooLarge uint64
+
+	// HandlerTimeouts is the number of requests timed out
+	// via fasthttp.TimeoutHandler or RequestCtx.TimeoutError.
+	HandlerTimeouts uint64
+
+	// DeferredTimeouts is the number of timed out deferred responses.
+	DeferredTimeouts uint64
+
+	// Panics is the number of panics recovered in Handler.
+	Panics uint64
+
+	// BytesWritten is the number of bytes written to connections
+	// after compression.
+	BytesWritten uint64
+
+	// BytesRead is the number of bytes read from connections
+	// before decompression.
+	BytesRead uint64
+
+	// UncompressedBytesWritten is the number of bytes in sent responses
+	// before compression.
+	UncompressedBytesWritten uint64
+
+	// UncompressedBytesRead is the number of bytes in received requests
+	// after decompression.
+	UncompressedBytesRead uint64
+
+	// BatchesFlushed is the number of flushed batches containing
+	// at least one http response.
+	//
+	// Responses are batched according to Server.MaxBatchDelay.
+	// A batch is counted on the first write to the connection after
+	// the responses have been buffered. So a batch exceeding
+	// WriteBufferSize may be counted multiple times. Pings aren't counted.
+	BatchesFlushed uint64
+
+	// BatchedResponses is the number of http responses in flushed batches.
+	BatchedResponses uint64
+
+	// OpenConns is the number of open connections at the moment.
+	OpenConns int
+
+	// Running is the number of running Handler calls at the moment.
+	Running int
+
+	// Queued is the number of requests waiting for free Handler slot
+	// at the moment.
+	Queued int
+
+	// Latency is the histogram of durations since reading the request
+	// till writing the response. It includes the time spent
+	// in the queue and in the Handler.
+	Latency Histogram
+
+	// BufferedBytes is the number of buffered bytes at the moment.
+	//
+	// See MaxBufferedBytes for details.
+	BufferedBytes int64
+}
+
+// AvgBatchSize returns the average number of responses per flushed batch.
+func (s *ServerStats) AvgBatchSize() float64 {
+	return avgBatchSize(s.BatchedResponses, s.BatchesFlushed)
+}
+
+func avgBatchSize(n, batches uint64) float64 {
+	if batches == 0 {
+		return 0
+	}
+	return float64(n) / float64(batches)
+}
+
+// LatencyBuckets contains upper bounds for Histogram buckets.
+//
+// The slice must not be modified.
+var LatencyBuckets = latencyBuckets[:]
+
+var latencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	2 * time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	20 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	200 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram is a cumulative histogram of durations.
+type Histogram struct {
+	// Counts contains the number of durations not exceeding
+	// the corresponding bound from LatencyBuckets.
+	Counts []uint64
+
+	// Count is the total number of durations.
+	Count uint64
+
+	// Sum is the sum of all the durations.
+	Sum time.Duration
+}
+
+// LatencyHistogram collects durations into LatencyBuckets.
+//
+// It may be used for collecting custom durations, which are exported
+// alongside Client and Server statistics. The zero value is ready to use.
+//
+// It is safe calling LatencyHistogram methods from concurrently
+// running goroutines.
+type LatencyHistogram struct {
+	// The last item counts durations exceeding all the buckets.
+	counts [len(latencyBuckets) + 1]uint64
+	sum    int64
+}
+
+// Add adds d to the histogram.
+func (h *LatencyHistogram) Add(d time.Duration) {
+	n := len(latencyBuckets)
+	for i, b := range latencyBuckets {
+		if d <= b {
+			n = i
+			break
+		}
+	}
+	atomic.AddUint64(&h.counts[n], 1)
+	atomic.AddInt64(&h.sum, int64(d))
+}
+
+// Histogram returns a snapshot of the histogram.
+func (h *LatencyHistogram) Histogram() Histogram {
+	var count uint64
+	counts := make([]uint64, len(latencyBuckets))
+	for i := range h.counts {
+		count += atomic.LoadUint64(&h.counts[i])
+		if i < len(counts) {
+			counts[i] = count
+		}
+	}
+	return Histogram{
+		Counts: counts,
+		Count:  count,
+		Sum:    time.Duration(atomic.LoadInt64(&h.sum)),
+	}
+}
+
+// connCounters contains byte counters shared by client and server
+// connections.
+type connCounters struct {
+	bytesWritten             uint64
+	bytesRead                uint64
+	uncompressedBytesWritten uint64
+	uncompressedBytesRead    uint64
+	batchesFlushed           uint64
+	batchedMessages          uint64
+}
+
+// addWritten accounts n bytes written to the connection.
+//
+// unflushed must point to the number of http messages buffered
+// for the connection since the previous write.
+func (cs *connCounters) addWritten(n int, unflushed *uint64) {
+	atomic.AddUint64(&cs.bytesWritten, uint64(n))
+	if k := atomic.SwapUint64(unflushed, 0); k > 0 {
+		atomic.AddUint64(&cs.batchesFlushed, 1)
+		atomic.AddUint64(&cs.batchedMessages, k)
+	}
+}
+
+func (cs *connCounters) addRead(n int) {
+	atomic.AddUint64(&cs.bytesRead, uint64(n))
+}
+
+type clientCounters struct {
+	connCounters
+
+	// unflushed is the number of requests buffered since the last write
+	// to the connection.
+	unflushed uint64
+
+	requests                 uint64
+	responses                uint64
+	timeouts                 uint64
+	pendingRequestsOverflows uint64
+	responsesTooLarge        uint64
+	otherErrors              uint64
+	dials                    uint64
+	dialErrors               uint64
+	reconnects               uint64
+	connected                uint32
+	latency                  LatencyHistogram
+}
+
+func (cs *clientCounters) addResult(err error, d time.Duration) {
+	atomic.AddUint64(&cs.requests, 1)
+	cs.latency.Add(d)
+	switch err {
+	case nil:
+		atomic.AddUint64(&cs.responses, 1)
+	case ErrTimeout:
+		atomic.AddUint64(&cs.timeouts, 1)
+	case ErrPendingRequestsOverflow:
+		atomic.AddUint64(&cs.pendingRequestsOverflows, 1)
+	case ErrResponseBodyTooLarge, ErrResponseHeaderTooLarge:
+		atomic.AddUint64(&cs.responsesTooLarge, 1)
+	default:
+		atomic.AddUint64(&cs.otherErrors, 1)
+	}
+}
+
+func (cs *clientCounters) addDial(err error) {
+	atomic.AddUint64(&cs.dials, 1)
+	if err != nil {
+		atomic.AddUint64(&cs.dialErrors, 1)
+		return
+	}
+	if !atomic.CompareAndSwapUint32(&cs.connected, 0, 1) {
+		atomic.AddUint64(&cs.reconnects, 1)
+	}
+}
+
+// Stats returns the client statistics.
+func (c *Client) Stats() ClientStats {
+	cs := &c.stats
+	return ClientStats{
+		Requests:                 atomic.LoadUint64(&cs.requests),
+		Responses:                atomic.LoadUint64(&cs.responses),
+		Timeouts:                 atomic.LoadUint64(&cs.timeouts),
+		PendingRequestsOverflows: atomic.LoadUint64(&cs.pendingRequestsOverflows),
+		ResponsesTooLarge:        atomic.LoadUint64(&cs.responsesTooLarge),
+		OtherErrors:              atomic.LoadUint64(&cs.otherErrors),
+		BytesWritten:             atomic.LoadUint64(&cs.bytesWritten),
+		BytesRead:                atomic.LoadUint64(&cs.bytesRead),
+		UncompressedBytesWritten: atomic.LoadUint64(&cs.uncompressedBytesWritten),
+		UncompressedBytesRead:    atomic.LoadUint64(&cs.uncompressedBytesRead),
+		BatchesFlushed:           atomic.LoadUint64(&cs.batchesFlushed),
+		BatchedRequests:          atomic.LoadUint64(&cs.batchedMessages),
+		Dials:                    atomic.LoadUint64(&cs.dials),
+		DialErrors:               atomic.LoadUint64(&cs.dialErrors),
+		Reconnects:               atomic.LoadUint64(&cs.reconnects),
+		PendingRequests:          c.PendingRequests(),
+		RTT:                      c.RTT(),
+		Latency:                  cs.latency.Histogram(),
+	}
+}
+
+type serverCounters struct {
+	connCounters
+
+	conns                  uint64
+	handshakeErrors        uint64
+	requests               uint64
+	responses              uint64
+	concurrencyLimitErrors uint64
+	queueTimeouts          uint64
+	requestsTooLarge       uint64
+	handlerTimeouts        uint64
+	deferredTimeouts       uint64
+	openConns              int64
+	latency                LatencyHistogram
+}
+
+// addRequest accounts req read by the server. skipped is the size
+// of the skipped request body.
+func (ss *serverCounters) addRequest(req *fasthttp.Request, skipped int) {
+	atomic.AddUint64(&ss.requests, 1)
+	atomic.AddUint64(&ss.uncompressedBytesRead, uint64(requestSize(req)+skipped))
+}
+
+// addResponse accounts resp written by the server d after reading
+// the request.
+func (ss *serverCounters) addResponse(resp *fasthttp.Response, d time.Duration) {
+	atomic.AddUint64(&ss.responses, 1)
+	ss.latency.Add(d)
+	atomic.AddUint64(&ss.uncompressedBytesWritten, uint64(responseSize(resp)))
+}
+
+// Stats returns the server statistics.
+func (s *Server) Stats() ServerStats {
+	ss := &s.stats
+	return ServerStats{
+		Conns:                    atomic.LoadUint64(&ss.conns),
+		HandshakeErrors:          atomic.LoadUint64(&ss.handshakeErrors),
+		Requests:                 atomic.LoadUint64(&ss.requests),
+		Responses:                atomic.LoadUint64(&ss.responses),
+		ConcurrencyLimitErrors:   atomic.LoadUint64(&ss.concurrencyLimitErrors),
+		QueueTimeouts:            atomic.LoadUint64(&ss.queueTimeouts),
+		RequestsTooLarge:         atomic.LoadUint64(&ss.requestsTooLarge),
+		HandlerTimeouts:          atomic.LoadUint64(&ss.handlerTimeouts),
+		DeferredTimeouts:         atomic.LoadUint64(&ss.deferredTimeouts),
+		Panics:                   s.Panics(),
+		BytesWritten:             atomic.LoadUint64(&ss.bytesWritten),
+		BytesRead:                atomic.LoadUint64(&ss.bytesRead),
+		UncompressedBytesWritten: atomic.LoadUint64(&ss.uncompressedBytesWritten),
+		UncompressedBytesRead:    atomic.LoadUint64(&ss.uncompressedBytesRead),
+		BatchesFlushed:           atomic.LoadUint64(&ss.batchesFlushed),
+		BatchedResponses:         atomic.LoadUint64(&ss.batchedMessages),
+		OpenConns:                int(atomic.LoadInt64(&ss.openConns)),
+		Running:                  int(atomic.LoadInt32(&s.running)),
+		Queued:                   int(atomic.LoadInt32(&s.queued)),
+		BufferedBytes:            s.BufferedBytes(),
+		Latency:                  ss.latency.Histogram(),
+	}
+}
+
+// requestSize returns the size of req written to the connection.
+func requestSize(req *fasthttp.Request) int {
+	return 1 + len(req.Header.Header()) + len(req.Body())
+}
+
+// responseSize returns the size of resp written to the connection.
+func responseSize(resp *fasthttp.Response) int {
+	return 1 + len(resp.Header.Header()) + len(resp.Body())
+}
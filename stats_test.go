@@ -0,0 +1,131 @@
+package httpteleport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/valyala/fasthttp"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("done"))
+		},
+		CompressType:       CompressNone,
+		MaxRequestBodySize: 100,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.CompressType = CompressNone
+
+	for i := 0; i < 10; i++ {
+		if err := testDone(c); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+	}
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	req.SetBody(bytes.Repeat([]byte("a"), 200))
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if resp.StatusCode() != fasthttp.StatusRequestEntityTooLarge {
+		t.Fatalf("unexpected status code: %d. Expecting %d", resp.StatusCode(), fasthttp.StatusRequestEntityTooLarge)
+	}
+
+	cs := c.Stats()
+	if cs.Requests != 11 || cs.Responses != 11 {
+		t.Fatalf("unexpected client requests and responses: %d, %d. Expecting 11, 11", cs.Requests, cs.Responses)
+	}
+	if cs.Timeouts != 0 || cs.OtherErrors != 0 {
+		t.Fatalf("unexpected client errors: %+v", cs)
+	}
+	if cs.Dials != 1 || cs.DialErrors != 0 || cs.Reconnects != 0 {
+		t.Fatalf("unexpected client dials: %+v", cs)
+	}
+	// Requests are sent sequentially, so each batch contains a single request.
+	if cs.BatchesFlushed != 11 || cs.BatchedRequests != 11 || cs.AvgBatchSize() != 1 {
+		t.Fatalf("unexpected client batches: %+v", cs)
+	}
+	if cs.Latency.Count != 11 || cs.Latency.Counts[len(LatencyBuckets)-1] != 11 {
+		t.Fatalf("unexpected client latency histogram: %+v", cs.Latency)
+	}
+	if cs.UncompressedBytesWritten < 200 || cs.BytesWritten < cs.UncompressedBytesWritten {
+		t.Fatalf("unexpected client bytes written: %+v", cs)
+	}
+
+	ss := s.Stats()
+	if ss.Conns != 1 || ss.OpenConns != 1 {
+		t.Fatalf("unexpected server conns: %d, %d. Expecting 1, 1", ss.Conns, ss.OpenConns)
+	}
+	if ss.Requests != 11 || ss.Responses != 11 {
+		t.Fatalf("unexpected server requests and responses: %d, %d. Expecting 11, 11", ss.Requests, ss.Responses)
+	}
+	if ss.RequestsTooLarge != 1 {
+		t.Fatalf("unexpected number of too large requests: %d. Expecting 1", ss.RequestsTooLarge)
+	}
+
+	if ss.BatchesFlushed != 11 || ss.BatchedResponses != 11 || ss.AvgBatchSize() != 1 {
+		t.Fatalf("unexpected server batches: %+v", ss)
+	}
+
+	if ss.Latency.Count != 11 {
+		t.Fatalf("unexpected server latency histogram: %+v", ss.Latency)
+	}
+
+	// Connections aren't compressed, so the client and the server
+	// must see the same traffic.
+	if cs.BytesWritten != ss.BytesRead {
+		t.Fatalf("client bytes written mismatch server bytes read: %d vs %d", cs.BytesWritten, ss.BytesRead)
+	}
+	if cs.BytesRead != ss.BytesWritten {
+		t.Fatalf("client bytes read mismatch server bytes written: %d vs %d", cs.BytesRead, ss.BytesWritten)
+	}
+	if ss.UncompressedBytesRead == 0 || ss.UncompressedBytesWritten == 0 {
+		t.Fatalf("unexpected server uncompressed bytes: %+v", ss)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
+
+func TestStatsBatchesCompressTLS(t *testing.T) {
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			ctx.Success("text/plain", []byte("done"))
+		},
+		CompressType: CompressFlate,
+		TLSConfig:    newTestServerTLSConfig(),
+	}
+	serverStop, c := newTestServerClientExt(s)
+	c.CompressType = CompressFlate
+	c.TLSConfig = &tls.Config{
+		InsecureSkipVerify: true,
+	}
+	c.PingInterval = 10 * time.Millisecond
+
+	for i := 0; i < 10; i++ {
+		if err := testDone(c); err != nil {
+			t.Fatalf("unexpected error on iteration %d: %s", i, err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// Compressed and encrypted batches are written to the connection
+	// in multiple write calls, while pings mustn't be counted.
+	cs := c.Stats()
+	if cs.BatchesFlushed != 10 || cs.BatchedRequests != 10 {
+		t.Fatalf("unexpected client batches: %d, %d. Expecting 10, 10", cs.BatchesFlushed, cs.BatchedRequests)
+	}
+	ss := s.Stats()
+	if ss.BatchesFlushed != 10 || ss.BatchedResponses != 10 {
+		t.Fatalf("unexpected server batches: %d, %d. Expecting 10, 10", ss.BatchesFlushed, ss.BatchedResponses)
+	}
+
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+}
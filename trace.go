@@ -0,0 +1,251 @@
+package httpteleport
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"io"
+	"sync"
+	"time"
+)
+
+// Tracer creates spans for teleported requests.
+//
+// Tracer may be used for integrating Client and Server with distributed
+// tracing systems such as OpenTelemetry.
+type Tracer interface {
+	// StartSpan starts the span with the given name for req.
+	//
+	// parent is the trace context of the caller. It is zero
+	// if the request isn't traced yet.
+	//
+	// req must not be modified and must not be retained after returning
+	// from StartSpan.
+	StartSpan(name string, parent TraceContext, req *fasthttp.Request) Span
+}
+
+// Span is a span created by Tracer.
+//
+// Span methods may be called from concurrently running goroutines,
+// but AddEvent is never called after End.
+type Span interface {
+	// Context returns the trace context of the span.
+	//
+	// The context is propagated to the server in the request frame.
+	Context() TraceContext
+
+	// AddEvent records the event with the given name occurred at t.
+	//
+	// See SpanEvent* constants for event names.
+	AddEvent(name string, t time.Time)
+
+	// End finishes the span. err is nil for successful requests.
+	End(err error)
+}
+
+// Span events recorded by Client and Server.
+//
+// The time between SpanEventWritten and SpanEventFlushed is the batch
+// wait time for the request or the response. Compression time isn't
+// recorded as a separate event: the batch is compressed by the underlying
+// fastrpc connection in the same flush, which isn't observable from
+// Client and Server. So the interval includes compression time
+// unless CompressNone is used.
+const (
+	// SpanEventWritten is recorded when the request or the response
+	// is added to the batch.
+	//
+	// The time between the client span start and this event is the time
+	// the request spent in the queue of pending requests.
+	SpanEventWritten = "written"
+
+	// SpanEventFlushed is recorded when the batch with the request
+	// or the response is written to the connection, i.e. after
+	// the batch is compressed.
+	SpanEventFlushed = "flushed"
+
+	// SpanEventHandlerStarted is recorded when Server.Handler is called
+	// for the request.
+	//
+	// The time between the server span start and this event is the time
+	// the request spent in the queue due to Server concurrency limits.
+	SpanEventHandlerStarted = "handlerStarted"
+
+	// SpanEventHandlerFinished is recorded when the response
+	// is ready for sending to the client.
+	SpanEventHandlerFinished = "handlerFinished"
+)
+
+// TraceContext is W3C trace context.
+//
+// See https://www.w3.org/TR/trace-context/ for details.
+type TraceContext struct {
+	// TraceID is the id of the whole trace.
+	TraceID [16]byte
+
+	// SpanID is the id of the parent span.
+	SpanID [8]byte
+
+	// Flags are trace flags such as sampled flag.
+	Flags byte
+}
+
+// IsValid returns true if both TraceID and SpanID are non-zero.
+func (tc *TraceContext) IsValid() bool {
+	return tc.TraceID != [16]byte{} && tc.SpanID != [8]byte{}
+}
+
+// String returns tc in traceparent header format.
+func (tc *TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", tc.TraceID[:], tc.SpanID[:], tc.Flags)
+}
+
+// TraceparentHeader is the http header name for W3C trace context.
+//
+// Server sets the header in requests passed to Handler, while Client
+// uses it as a parent for client spans.
+const TraceparentHeader = "traceparent"
+
+// ParseTraceparent parses W3C traceparent header value.
+func ParseTraceparent(s string) (TraceContext, error) {
+	var tc TraceContext
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return tc, fmt.Errorf("cannot parse traceparent %q: unexpected format", s)
+	}
+	if s[:2] == "ff" || (s[:2] == "00" && len(s) != 55) {
+		return tc, fmt.Errorf("cannot parse traceparent %q: unsupported version", s)
+	}
+	var flags [1]byte
+	if err := decodeHex(tc.TraceID[:], s[3:35]); err != nil {
+		return tc, fmt.Errorf("cannot parse trace id in traceparent %q: %s", s, err)
+	}
+	if err := decodeHex(tc.SpanID[:], s[36:52]); err != nil {
+		return tc, fmt.Errorf("cannot parse span id in traceparent %q: %s", s, err)
+	}
+	if err := decodeHex(flags[:], s[53:55]); err != nil {
+		return tc, fmt.Errorf("cannot parse flags in traceparent %q: %s", s, err)
+	}
+	tc.Flags = flags[0]
+	if !tc.IsValid() {
+		return tc, fmt.Errorf("cannot parse traceparent %q: zero trace id or span id", s)
+	}
+	return tc, nil
+}
+
+func decodeHex(dst []byte, s string) error {
+	for i := 0; i < len(s); i++ {
+		// Only lowercase hex is allowed by the spec.
+		if c := s[i]; c >= 'A' && c <= 'F' {
+			return fmt.Errorf("unexpected uppercase hex char %q", c)
+		}
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err
+}
+
+// traceContextFromRequest returns the trace context from req headers.
+//
+// Zero trace context is returned if req has no valid traceparent header.
+func traceContextFromRequest(req *fasthttp.Request) TraceContext {
+	v := req.Header.Peek(TraceparentHeader)
+	if len(v) == 0 {
+		return TraceContext{}
+	}
+	tc, err := ParseTraceparent(string(v))
+	if err != nil {
+		return TraceContext{}
+	}
+	return tc
+}
+
+// traceContextSize is the size of the trace context in the request frame.
+const traceContextSize = 16 + 8 + 1
+
+func appendTraceContext(dst []byte, tc TraceContext) []byte {
+	dst = append(dst, tc.TraceID[:]...)
+	dst = append(dst, tc.SpanID[:]...)
+	return append(dst, tc.Flags)
+}
+
+func readTraceContext(br *bufio.Reader) (TraceContext, error) {
+	var tc TraceContext
+	var buf [traceContextSize]byte
+	if _, err := io.ReadFull(br, buf[:]); err != nil {
+		return tc, fmt.Errorf("cannot read trace context: %s", err)
+	}
+	copy(tc.TraceID[:], buf[:16])
+	copy(tc.SpanID[:], buf[16:24])
+	tc.Flags = buf[24]
+	return tc, nil
+}
+
+// traceSpan guarantees Span.AddEvent isn't called after Span.End.
+//
+// Events may be recorded after the span is finished, for instance,
+// the client span is finished on timeout, while the request is still
+// in the batch.
+type traceSpan struct {
+	s Span
+
+	mu    sync.Mutex
+	ended bool
+}
+
+func newTraceSpan(s Span) *traceSpan {
+	return &traceSpan{
+		s: s,
+	}
+}
+
+func (ts *traceSpan) addEvent(name string, t time.Time) {
+	ts.mu.Lock()
+	if !ts.ended {
+		ts.s.AddEvent(name, t)
+	}
+	ts.mu.Unlock()
+}
+
+func (ts *traceSpan) end(err error) {
+	ts.mu.Lock()
+	if !ts.ended {
+		ts.ended = true
+		ts.s.End(err)
+	}
+	ts.mu.Unlock()
+}
+
+// flushSpans contains spans waiting for SpanEventFlushed, i.e. spans
+// for requests or responses in the current batch.
+type flushSpans struct {
+	mu    sync.Mutex
+	spans []*traceSpan
+}
+
+func (fs *flushSpans) add(ts *traceSpan) {
+	fs.mu.Lock()
+	fs.spans = append(fs.spans, ts)
+	fs.mu.Unlock()
+}
+
+// flushed records SpanEventFlushed for all the pending spans.
+//
+// The spans are finished if end is set.
+func (fs *flushSpans) flushed(end bool, err error) {
+	fs.mu.Lock()
+	spans := fs.spans
+	fs.spans = nil
+	fs.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	t := time.Now()
+	for _, ts := range spans {
+		if err == nil {
+			ts.addEvent(SpanEventFlushed, t)
+		}
+		if end {
+			ts.end(err)
+		}
+	}
+}
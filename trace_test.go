@@ -0,0 +1,203 @@
+package httpteleport
+
+import (
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	f := func(s string, expectedTraceID, expectedSpanID string, expectedFlags byte) {
+		tc, err := ParseTraceparent(s)
+		if err != nil {
+			t.Fatalf("unexpected error when parsing %q: %s", s, err)
+		}
+		if traceID := fmt.Sprintf("%x", tc.TraceID[:]); traceID != expectedTraceID {
+			t.Fatalf("unexpected trace id: %q. Expecting %q", traceID, expectedTraceID)
+		}
+		if spanID := fmt.Sprintf("%x", tc.SpanID[:]); spanID != expectedSpanID {
+			t.Fatalf("unexpected span id: %q. Expecting %q", spanID, expectedSpanID)
+		}
+		if tc.Flags != expectedFlags {
+			t.Fatalf("unexpected flags: %d. Expecting %d", tc.Flags, expectedFlags)
+		}
+		if s[:2] == "00" && tc.String() != s {
+			t.Fatalf("unexpected string: %q. Expecting %q", tc.String(), s)
+		}
+	}
+	f("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", 1)
+	f("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", 0)
+	f("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-foobar", "0af7651916cd43dd8448eb211c80319c", "b7ad6b7169203331", 1)
+
+	fErr := func(s string) {
+		if _, err := ParseTraceparent(s); err == nil {
+			t.Fatalf("expecting non-nil error when parsing %q", s)
+		}
+	}
+	fErr("")
+	fErr("foobar")
+	fErr("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331")
+	fErr("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-foobar")
+	fErr("ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	fErr("00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01")
+	fErr("00-0af7651916cd43dd8448eb211c80319x-b7ad6b7169203331-01")
+	fErr("00-00000000000000000000000000000000-b7ad6b7169203331-01")
+	fErr("00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01")
+}
+
+func TestTracer(t *testing.T) {
+	serverTracer := &testTracer{}
+	var handlerTraceparent string
+	s := &Server{
+		Handler: func(ctx *fasthttp.RequestCtx) {
+			handlerTraceparent = string(ctx.Request.Header.Peek(TraceparentHeader))
+			ctx.Success("text/plain", []byte("done"))
+		},
+		Tracer: serverTracer,
+	}
+	serverStop, c := newTestServerClientExt(s)
+	clientTracer := &testTracer{}
+	c.Tracer = clientTracer
+
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	if err := testTraceRequest(c, parent); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+
+	cs := clientTracer.getSpan(t)
+	if cs.parent.String() != parent {
+		t.Fatalf("unexpected client span parent: %q. Expecting %q", cs.parent.String(), parent)
+	}
+	cs.checkEvents(t, SpanEventWritten, SpanEventFlushed)
+
+	ss := serverTracer.getSpan(t)
+	if ss.parent != cs.tc {
+		t.Fatalf("unexpected server span parent: %q. Expecting %q", ss.parent.String(), cs.tc.String())
+	}
+	if handlerTraceparent != ss.tc.String() {
+		t.Fatalf("unexpected traceparent passed to handler: %q. Expecting %q", handlerTraceparent, ss.tc.String())
+	}
+	ss.checkEvents(t, SpanEventHandlerStarted, SpanEventHandlerFinished, SpanEventFlushed)
+}
+
+func TestTracerClientOnly(t *testing.T) {
+	var handlerTraceparent string
+	serverStop, c := newTestServerClient(func(ctx *fasthttp.RequestCtx) {
+		handlerTraceparent = string(ctx.Request.Header.Peek(TraceparentHeader))
+		ctx.Success("text/plain", []byte("done"))
+	})
+	clientTracer := &testTracer{}
+	c.Tracer = clientTracer
+
+	// The client span context must be passed to the handler
+	// even if the server doesn't trace requests.
+	if err := testTraceRequest(c, ""); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := serverStop(); err != nil {
+		t.Fatalf("cannot shutdown server: %s", err)
+	}
+
+	cs := clientTracer.getSpan(t)
+	if cs.parent.IsValid() {
+		t.Fatalf("unexpected client span parent: %q", cs.parent.String())
+	}
+	if handlerTraceparent != cs.tc.String() {
+		t.Fatalf("unexpected traceparent passed to handler: %q. Expecting %q", handlerTraceparent, cs.tc.String())
+	}
+}
+
+func testTraceRequest(c *Client, traceparent string) error {
+	var req fasthttp.Request
+	var resp fasthttp.Response
+	req.SetRequestURI("http://foobar.com/aaa")
+	if len(traceparent) > 0 {
+		req.Header.Set(TraceparentHeader, traceparent)
+	}
+	if err := c.DoTimeout(&req, &resp, time.Second); err != nil {
+		return err
+	}
+	if string(resp.Body()) != "done" {
+		return fmt.Errorf("unexpected body: %q. Expecting %q", resp.Body(), "done")
+	}
+	return nil
+}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (tt *testTracer) StartSpan(name string, parent TraceContext, req *fasthttp.Request) Span {
+	tt.mu.Lock()
+	defer tt.mu.Unlock()
+	ts := &testSpan{
+		parent: parent,
+		endCh:  make(chan error, 1),
+	}
+	ts.tc.TraceID = parent.TraceID
+	if !parent.IsValid() {
+		ts.tc.TraceID[0] = 1
+	}
+	ts.tc.SpanID[0] = byte(len(tt.spans) + 1)
+	ts.tc.Flags = 1
+	tt.spans = append(tt.spans, ts)
+	return ts
+}
+
+func (tt *testTracer) getSpan(t *testing.T) *testSpan {
+	tt.mu.Lock()
+	spans := tt.spans
+	tt.mu.Unlock()
+	if len(spans) != 1 {
+		t.Fatalf("unexpected number of spans: %d. Expecting 1", len(spans))
+	}
+	ts := spans[0]
+	select {
+	case err := <-ts.endCh:
+		if err != nil {
+			t.Fatalf("unexpected span error: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout when waiting for span end")
+	}
+	return ts
+}
+
+type testSpan struct {
+	parent TraceContext
+	tc     TraceContext
+
+	mu     sync.Mutex
+	events []string
+	endCh  chan error
+}
+
+func (ts *testSpan) Context() TraceContext {
+	return ts.tc
+}
+
+func (ts *testSpan) AddEvent(name string, t time.Time) {
+	ts.mu.Lock()
+	ts.events = append(ts.events, name)
+	ts.mu.Unlock()
+}
+
+func (ts *testSpan) End(err error) {
+	ts.endCh <- err
+}
+
+func (ts *testSpan) checkEvents(t *testing.T, expectedEvents ...string) {
+	ts.mu.Lock()
+	events := ts.events
+	ts.mu.Unlock()
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Fatalf("unexpected span events: %q. Expecting %q", events, expectedEvents)
+	}
+}